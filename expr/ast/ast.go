@@ -0,0 +1,163 @@
+// Package ast declares the types used to represent the syntax tree of an expression.
+//
+// Trees are produced by expr.Parser.Parse, which resolves function names against the builtins
+// and the functions registered on that parser, and can be compiled back into an evaluable
+// program with expr.Parser.CompileNode.
+package ast
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Node is implemented by every node of the tree.
+type Node interface {
+	Pos() int // offset of the first byte of the node in the input
+	End() int // offset of the byte immediately after the node
+}
+
+// Span is the byte range [Start, Stop) of the input a node was parsed from.
+// Nodes that were built or rewritten rather than parsed have a zero span.
+type Span struct{ Start, Stop int }
+
+func (s Span) Pos() int { return s.Start }
+func (s Span) End() int { return s.Stop }
+
+// Op identifies the operator of a UnaryExpr or BinaryExpr.
+type Op int
+
+const (
+	Add    Op = iota // +
+	Sub              // -
+	Mul              // *
+	Div              // /
+	Mod              // %
+	Pow              // **
+	Eq               // ==
+	Neq              // !=
+	Lt               // <
+	Lte              // <=
+	Gt               // >
+	Gte              // >=
+	And              // &&
+	Or               // ||
+	BitAnd           // &
+	BitOr            // |
+	BitXor           // ^
+	Shl              // <<
+	Shr              // >>
+	Neg              // unary -
+	Not              // unary !
+	BitNot           // unary ~
+)
+
+var opSymbols = [...]string{
+	Add:    "+",
+	Sub:    "-",
+	Mul:    "*",
+	Div:    "/",
+	Mod:    "%",
+	Pow:    "**",
+	Eq:     "==",
+	Neq:    "!=",
+	Lt:     "<",
+	Lte:    "<=",
+	Gt:     ">",
+	Gte:    ">=",
+	And:    "&&",
+	Or:     "||",
+	BitAnd: "&",
+	BitOr:  "|",
+	BitXor: "^",
+	Shl:    "<<",
+	Shr:    ">>",
+	Neg:    "-",
+	Not:    "!",
+	BitNot: "~",
+}
+
+// String returns the operator as it is written in an expression.
+func (op Op) String() string {
+	if op < 0 || int(op) >= len(opSymbols) {
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+	return opSymbols[op]
+}
+
+// Unary reports whether op is a prefix operator.
+func (op Op) Unary() bool { return op == Neg || op == Not || op == BitNot }
+
+type (
+	// Number is a numeric literal.
+	Number struct {
+		Span
+		Value float64
+		Lit   string // the literal as written in the input, empty for synthesized numbers, which are floats
+	}
+
+	// StringLit is a quoted string literal.
+	StringLit struct {
+		Span
+		Value string
+		Lit   string // the literal as written in the input, quotes and escapes included, empty for synthesized strings
+	}
+
+	// Ident is a named variable, or the %P placeholder.
+	Ident struct {
+		Span
+		Name string
+	}
+
+	// UnaryExpr is a prefix operator applied to X.
+	UnaryExpr struct {
+		Span
+		Op Op
+		X  Node
+	}
+
+	// BinaryExpr is an infix operator applied to X and Y.
+	BinaryExpr struct {
+		Span
+		Op   Op
+		X, Y Node
+	}
+
+	// CondExpr is the ternary Cond ? Then : Else.
+	CondExpr struct {
+		Span
+		Cond, Then, Else Node
+	}
+
+	// CallExpr is a call to a builtin or registered function.
+	CallExpr struct {
+		Span
+		Func string
+		Args []Node
+	}
+)
+
+// NewNumber returns a synthesized numeric literal.
+func NewNumber(value float64) *Number {
+	return &Number{Value: value}
+}
+
+// String returns the literal as written, or the shortest representation of its value.
+func (n *Number) String() string {
+	if n.Lit != "" {
+		return n.Lit
+	}
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+// NewString returns a synthesized string literal.
+func NewString(value string) *StringLit {
+	return &StringLit{Value: value}
+}
+
+// String returns the literal as written, or its value quoted with Go escapes.
+func (s *StringLit) String() string {
+	if s.Lit != "" {
+		return s.Lit
+	}
+	return strconv.Quote(s.Value)
+}
@@ -0,0 +1,141 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Binding strength of each grammar level, from the loosest (the ternary) to the tightest (a base term).
+const (
+	precCond = iota + 1
+	precOr
+	precAnd
+	precBitOr
+	precBitXor
+	precBitAnd
+	precEquality
+	precRelational
+	precShift
+	precAdditive
+	precMultiplicative
+	precUnary
+	precPower
+	precBase
+)
+
+// Precedence returns the binding strength of op; operators with a higher precedence bind tighter.
+func (op Op) Precedence() int {
+	switch op {
+	case Or:
+		return precOr
+	case And:
+		return precAnd
+	case BitOr:
+		return precBitOr
+	case BitXor:
+		return precBitXor
+	case BitAnd:
+		return precBitAnd
+	case Eq, Neq:
+		return precEquality
+	case Lt, Lte, Gt, Gte:
+		return precRelational
+	case Shl, Shr:
+		return precShift
+	case Add, Sub:
+		return precAdditive
+	case Mul, Div, Mod:
+		return precMultiplicative
+	case Neg, Not, BitNot:
+		return precUnary
+	case Pow:
+		return precPower
+	}
+	return 0
+}
+
+// Format returns the canonical text of the tree: operators are separated by single spaces, arguments
+// by ", ", and parentheses are only kept where precedence or associativity requires them, so parsing
+// the result yields the same tree.
+func Format(node Node) string {
+	var sb strings.Builder
+	format(&sb, node, 0)
+	return sb.String()
+}
+
+// Writes node, parenthesized when it binds looser than min.
+func format(sb *strings.Builder, node Node, min int) {
+	if precedence(node) < min {
+		sb.WriteString("(")
+		defer sb.WriteString(")")
+	}
+
+	switch n := node.(type) {
+	case *Number:
+		sb.WriteString(n.String())
+
+	case *StringLit:
+		sb.WriteString(n.String())
+
+	case *Ident:
+		sb.WriteString(n.Name)
+
+	case *UnaryExpr:
+		sb.WriteString(n.Op.String())
+		// Keeps "- -x" from being written as the decrement-looking "--x"
+		if inner, ok := n.X.(*UnaryExpr); ok && inner.Op == n.Op && n.Op == Neg {
+			sb.WriteString(" ")
+		}
+		format(sb, n.X, precUnary)
+
+	case *BinaryExpr:
+		prec := n.Op.Precedence()
+		left, right := prec, prec+1 // left-associative
+		if n.Op == Pow {
+			left, right = precBase, precUnary // P -> B [** F]
+		}
+
+		format(sb, n.X, left)
+		sb.WriteString(" ")
+		sb.WriteString(n.Op.String())
+		sb.WriteString(" ")
+		format(sb, n.Y, right)
+
+	case *CondExpr:
+		format(sb, n.Cond, precOr) // C -> O [? C : C]
+		sb.WriteString(" ? ")
+		format(sb, n.Then, precCond)
+		sb.WriteString(" : ")
+		format(sb, n.Else, precCond)
+
+	case *CallExpr:
+		sb.WriteString(n.Func)
+		sb.WriteString("(")
+		for ix, arg := range n.Args {
+			if ix > 0 {
+				sb.WriteString(", ")
+			}
+			format(sb, arg, precCond)
+		}
+		sb.WriteString(")")
+
+	default:
+		panic(fmt.Sprintf("ast.Format: unexpected node type %T", n))
+	}
+}
+
+func precedence(node Node) int {
+	switch n := node.(type) {
+	case *Number:
+		if n.String()[0] == '-' {
+			return precUnary // written as a negation of its magnitude
+		}
+	case *UnaryExpr:
+		return n.Op.Precedence()
+	case *BinaryExpr:
+		return n.Op.Precedence()
+	case *CondExpr:
+		return precCond
+	}
+	return precBase
+}
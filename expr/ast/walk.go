@@ -0,0 +1,108 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree depth-first: it starts by calling v.Visit(node); node must not be nil.
+// If the visitor w returned by v.Visit(node) is not nil, Walk is invoked recursively with visitor
+// w for each of the non-nil children of node, followed by a call of w.Visit(nil).
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Number, *StringLit, *Ident:
+		// leaves
+
+	case *UnaryExpr:
+		Walk(v, n.X)
+
+	case *BinaryExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+
+	case *CondExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
+	case *CallExpr:
+		for _, arg := range n.Args {
+			Walk(v, arg)
+		}
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree in depth-first order: it starts by calling f(node); node must not be nil.
+// If f returns true, Inspect invokes f recursively for each of the non-nil children of node,
+// followed by a call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrite returns a copy of the tree in which every node has been replaced by the result of f.
+// Children are rewritten before their parent, so f sees each node with its rewritten children
+// already in place. Returning the node unchanged keeps it; the input tree is never modified.
+func Rewrite(node Node, f func(Node) Node) Node {
+	switch n := node.(type) {
+	case *Number:
+		c := *n
+		node = &c
+
+	case *StringLit:
+		c := *n
+		node = &c
+
+	case *Ident:
+		c := *n
+		node = &c
+
+	case *UnaryExpr:
+		c := *n
+		c.X = Rewrite(n.X, f)
+		node = &c
+
+	case *BinaryExpr:
+		c := *n
+		c.X, c.Y = Rewrite(n.X, f), Rewrite(n.Y, f)
+		node = &c
+
+	case *CondExpr:
+		c := *n
+		c.Cond, c.Then, c.Else = Rewrite(n.Cond, f), Rewrite(n.Then, f), Rewrite(n.Else, f)
+		node = &c
+
+	case *CallExpr:
+		c := *n
+		c.Args = make([]Node, len(n.Args))
+		for ix, arg := range n.Args {
+			c.Args[ix] = Rewrite(arg, f)
+		}
+		node = &c
+
+	default:
+		panic(fmt.Sprintf("ast.Rewrite: unexpected node type %T", n))
+	}
+	return f(node)
+}
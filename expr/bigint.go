@@ -0,0 +1,239 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+	"strings"
+)
+
+// DivisionMode selects how integer division rounds in parsers created with IntegerMode.
+type DivisionMode uint8
+
+const (
+	TruncatedDivision DivisionMode = iota // quotients round toward zero and remainders take the sign of the dividend, as in Go
+	FlooredDivision                       // quotients round toward negative infinity and remainders take the sign of the divisor, as in Python
+)
+
+// The most bits a big integer result may take, which bounds the memory and time a single operator can use.
+const bigIntMaxBits = 1 << 20
+
+// IntegerMode selects exact integer arithmetic for the parser: integer literals, and the variables of the
+// programs it compiles holding whole numbers, are big integers, which the arithmetic and bitwise operators
+// and builtins compute exactly however large they get. / divides them into an integer, rounding as div
+// selects. Floats are left as they are, and promote big integers they meet to floats. It replaces any other
+// number mode given before it.
+func IntegerMode(div DivisionMode) ParserOption {
+	return func(p *Parser) {
+		p.resetMode()
+		p.integer = &integerContext{div: div}
+	}
+}
+
+// The division mode of big integer arithmetic.
+type integerContext struct {
+	div DivisionMode
+}
+
+// The integer context of big integers supplied by the caller through BigIntValue.
+var defaultInteger = &integerContext{div: TruncatedDivision}
+
+// A big integer. Its value is never modified once built.
+type bigInt struct {
+	n   *big.Int
+	ctx *integerContext
+}
+
+// BigIntValue returns a Value holding a copy of n, which divides by truncating unless it meets a big integer
+// of a parser in IntegerMode.
+func BigIntValue(n *big.Int) Value {
+	return defaultInteger.value(new(big.Int).Set(n))
+}
+
+func (ctx *integerContext) value(n *big.Int) Value {
+	return Value{kind: BigInt, b: &bigInt{n: n, ctx: ctx}}
+}
+
+// Parses an integer literal, of any size, as a big integer. Reports false for literals that are not
+// integers, which are parsed as floats.
+func (ctx *integerContext) literal(lit string) (Value, bool) {
+	prefixed := len(lit) > 1 && lit[0] == '0' && isIntPrefix(rune(lit[1]))
+	if !prefixed && strings.ContainsAny(lit, ".eE") {
+		return Value{}, false
+	}
+
+	var n *big.Int
+	var ok bool
+	if prefixed {
+		n, ok = new(big.Int).SetString(lit, 0)
+	} else {
+		n, ok = new(big.Int).SetString(strings.ReplaceAll(lit, "_", ""), 10) // leading zeros are not octal
+	}
+
+	if !ok {
+		return Value{}, false
+	}
+	return ctx.value(n), true
+}
+
+// Converts an int, a big integer or a float holding a whole number into a big integer, reporting false
+// for any other value.
+func bigOperand(v Value) (*big.Int, bool) {
+	switch v.kind {
+	case Int:
+		return big.NewInt(v.i), true
+	case BigInt:
+		return v.b.n, true
+	case Float:
+		if v.f == math.Trunc(v.f) && !math.IsInf(v.f, 0) {
+			n, _ := big.NewFloat(v.f).Int(nil)
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the context of the first big integer argument, or nil when there is none.
+func integerArg(params []Value) *integerContext {
+	for _, param := range params {
+		if param.kind == BigInt {
+			return param.b.ctx
+		}
+	}
+	return nil
+}
+
+// Checks the size of a result, which fails with ErrInvalidValue beyond bigIntMaxBits.
+func (ctx *integerContext) finish(n *big.Int) (Value, error) {
+	if n.BitLen() > bigIntMaxBits {
+		return Value{}, newEvalError(ErrInvalidValue, span{}, INTEGER_OUT_OF_RANGE, bigIntMaxBits)
+	}
+	return ctx.value(n), nil
+}
+
+// Applies an arithmetic or comparison operator to two big integers in the context of ctx.
+func (ctx *integerContext) op(op opcode, a, b *big.Int) (Value, error) {
+	switch op {
+	case opAdd:
+		return ctx.finish(new(big.Int).Add(a, b))
+	case opSub:
+		return ctx.finish(new(big.Int).Sub(a, b))
+	case opMul:
+		if a.BitLen()+b.BitLen() > bigIntMaxBits+1 {
+			return Value{}, newEvalError(ErrInvalidValue, span{}, INTEGER_OUT_OF_RANGE, bigIntMaxBits)
+		}
+		return ctx.finish(new(big.Int).Mul(a, b))
+
+	case opDiv, opMod:
+		if b.Sign() == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+
+		q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+		if ctx.div == FlooredDivision && r.Sign() != 0 && r.Sign() != b.Sign() {
+			q.Sub(q, bigOne)
+			r.Add(r, b)
+		}
+
+		if op == opDiv {
+			return ctx.value(q), nil
+		}
+		return ctx.value(r), nil
+
+	case opPow:
+		if b.Sign() < 0 {
+			return floatOp(op, bigFloat(a), bigFloat(b)) // a fraction, as for ints
+		}
+
+		if a.CmpAbs(bigOne) > 0 && (!b.IsInt64() || b.Int64() > int64(bigIntMaxBits/(a.BitLen()-1))) {
+			return Value{}, newEvalError(ErrInvalidValue, span{}, INTEGER_OUT_OF_RANGE, bigIntMaxBits)
+		}
+		return ctx.finish(new(big.Int).Exp(a, b, nil))
+
+	case opEq:
+		return BoolValue(a.Cmp(b) == 0), nil
+	case opNeq:
+		return BoolValue(a.Cmp(b) != 0), nil
+	case opLt:
+		return BoolValue(a.Cmp(b) < 0), nil
+	case opLte:
+		return BoolValue(a.Cmp(b) <= 0), nil
+	case opGt:
+		return BoolValue(a.Cmp(b) > 0), nil
+	case opGte:
+		return BoolValue(a.Cmp(b) >= 0), nil
+	}
+	return ctx.bitwise(op, a, b)
+}
+
+// Applies a bitwise operator to two big integers, which behave as infinitely sign-extended two's complement.
+func (ctx *integerContext) bitwise(op opcode, a, b *big.Int) (Value, error) {
+	switch op {
+	case opBitAnd:
+		return ctx.value(new(big.Int).And(a, b)), nil
+	case opBitOr:
+		return ctx.value(new(big.Int).Or(a, b)), nil
+	case opBitXor:
+		return ctx.value(new(big.Int).Xor(a, b)), nil
+	case opShl, opShr:
+		return ctx.shift(a, b, op == opShl)
+	}
+	return Value{}, newEvalError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+}
+
+// Shifts x by n bits. Right shifts round toward negative infinity, as they do for ints.
+func (ctx *integerContext) shift(x, n *big.Int, left bool) (Value, error) {
+	if n.Sign() < 0 {
+		return Value{}, newEvalError(ErrNegativeShift, span{}, NEGATIVE_SHIFT_COUNT)
+	}
+
+	if left {
+		if x.Sign() != 0 && (!n.IsInt64() || n.Int64() > int64(bigIntMaxBits-x.BitLen())) {
+			return Value{}, newEvalError(ErrInvalidValue, span{}, INTEGER_OUT_OF_RANGE, bigIntMaxBits)
+		}
+		return ctx.value(new(big.Int).Lsh(x, uint(n.Uint64()))), nil
+	}
+
+	// Shifting by the bit length or more leaves only the sign
+	count := uint(x.BitLen() + 1)
+	if n.IsInt64() && n.Int64() < int64(count) {
+		count = uint(n.Int64())
+	}
+	return ctx.value(new(big.Int).Rsh(x, count)), nil
+}
+
+// Rounds x to a multiple of 10^places, rounding halves to even, for ROUND with negative decimal places.
+func (ctx *integerContext) round(x *big.Int, places int64) Value {
+	if places <= 0 || x.Sign() == 0 {
+		return ctx.value(x)
+	}
+
+	// Beyond the number of digits of x, the result is 0
+	if places > digits(x) {
+		return ctx.value(new(big.Int))
+	}
+
+	unit := pow10(places)
+	q, r := new(big.Int).QuoRem(x, unit, new(big.Int))
+	half := r.Abs(r).Lsh(r, 1).Cmp(unit)
+	if half > 0 || half == 0 && q.Bit(0) == 1 {
+		q.Add(q, big.NewInt(int64(x.Sign())))
+	}
+	return ctx.value(q.Mul(q, unit))
+}
+
+// Returns the float nearest to x, which is an infinity beyond the range of floats.
+func bigFloat(x *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(x).Float64()
+	return f
+}
+
+// Returns x as an int64, saturating beyond its range.
+func bigInt64(x *big.Int) int64 {
+	switch {
+	case x.IsInt64():
+		return x.Int64()
+	case x.Sign() < 0:
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
@@ -0,0 +1,143 @@
+package expr
+
+import (
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+// The identifier that is the imaginary unit in parsers created with ComplexMode.
+const imaginaryUnit = "i"
+
+// The constants of programs compiled by parsers created with ComplexMode, which are only used when the
+// resolver has no variable of the same name.
+var complexConstants = map[string]complex128{"PI": math.Pi, "E": math.E}
+
+// ComplexMode selects complex arithmetic for the parser: number literals, and the numeric variables of the
+// programs it compiles, are complex numbers. A number literal followed by i, as in 4i or 2.5e3i, is imaginary,
+// and i on its own is the imaginary unit rather than a variable. PI and E are the constants π and e, unless
+// a variable of the same name is resolved.
+// Complex numbers cannot be combined with another number mode, which ComplexMode replaces.
+func ComplexMode() ParserOption {
+	return func(p *Parser) {
+		p.resetMode()
+		p.complex = true
+	}
+}
+
+// ComplexValue returns a Value holding c.
+func ComplexValue(c complex128) Value { return Value{kind: Complex, c: c} }
+
+// Parses a number literal, which is imaginary when it ends in i, or the imaginary unit, as a complex number.
+func complexLiteral(lit string) (Value, bool) {
+	if lit == imaginaryUnit {
+		return ComplexValue(1i), true
+	}
+
+	imaginary := strings.HasSuffix(lit, imaginaryUnit)
+	if imaginary {
+		lit = lit[:len(lit)-1]
+	}
+
+	value, ok := parseNumber(lit)
+	if !ok {
+		return Value{}, false
+	}
+
+	if imaginary {
+		return ComplexValue(complex(0, value.Float())), true
+	}
+	return ComplexValue(complex(value.Float(), 0)), true
+}
+
+// Converts a number into a complex number, reporting false for bools and strings.
+func complexOperand(v Value) (complex128, bool) {
+	switch v.kind {
+	case Complex:
+		return v.c, true
+	case Bool, String, dualKind:
+		return 0, false
+	}
+	return complex(v.Float(), 0), true
+}
+
+// Reports whether any of the arguments is a complex number.
+func complexArg(params []Value) bool {
+	for _, param := range params {
+		if param.kind == Complex {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies an operator to two complex numbers. The ordering operators and % are defined only when
+// both are real.
+func complexOp(op opcode, a, b complex128) (Value, error) {
+	switch op {
+	case opAdd:
+		return ComplexValue(a + b), nil
+	case opSub:
+		return ComplexValue(a - b), nil
+	case opMul:
+		return ComplexValue(a * b), nil
+	case opDiv:
+		if b == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		return ComplexValue(a / b), nil
+	case opPow:
+		return ComplexValue(powComplex(a, b)), nil
+	case opEq:
+		return BoolValue(a == b), nil
+	case opNeq:
+		return BoolValue(a != b), nil
+	}
+
+	if imag(a) != 0 || imag(b) != 0 {
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED, opSymbols[op], Complex)
+	}
+
+	res, err := floatOp(op, real(a), real(b))
+	if err != nil || res.kind != Float {
+		return res, err
+	}
+	return ComplexValue(complex(res.f, 0)), nil
+}
+
+// Raises a to the power of b. Small integer powers are multiplied out, which keeps i ** 2 exactly -1
+// where cmplx.Pow leaves a rounding error in the imaginary part.
+func powComplex(a, b complex128) complex128 {
+	n := real(b)
+	if imag(b) != 0 || n != math.Trunc(n) || math.Abs(n) > 64 {
+		return cmplx.Pow(a, b)
+	}
+
+	res := complex(1, 0)
+	for k := int(math.Abs(n)); k > 0; k-- {
+		res *= a
+	}
+
+	if n < 0 {
+		return 1 / res
+	}
+	return res
+}
+
+// Formats a complex number as a sum of its real and imaginary parts, leaving out a part that is zero.
+func formatComplex(c complex128) string {
+	re, im := real(c), imag(c)
+	switch {
+	case im == 0:
+		return strconv.FormatFloat(re, 'g', -1, 64)
+	case re == 0:
+		return strconv.FormatFloat(im, 'g', -1, 64) + imaginaryUnit
+	}
+
+	sign := "+"
+	if im < 0 || math.IsInf(im, 1) {
+		sign = "" // formatted with the number
+	}
+	return strconv.FormatFloat(re, 'g', -1, 64) + sign + strconv.FormatFloat(im, 'g', -1, 64) + imaginaryUnit
+}
@@ -0,0 +1,498 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultDecimalPrecision is the precision, in significant digits, of parsers created with DecimalMode(0, mode).
+// It is that of IEEE 754 decimal128.
+const DefaultDecimalPrecision = 34
+
+// The adjusted exponents of decimals are kept to those of decimal128. Results above the range fail, and
+// results below it are flushed to zero, which also bounds the work of aligning two operands.
+const (
+	decimalMaxExp = 6144
+	decimalMinExp = -6143
+
+	// Exponents are clamped to this far beyond the range, which keeps adding the digits of a coefficient
+	// to them from overflowing an int64 without bringing them back within it
+	decimalExpLimit = 1 << 40
+)
+
+// DecimalMode selects decimal arithmetic for the parser: number literals, and the variables of the programs it
+// compiles, are decimals, which add, subtract, multiply and take the modulo exactly, and round divisions and
+// other inexact results to precision significant digits in the given mode. A precision of 0 selects
+// DefaultDecimalPrecision. Like the other number modes, it replaces any given before it.
+func DecimalMode(precision uint, mode big.RoundingMode) ParserOption {
+	if precision == 0 {
+		precision = DefaultDecimalPrecision
+	}
+	return func(p *Parser) {
+		p.resetMode()
+		p.decimal = &decimalContext{prec: precision, mode: mode}
+	}
+}
+
+// The precision, in significant digits, and the rounding mode of decimal arithmetic.
+type decimalContext struct {
+	prec uint
+	mode big.RoundingMode
+}
+
+// The decimal context of parsers that were not created with DecimalMode, used by ROUND on floats.
+var defaultDecimal = &decimalContext{prec: DefaultDecimalPrecision, mode: big.ToNearestEven}
+
+// A decimal number coef × 10^exp. Decimals are never modified once built.
+type decimal struct {
+	coef *big.Int
+	exp  int64
+	ctx  *decimalContext
+}
+
+var (
+	bigOne = big.NewInt(1)
+	bigTen = big.NewInt(10)
+)
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(n), nil)
+}
+
+// Returns the number of decimal digits of x, ignoring its sign. Zero has one digit.
+func digits(x *big.Int) int64 {
+	if x.Sign() == 0 {
+		return 1
+	}
+
+	// Starts from a lower bound derived from the bit length and counts up from there
+	n := int64(float64(x.BitLen()-1)*math.Log10(2)) + 1
+	abs := new(big.Int).Abs(x)
+	for p := pow10(n); abs.Cmp(p) >= 0; p.Mul(p, bigTen) {
+		n++
+	}
+	return n
+}
+
+// Divides coef by 10^drop, rounding the digits dropped according to mode.
+func shiftRound(coef *big.Int, drop int64, mode big.RoundingMode) *big.Int {
+	if drop <= 0 {
+		return coef
+	}
+
+	// Digits more than one place below the last kept one only matter for being non-zero
+	if drop > digits(coef)+1 {
+		coef, drop = big.NewInt(int64(coef.Sign())), 2
+	}
+
+	div := pow10(drop)
+	q, r := new(big.Int).QuoRem(coef, div, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+
+	neg := coef.Sign() < 0
+	half := new(big.Int).Abs(r)
+	cmp := half.Lsh(half, 1).Cmp(div)
+
+	var away bool
+	switch mode {
+	case big.ToNearestEven:
+		away = cmp > 0 || cmp == 0 && q.Bit(0) == 1
+	case big.ToNearestAway:
+		away = cmp >= 0
+	case big.AwayFromZero:
+		away = true
+	case big.ToNegativeInf:
+		away = neg
+	case big.ToPositiveInf:
+		away = !neg
+	}
+
+	if away && neg {
+		q.Sub(q, bigOne)
+	} else if away {
+		q.Add(q, bigOne)
+	}
+	return q
+}
+
+// Builds the decimal coef × 10^exp rounded to the precision of ctx, failing when it is out of range.
+func (ctx *decimalContext) finish(coef *big.Int, exp int64) (*decimal, error) {
+	exp = limitExp(exp)
+	if n := digits(coef); n > int64(ctx.prec) {
+		drop := n - int64(ctx.prec)
+		coef, exp = shiftRound(coef, drop, ctx.mode), exp+drop
+
+		// Rounding 99.9 up carries into a new digit
+		if digits(coef) > int64(ctx.prec) {
+			coef, exp = coef.Quo(coef, bigTen), exp+1
+		}
+	}
+
+	if coef.Sign() == 0 {
+		return &decimal{coef: coef, exp: clampExp(exp), ctx: ctx}, nil
+	}
+
+	adjusted := exp + digits(coef) - 1
+	switch {
+	case adjusted > decimalMaxExp:
+		return nil, newEvalError(ErrInvalidValue, span{}, DECIMAL_OUT_OF_RANGE)
+	case adjusted < decimalMinExp:
+		return &decimal{coef: new(big.Int), exp: decimalMinExp, ctx: ctx}, nil
+	}
+	return &decimal{coef: coef, exp: exp, ctx: ctx}, nil
+}
+
+func limitExp(exp int64) int64 {
+	if exp > decimalExpLimit {
+		return decimalExpLimit
+	}
+	if exp < -decimalExpLimit {
+		return -decimalExpLimit
+	}
+	return exp
+}
+
+func clampExp(exp int64) int64 {
+	if exp > decimalMaxExp {
+		return decimalMaxExp
+	}
+	if exp < decimalMinExp {
+		return decimalMinExp
+	}
+	return exp
+}
+
+// Parses a decimal literal with an optional fraction and exponent, whose digits may be separated by
+// underscores, or a hex, octal or binary integer literal.
+func (ctx *decimalContext) parse(lit string) (*decimal, error) {
+	lit = strings.ReplaceAll(lit, "_", "")
+	if len(lit) > 1 && lit[0] == '0' && isIntPrefix(rune(lit[1])) {
+		coef, ok := new(big.Int).SetString(lit, 0)
+		if !ok {
+			return nil, strconv.ErrSyntax
+		}
+		return ctx.finish(coef, 0)
+	}
+
+	mantissa, exp := lit, int64(0)
+	if ix := strings.IndexAny(lit, "eE"); ix >= 0 {
+		var err error
+		if exp, err = strconv.ParseInt(lit[ix+1:], 10, 64); err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, err
+		}
+		mantissa, exp = lit[:ix], limitExp(exp)
+	}
+
+	if ix := strings.IndexByte(mantissa, '.'); ix >= 0 {
+		exp -= int64(len(mantissa) - ix - 1)
+		mantissa = mantissa[:ix] + mantissa[ix+1:]
+	}
+
+	coef, ok := new(big.Int).SetString(mantissa, 10)
+	if !ok {
+		return nil, strconv.ErrSyntax
+	}
+	return ctx.finish(coef, exp)
+}
+
+// Parses a number literal that was already validated by parseNumber, failing with ErrInvalidValue when it
+// is out of range.
+func (ctx *decimalContext) literal(lit string) (Value, error) {
+	d, err := ctx.parse(lit)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{kind: Decimal, d: d}, nil
+}
+
+// Converts an int or a float into a decimal. Floats are converted from their shortest representation,
+// so 0.1 becomes exactly 0.1 rather than the binary fraction closest to it.
+func (ctx *decimalContext) convert(v Value) (*decimal, error) {
+	switch v.kind {
+	case Decimal:
+		return v.d, nil
+	case Int:
+		return ctx.finish(big.NewInt(v.i), 0)
+	case BigInt:
+		return ctx.finish(new(big.Int).Set(v.b.n), 0)
+	case Float:
+		if math.IsNaN(v.f) || math.IsInf(v.f, 0) {
+			return nil, newEvalError(ErrInvalidValue, span{}, NOT_A_DECIMAL, v.describe())
+		}
+		return ctx.parse(strconv.FormatFloat(v.f, 'e', -1, 64))
+	}
+	return nil, newEvalError(ErrTypeMismatch, span{}, NUMBER_EXPECTED, v.describe())
+}
+
+func decimalValue(d *decimal, err error) (Value, error) {
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{kind: Decimal, d: d}, nil
+}
+
+// Returns the coefficients of x and y scaled to their common, smaller, exponent.
+func align(x, y *decimal) (*big.Int, *big.Int, int64) {
+	switch {
+	case x.exp > y.exp:
+		return new(big.Int).Mul(x.coef, pow10(x.exp-y.exp)), y.coef, y.exp
+	case x.exp < y.exp:
+		return x.coef, new(big.Int).Mul(y.coef, pow10(y.exp-x.exp)), x.exp
+	}
+	return x.coef, y.coef, x.exp
+}
+
+func (x *decimal) cmp(y *decimal) int {
+	if x.coef.Sign() != y.coef.Sign() || x.coef.Sign() == 0 {
+		return x.coef.Sign() - y.coef.Sign()
+	}
+
+	a, b, _ := align(x, y)
+	return a.Cmp(b)
+}
+
+func (x *decimal) neg() *decimal {
+	return &decimal{coef: new(big.Int).Neg(x.coef), exp: x.exp, ctx: x.ctx}
+}
+
+// Applies an arithmetic or comparison operator to two decimals, rounding to the context of x.
+func decimalOp(op opcode, x, y *decimal) (Value, error) {
+	ctx := x.ctx
+	var res *decimal
+	var err error
+
+	switch op {
+	case opAdd, opSub:
+		a, b, exp := align(x, y)
+		if op == opSub {
+			res, err = ctx.finish(new(big.Int).Sub(a, b), exp)
+		} else {
+			res, err = ctx.finish(new(big.Int).Add(a, b), exp)
+		}
+
+	case opMul:
+		res, err = ctx.finish(new(big.Int).Mul(x.coef, y.coef), x.exp+y.exp)
+
+	case opDiv:
+		res, err = ctx.quo(x, y)
+
+	case opMod:
+		if y.coef.Sign() == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		a, b, exp := align(x, y)
+		res, err = ctx.finish(new(big.Int).Rem(a, b), exp)
+
+	case opPow:
+		res, err = ctx.pow(x, y)
+
+	case opEq:
+		return BoolValue(x.cmp(y) == 0), nil
+	case opNeq:
+		return BoolValue(x.cmp(y) != 0), nil
+	case opLt:
+		return BoolValue(x.cmp(y) < 0), nil
+	case opLte:
+		return BoolValue(x.cmp(y) <= 0), nil
+	case opGt:
+		return BoolValue(x.cmp(y) > 0), nil
+	case opGte:
+		return BoolValue(x.cmp(y) >= 0), nil
+
+	default:
+		return Value{}, newEvalError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+	}
+
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{kind: Decimal, d: res}, nil
+}
+
+// Divides x by y, rounding the quotient to the precision of ctx. Exact quotients drop the trailing zeros
+// that the extra digits computed for rounding leave behind.
+func (ctx *decimalContext) quo(x, y *decimal) (*decimal, error) {
+	if y.coef.Sign() == 0 {
+		return nil, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+	}
+
+	ideal := x.exp - y.exp
+	if x.coef.Sign() == 0 {
+		return ctx.finish(new(big.Int), ideal)
+	}
+
+	// Scales x so that the quotient has at least one digit more than the precision
+	scale := int64(ctx.prec) + digits(y.coef) - digits(x.coef) + 1
+	if scale < 0 {
+		scale = 0
+	}
+
+	num := new(big.Int).Mul(x.coef, pow10(scale))
+	q, r := num.QuoRem(num, y.coef, new(big.Int))
+	exp := ideal - scale
+
+	if r.Sign() != 0 {
+		// A sticky digit keeps the remainder from being mistaken for an exact half when rounding
+		q.Mul(q, bigTen)
+		if q.Sign() < 0 {
+			q.Sub(q, bigOne)
+		} else {
+			q.Add(q, bigOne)
+		}
+		return ctx.finish(q, exp-1)
+	}
+
+	digit := new(big.Int)
+	for exp < ideal {
+		if _, digit = new(big.Int).QuoRem(q, bigTen, digit); digit.Sign() != 0 {
+			break
+		}
+		q.Quo(q, bigTen)
+		exp++
+	}
+	return ctx.finish(q, exp)
+}
+
+// Raises x to the power y. Whole exponents are computed by squaring with a few guard digits, and any
+// others through float64.
+func (ctx *decimalContext) pow(x, y *decimal) (*decimal, error) {
+	n, ok := y.int64()
+	if !ok {
+		return ctx.convert(FloatValue(math.Pow(x.float(), y.float())))
+	}
+
+	work := &decimalContext{prec: ctx.prec + 10, mode: ctx.mode}
+	res, base := &decimal{coef: big.NewInt(1), ctx: work}, x
+	var err error
+	for m := abs64(n); m > 0; m >>= 1 {
+		if m&1 == 1 {
+			if res, err = work.finish(new(big.Int).Mul(res.coef, base.coef), res.exp+base.exp); err != nil {
+				return nil, err
+			}
+		}
+
+		if m > 1 {
+			if base, err = work.finish(new(big.Int).Mul(base.coef, base.coef), base.exp*2); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if n < 0 {
+		return ctx.quo(&decimal{coef: big.NewInt(1), ctx: ctx}, res)
+	}
+	return ctx.finish(res.coef, res.exp)
+}
+
+func abs64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// Rounds x to the exponent exp in the given mode. Rounding to an exponent below that of x pads it with
+// zeros, as long as it still fits the precision, so that ROUND(1.5, 2) is 1.50.
+func (x *decimal) quantize(exp int64, mode big.RoundingMode) *decimal {
+	switch {
+	case exp > x.exp:
+		return &decimal{coef: shiftRound(x.coef, exp-x.exp, mode), exp: exp, ctx: x.ctx}
+
+	case exp < x.exp && digits(x.coef)+x.exp-exp <= int64(x.ctx.prec):
+		return &decimal{coef: new(big.Int).Mul(x.coef, pow10(x.exp-exp)), exp: exp, ctx: x.ctx}
+	}
+	return x
+}
+
+// Returns the square root of x rounded to the precision of its context.
+func (x *decimal) sqrt() (*decimal, error) {
+	if x.coef.Sign() < 0 {
+		return nil, newEvalError(ErrInvalidValue, span{}, NOT_A_DECIMAL, "the square root of "+x.String())
+	}
+
+	bits := uint(float64(x.ctx.prec+10)*math.Log2(10)) + 64
+	f := new(big.Float).SetPrec(bits).SetRat(x.rat())
+	return x.ctx.parse(f.Sqrt(f).Text('e', int(x.ctx.prec)+5))
+}
+
+// Returns x as an int64 when it is a whole number in range.
+func (x *decimal) int64() (int64, bool) {
+	if x.exp < 0 {
+		q, r := new(big.Int).QuoRem(x.coef, pow10(-x.exp), new(big.Int))
+		return q.Int64(), r.Sign() == 0 && q.IsInt64()
+	}
+
+	if x.exp > 18 && x.coef.Sign() != 0 {
+		return 0, false
+	}
+
+	i := new(big.Int).Mul(x.coef, pow10(x.exp))
+	return i.Int64(), i.IsInt64()
+}
+
+// Returns x truncated to an int64, wrapping outside of its range.
+func (x *decimal) trunc() int64 {
+	if x.exp < 0 {
+		return new(big.Int).Quo(x.coef, pow10(-x.exp)).Int64()
+	}
+	return new(big.Int).Mul(x.coef, pow10(x.exp)).Int64()
+}
+
+// Returns the float64 nearest to x.
+func (x *decimal) float() float64 {
+	f, _ := strconv.ParseFloat(x.coef.String()+"e"+strconv.FormatInt(x.exp, 10), 64)
+	return f
+}
+
+func (x *decimal) rat() *big.Rat {
+	if x.exp < 0 {
+		return new(big.Rat).SetFrac(x.coef, pow10(-x.exp))
+	}
+	return new(big.Rat).SetInt(new(big.Int).Mul(x.coef, pow10(x.exp)))
+}
+
+// Formats x in plain notation, keeping any trailing zeros of its fraction, unless that would take more
+// than a few zeros before or after its digits, in which case it is written with an exponent.
+func (x *decimal) String() string {
+	// Zeros keep the digits of their fraction, but not an exponent, such as that of a result flushed to zero
+	if x.coef.Sign() == 0 && (x.exp > 0 || x.exp < -7) {
+		return "0"
+	}
+
+	s := new(big.Int).Abs(x.coef).String()
+	adjusted := x.exp + int64(len(s)) - 1
+
+	switch {
+	case x.exp <= 0 && adjusted >= -7:
+		if point := int64(len(s)) + x.exp; point > 0 {
+			if x.exp < 0 {
+				s = s[:point] + "." + s[point:]
+			}
+		} else {
+			s = "0." + strings.Repeat("0", int(-point)) + s
+		}
+
+	case x.exp > 0 && adjusted < 21:
+		s += strings.Repeat("0", int(x.exp))
+
+	default:
+		if len(s) > 1 {
+			s = s[:1] + "." + s[1:]
+		}
+		if adjusted >= 0 {
+			s += "e+" + strconv.FormatInt(adjusted, 10)
+		} else {
+			s += "e" + strconv.FormatInt(adjusted, 10)
+		}
+	}
+
+	if x.coef.Sign() < 0 {
+		return "-" + s
+	}
+	return s
+}
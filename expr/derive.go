@@ -0,0 +1,449 @@
+package expr
+
+import (
+	"math"
+
+	"github.com/js10x/expr-evaluator/expr/ast"
+)
+
+// Parses the input and returns its derivative with respect to the variable name, as Derive does.
+func (p *Parser) D(input, name string) (ast.Node, error) {
+
+	node, err := p.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.Derive(node, name)
+	if err != nil {
+		return nil, withLineCol(err, input)
+	}
+	return res, nil
+}
+
+// Returns the derivative of the tree with respect to the variable name, as a new tree that can be formatted
+// with ast.Format or compiled with CompileNode. The derivative is built by the sum, product, quotient and
+// chain rules, and simplified as it is built: terms that are zero are dropped, factors of one removed and
+// numbers combined, so the derivative of SIN(x) * x is COS(x) * x + SIN(x). Subtrees that do not depend
+// on the variable have a derivative of 0, as do comparisons and builtins that step, such as CEIL. At the
+// kinks of ABS, MIN and MAX the derivative is that of the argument selected, as it is for Gradient.
+// Bitwise operators and functions, and registered functions, fail with ErrNotDifferentiable when they
+// depend on the variable, and so do MEDIAN and IFERROR, which have no derivative as a formula.
+func (p *Parser) Derive(node ast.Node, name string) (ast.Node, error) {
+	res, err := p.derive(node, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tree was built rather than parsed, so none of it has a span, even where it reuses the input
+	return ast.Rewrite(res, func(node ast.Node) ast.Node {
+		switch n := node.(type) {
+		case *ast.Number:
+			n.Span = ast.Span{}
+		case *ast.StringLit:
+			n.Span = ast.Span{}
+		case *ast.Ident:
+			n.Span = ast.Span{}
+		case *ast.UnaryExpr:
+			n.Span = ast.Span{}
+		case *ast.BinaryExpr:
+			n.Span = ast.Span{}
+		case *ast.CondExpr:
+			n.Span = ast.Span{}
+		case *ast.CallExpr:
+			n.Span = ast.Span{}
+		}
+		return node
+	}), nil
+}
+
+func (p *Parser) derive(node ast.Node, name string) (ast.Node, error) {
+	if !dependsOn(node, name) {
+		return ast.NewNumber(0), nil
+	}
+
+	switch n := node.(type) {
+	case *ast.Ident:
+		return ast.NewNumber(1), nil
+
+	case *ast.UnaryExpr:
+		switch n.Op {
+		case ast.Neg:
+			dx, err := p.derive(n.X, name)
+			return negNode(dx), err
+		case ast.Not:
+			return ast.NewNumber(0), nil
+		}
+
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case ast.Eq, ast.Neq, ast.Lt, ast.Lte, ast.Gt, ast.Gte, ast.And, ast.Or:
+			return ast.NewNumber(0), nil
+		case ast.BitAnd, ast.BitOr, ast.BitXor, ast.Shl, ast.Shr:
+			return nil, newEvalError(ErrNotDifferentiable, fromSpan(n), NOT_DIFFERENTIABLE, n.Op)
+		}
+
+		dx, err := p.derive(n.X, name)
+		if err != nil {
+			return nil, err
+		}
+
+		dy, err := p.derive(n.Y, name)
+		if err != nil {
+			return nil, err
+		}
+		return p.deriveBinary(n.Op, n.X, n.Y, dx, dy), nil
+
+	case *ast.CondExpr:
+		then, err := p.derive(n.Then, name)
+		if err != nil {
+			return nil, err
+		}
+
+		otherwise, err := p.derive(n.Else, name)
+		if err != nil {
+			return nil, err
+		}
+		return condNode(n.Cond, then, otherwise), nil
+
+	case *ast.CallExpr:
+		return p.deriveCall(n, name)
+	}
+	return nil, newEvalError(ErrNotDifferentiable, fromSpan(node), NOT_DIFFERENTIABLE, ast.Format(node))
+}
+
+// Returns the derivative of x op y for an arithmetic operator, given the derivatives of x and y.
+func (p *Parser) deriveBinary(op ast.Op, x, y, dx, dy ast.Node) ast.Node {
+	switch op {
+	case ast.Add:
+		return addNode(dx, dy)
+	case ast.Sub:
+		return subNode(dx, dy)
+	case ast.Mul:
+		return addNode(mulNode(dx, y), mulNode(x, dy))
+	case ast.Div:
+		if isNumber(dy, 0) {
+			return divNode(dx, y)
+		}
+		return divNode(subNode(mulNode(dx, y), mulNode(x, dy)), powNode(y, ast.NewNumber(2)))
+	case ast.Mod:
+		// x % y is x - TRUNC(x / y) * y, and TRUNC(x / y) is (x - x % y) / y
+		if isNumber(dy, 0) {
+			return dx
+		}
+		return subNode(dx, mulNode(divNode(subNode(x, binaryNode(ast.Mod, x, y)), y), dy))
+	}
+
+	// x ** y
+	switch {
+	case isNumber(dy, 0):
+		return mulNode(mulNode(p.foldConstant(y), powNode(x, p.foldConstant(subNode(y, ast.NewNumber(1))))), dx)
+	case isNumber(dx, 0):
+		return mulNode(mulNode(powNode(x, y), callNode("LN", x)), dy)
+	}
+	return mulNode(powNode(x, y), addNode(mulNode(dy, callNode("LN", x)), divNode(mulNode(y, dx), x)))
+}
+
+// Folds a constant subtree, such as the exponent -1 - 1, which the constructors below leave alone when
+// it is not built only from numbers, into a number. Other subtrees are optimized as they are.
+func (p *Parser) foldConstant(node ast.Node) ast.Node {
+	res := p.Optimize(node)
+	if num, ok := res.(*ast.Number); ok {
+		return ast.NewNumber(num.Value) // formatted by value, as the other numbers of a derivative are
+	}
+	return res
+}
+
+// Returns the derivative of a call to a builtin, which depends on the variable.
+func (p *Parser) deriveCall(n *ast.CallExpr, name string) (ast.Node, error) {
+	if desc, ok := p.lookupFunc(n.Func); !ok || desc != funcTable[n.Func] {
+		return nil, newEvalError(ErrNotDifferentiable, fromSpan(n), NOT_DIFFERENTIABLE, n.Func)
+	}
+
+	switch n.Func {
+	case "BAND", "BANDNOT", "BNOT", "BOR", "BXOR", "SHL", "SHR":
+		return nil, newEvalError(ErrNotDifferentiable, fromSpan(n), NOT_DIFFERENTIABLE, n.Func)
+	case "MEDIAN", "IFERROR":
+		return nil, newEvalError(ErrNotDifferentiable, fromSpan(n), NO_SYMBOLIC_DERIVATIVE, n.Func)
+	case "ARG", "CEIL", "IM", "RND", "ROUND", "COUNT", "EQ", "NE", "GE", "GT", "LE", "LT", "AND", "OR", "NOT":
+		return ast.NewNumber(0), nil
+	}
+
+	args, ds := n.Args, make([]ast.Node, len(n.Args))
+	for ix, arg := range args {
+		d, err := p.derive(arg, name)
+		if err != nil {
+			return nil, err
+		}
+		ds[ix] = d
+	}
+
+	u, du := args[0], ds[0]
+	switch n.Func {
+	case "NEG":
+		return negNode(du), nil
+	case "CONJ", "RE", "HI", "LO":
+		return du, nil
+	case "ABS":
+		zero := ast.NewNumber(0)
+		return condNode(binaryNode(ast.Gt, u, zero), du, condNode(binaryNode(ast.Lt, u, zero), negNode(du), zero)), nil
+	case "ACOS":
+		return negNode(divNode(du, callNode("SQR", subNode(ast.NewNumber(1), powNode(u, ast.NewNumber(2)))))), nil
+	case "ASIN":
+		return divNode(du, callNode("SQR", subNode(ast.NewNumber(1), powNode(u, ast.NewNumber(2))))), nil
+	case "ATAN":
+		return divNode(du, addNode(ast.NewNumber(1), powNode(u, ast.NewNumber(2)))), nil
+	case "COS":
+		return negNode(mulNode(callNode("SIN", u), du)), nil
+	case "SIN":
+		return mulNode(callNode("COS", u), du), nil
+	case "TAN":
+		return divNode(du, powNode(callNode("COS", u), ast.NewNumber(2))), nil
+	case "EXP":
+		return mulNode(callNode("EXP", u), du), nil
+	case "LN":
+		return divNode(du, u), nil
+	case "SQR":
+		return divNode(du, mulNode(ast.NewNumber(2), callNode("SQR", u))), nil
+	case "MOD":
+		return p.deriveBinary(ast.Mod, u, args[1], du, ds[1]), nil
+	case "POW":
+		return p.deriveBinary(ast.Pow, u, args[1], du, ds[1]), nil
+	case "IF":
+		return condNode(u, ds[1], ds[2]), nil
+	case "MIN":
+		return selected(n.Func, ast.Lte, args, ds), nil
+	case "MAX":
+		return selected(n.Func, ast.Gte, args, ds), nil
+	case "SUM":
+		return sumNodes(ds), nil
+	case "AVG":
+		return divNode(sumNodes(ds), ast.NewNumber(float64(len(args)))), nil
+	case "PRODUCT":
+		terms := make([]ast.Node, len(args))
+		for ix := range args {
+			term := ds[ix]
+			for jx, arg := range args {
+				if jx != ix {
+					term = mulNode(term, arg)
+				}
+			}
+			terms[ix] = term
+		}
+		return sumNodes(terms), nil
+	case "STDDEV":
+		// The sum of each deviation from the mean times its derivative, over n times the standard deviation,
+		// or 0 when the arguments are all equal
+		stddev, mean := callNode(n.Func, args...), callNode("AVG", args...)
+		terms := make([]ast.Node, len(args))
+		for ix, arg := range args {
+			terms[ix] = mulNode(subNode(arg, mean), ds[ix])
+		}
+		res := divNode(sumNodes(terms), mulNode(ast.NewNumber(float64(len(args))), stddev))
+		return condNode(binaryNode(ast.Eq, stddev, ast.NewNumber(0)), ast.NewNumber(0), res), nil
+	}
+	return nil, newEvalError(ErrNotDifferentiable, fromSpan(n), NO_SYMBOLIC_DERIVATIVE, n.Func)
+}
+
+// Returns the derivative of the argument MIN or MAX selects, the first one that compares as op, <= or >=,
+// to the rest of them.
+func selected(fn string, op ast.Op, args, ds []ast.Node) ast.Node {
+	res := ds[len(ds)-1]
+	for ix := len(args) - 2; ix >= 0; ix-- {
+		rest := args[ix+1]
+		if ix+2 < len(args) {
+			rest = callNode(fn, args[ix+1:]...)
+		}
+		res = condNode(binaryNode(op, args[ix], rest), ds[ix], res)
+	}
+	return res
+}
+
+// Reports whether the tree reads the variable name.
+func dependsOn(node ast.Node, name string) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// Reports whether the node is a number equal to value.
+func isNumber(node ast.Node, value float64) bool {
+	num, ok := node.(*ast.Number)
+	return ok && num.Value == value
+}
+
+// The constructors below simplify as they build: they drop terms of zero and factors of one, move
+// negations outward and combine numbers, so that derivatives stay readable.
+
+func binaryNode(op ast.Op, x, y ast.Node) ast.Node {
+	a, okX := x.(*ast.Number)
+	b, okY := y.(*ast.Number)
+	if !okX || !okY {
+		return &ast.BinaryExpr{Op: op, X: x, Y: y}
+	}
+
+	var res float64
+	switch op {
+	case ast.Add:
+		res = a.Value + b.Value
+	case ast.Sub:
+		res = a.Value - b.Value
+	case ast.Mul:
+		res = a.Value * b.Value
+	case ast.Div:
+		res = a.Value / b.Value
+	case ast.Pow:
+		res = math.Pow(a.Value, b.Value)
+	default:
+		return &ast.BinaryExpr{Op: op, X: x, Y: y}
+	}
+
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		return &ast.BinaryExpr{Op: op, X: x, Y: y}
+	}
+	return ast.NewNumber(res)
+}
+
+func addNode(x, y ast.Node) ast.Node {
+	switch {
+	case isNumber(x, 0):
+		return y
+	case isNumber(y, 0):
+		return x
+	}
+
+	if n, ok := y.(*ast.UnaryExpr); ok && n.Op == ast.Neg {
+		return subNode(x, n.X)
+	}
+	if isNegative(y) {
+		return subNode(x, negNode(y))
+	}
+	if ast.Format(x) == ast.Format(y) {
+		return mulNode(ast.NewNumber(2), x)
+	}
+	return binaryNode(ast.Add, x, y)
+}
+
+func subNode(x, y ast.Node) ast.Node {
+	switch {
+	case isNumber(y, 0):
+		return x
+	case isNumber(x, 0):
+		return negNode(y)
+	}
+
+	if n, ok := y.(*ast.UnaryExpr); ok && n.Op == ast.Neg {
+		return addNode(x, n.X)
+	}
+	if isNegative(y) {
+		return addNode(x, negNode(y))
+	}
+	return binaryNode(ast.Sub, x, y)
+}
+
+// Reports whether the node is a product or quotient led by a negative number, as in -0.5 * x.
+func isNegative(node ast.Node) bool {
+	if n, ok := node.(*ast.BinaryExpr); ok && (n.Op == ast.Mul || n.Op == ast.Div) {
+		num, ok := n.X.(*ast.Number)
+		return ok && num.Value < 0
+	}
+	return false
+}
+
+func mulNode(x, y ast.Node) ast.Node {
+	switch {
+	case isNumber(x, 0) || isNumber(y, 0):
+		return ast.NewNumber(0)
+	case isNumber(x, 1):
+		return y
+	case isNumber(y, 1):
+		return x
+	case isNumber(x, -1):
+		return negNode(y)
+	case isNumber(y, -1):
+		return negNode(x)
+	}
+
+	if n, ok := x.(*ast.UnaryExpr); ok && n.Op == ast.Neg {
+		return negNode(mulNode(n.X, y))
+	}
+	if n, ok := y.(*ast.UnaryExpr); ok && n.Op == ast.Neg {
+		return negNode(mulNode(x, n.X))
+	}
+
+	// Numbers lead, as in 2 * COS(2 * x)
+	_, okX := x.(*ast.Number)
+	if _, okY := y.(*ast.Number); okY && !okX {
+		x, y = y, x
+	}
+	return binaryNode(ast.Mul, x, y)
+}
+
+func divNode(x, y ast.Node) ast.Node {
+	switch {
+	case isNumber(x, 0):
+		return ast.NewNumber(0)
+	case isNumber(y, 1):
+		return x
+	}
+
+	if n, ok := x.(*ast.UnaryExpr); ok && n.Op == ast.Neg {
+		return negNode(divNode(n.X, y))
+	}
+	return binaryNode(ast.Div, x, y)
+}
+
+func powNode(x, y ast.Node) ast.Node {
+	switch {
+	case isNumber(y, 0):
+		return ast.NewNumber(1)
+	case isNumber(y, 1):
+		return x
+	}
+	return binaryNode(ast.Pow, x, y)
+}
+
+func negNode(x ast.Node) ast.Node {
+	switch n := x.(type) {
+	case *ast.Number:
+		if !math.IsNaN(n.Value) {
+			return ast.NewNumber(0 - n.Value)
+		}
+	case *ast.UnaryExpr:
+		if n.Op == ast.Neg {
+			return n.X
+		}
+	case *ast.BinaryExpr:
+		// Negates a leading number instead, as in -2 * SIN(2 * x)
+		if num, ok := n.X.(*ast.Number); ok && (n.Op == ast.Mul || n.Op == ast.Div) && !math.IsNaN(num.Value) {
+			return &ast.BinaryExpr{Op: n.Op, X: negNode(num), Y: n.Y}
+		}
+	}
+	return &ast.UnaryExpr{Op: ast.Neg, X: x}
+}
+
+func condNode(c, then, otherwise ast.Node) ast.Node {
+	a, okThen := then.(*ast.Number)
+	b, okElse := otherwise.(*ast.Number)
+	if okThen && okElse && a.Value == b.Value {
+		return then
+	}
+	return &ast.CondExpr{Cond: c, Then: then, Else: otherwise}
+}
+
+func sumNodes(terms []ast.Node) ast.Node {
+	var res ast.Node = ast.NewNumber(0)
+	for _, term := range terms {
+		res = addNode(res, term)
+	}
+	return res
+}
+
+func callNode(fn string, args ...ast.Node) ast.Node {
+	return &ast.CallExpr{Func: fn, Args: args}
+}
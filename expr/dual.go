@@ -0,0 +1,295 @@
+package expr
+
+import (
+	"math"
+	"sort"
+
+	"github.com/js10x/expr-evaluator/expr/ast"
+)
+
+// Gradient evaluates the input like Eval, and also returns the partial derivatives of the result with
+// respect to each of its variables, as Program.Gradient does.
+func (p *Parser) Gradient(input string, env Resolver) (float64, map[string]float64, error) {
+	prog, err := p.Compile(input)
+	if err != nil {
+		return 0, nil, err
+	}
+	return prog.Gradient(env)
+}
+
+// Gradient evaluates the program like Eval, and also returns the partial derivatives of the result with
+// respect to each of its variables, by forward-mode automatic differentiation: numeric variables carry a
+// derivative of 1 with respect to themselves, and the operators and builtins apply the chain rule as they
+// compute the value, so the derivatives are exact up to rounding rather than estimated. At the kinks of ABS,
+// MIN and MAX a subgradient is taken, and functions that step, such as CEIL and ROUND, have a derivative
+// of 0. Bitwise operators and functions, and registered functions, have no derivative and fail with
+// ErrNotDifferentiable when given an argument that depends on a variable.
+func (p *Program) Gradient(env Resolver) (float64, map[string]float64, error) {
+	seeds := &seeds{index: map[string]int{}}
+	for _, name := range p.variables() {
+		seeds.add(name)
+	}
+
+	res, err := p.EvalValue(dualVars{env, seeds})
+	value, err := p.float(res, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	partials := make(map[string]float64, len(seeds.names))
+	for ix, name := range seeds.names {
+		partials[name] = 0
+		if res.kind == dualKind && ix < len(res.g.dx) {
+			partials[name] = res.g.dx[ix]
+		}
+	}
+	return value, partials, nil
+}
+
+// Returns the names of the variables of the program, in the order they first appear.
+func (p *Program) variables() []string {
+	node, err := toAST(p.ast)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && !seen[id.Name] {
+			seen[id.Name] = true
+			names = append(names, id.Name)
+		}
+		return true
+	})
+	return names
+}
+
+// The variables partial derivatives are taken with respect to, by their index within the partials.
+type seeds struct {
+	index map[string]int
+	names []string
+}
+
+func (s *seeds) add(name string) int {
+	if ix, ok := s.index[name]; ok {
+		return ix
+	}
+	s.index[name] = len(s.names)
+	s.names = append(s.names, name)
+	return len(s.names) - 1
+}
+
+// Resolves numeric variables as duals with a derivative of 1 with respect to themselves, for Gradient.
+type dualVars struct {
+	env   Resolver
+	seeds *seeds
+}
+
+func (v dualVars) Resolve(name string) (float64, bool) {
+	if v.env == nil {
+		return 0, false
+	}
+	return v.env.Resolve(name)
+}
+
+func (v dualVars) ResolveValue(name string) (Value, bool) {
+	if v.env == nil {
+		return Value{}, false
+	}
+
+	value, ok := resolve(v.env, name)
+	switch {
+	case !ok:
+		return value, ok
+	case value.kind != Int && value.kind != Float && value.kind != BigInt && value.kind != Decimal:
+		return value, true
+	}
+
+	ix := v.seeds.add(name)
+	dx := make([]float64, ix+1)
+	dx[ix] = 1
+	return dualValue(value.Float(), dx), true
+}
+
+// A number with its partial derivatives with respect to the variables of a program, of which dx holds
+// as many as the number depends on. A nil dx is a constant, whose partials are all zero.
+type dual struct {
+	x  float64
+	dx []float64
+}
+
+func dualValue(x float64, dx []float64) Value { return Value{kind: dualKind, g: &dual{x, dx}} }
+
+// Converts a number or a bool into a dual, which is a constant unless it already is a dual, reporting
+// false for strings, quantities, complex numbers with an imaginary part and intervals holding more than
+// one number.
+func dualOperand(v Value) (dual, bool) {
+	switch {
+	case v.kind == dualKind:
+		return *v.g, true
+	case v.kind == String || v.kind == Quantity:
+		return dual{}, false
+	case v.kind == Complex && imag(v.c) != 0:
+		return dual{}, false
+	case v.kind == Interval && !v.r.isPoint():
+		return dual{}, false
+	}
+	return dual{x: v.Float()}, true
+}
+
+// Reports whether any of the arguments is a dual.
+func dualArg(params []Value) bool {
+	for _, param := range params {
+		if param.kind == dualKind {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the partials of a function of a and b, whose derivatives with respect to them are da and db,
+// by the chain rule. A partial of zero contributes nothing even when its derivative is infinite or NaN,
+// as where the function does not depend on that argument.
+func chain(da float64, a []float64, db float64, b []float64) []float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	res := make([]float64, n)
+	for ix, d := range a {
+		if d != 0 {
+			res[ix] += da * d
+		}
+	}
+	for ix, d := range b {
+		if d != 0 {
+			res[ix] += db * d
+		}
+	}
+	return res
+}
+
+// Returns f(a), whose derivative with respect to a is df.
+func (a dual) then(f, df float64) Value {
+	return dualValue(f, chain(df, a.dx, 0, nil))
+}
+
+// Applies an arithmetic or comparison operator to two duals. Comparisons compare their values.
+func dualOp(op opcode, a, b dual) (Value, error) {
+	switch op {
+	case opAdd:
+		return dualValue(a.x+b.x, chain(1, a.dx, 1, b.dx)), nil
+	case opSub:
+		return dualValue(a.x-b.x, chain(1, a.dx, -1, b.dx)), nil
+	case opMul:
+		return dualValue(a.x*b.x, chain(b.x, a.dx, a.x, b.dx)), nil
+	case opDiv:
+		if b.x == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		q := a.x / b.x
+		return dualValue(q, chain(1/b.x, a.dx, -q/b.x, b.dx)), nil
+	case opMod:
+		if b.x == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		return dualValue(math.Mod(a.x, b.x), chain(1, a.dx, -math.Trunc(a.x/b.x), b.dx)), nil
+	case opPow:
+		return powDual(a, b), nil
+	}
+	return floatOp(op, a.x, b.x)
+}
+
+// Raises a to the power of b. The derivative with respect to b is only defined for a positive a, and
+// 0 for an a of 0.
+func powDual(a, b dual) Value {
+	res := math.Pow(a.x, b.x)
+
+	var da float64
+	if b.x != 0 {
+		da = b.x * math.Pow(a.x, b.x-1)
+	}
+
+	db := math.NaN()
+	switch {
+	case a.x > 0:
+		db = res * math.Log(a.x)
+	case a.x == 0:
+		db = 0
+	}
+	return dualValue(res, chain(da, a.dx, db, b.dx))
+}
+
+// Returns the arithmetic mean of duals.
+func meanDual(params []dual) dual {
+	res := dual{}
+	for _, p := range params {
+		res = dual{res.x + p.x, chain(1, res.dx, 1, p.dx)}
+	}
+	n := float64(len(params))
+	return dual{res.x / n, chain(1/n, res.dx, 0, nil)}
+}
+
+// Returns the median of duals, which is the middle one, or the mean of the middle two.
+func medianDual(params []dual) dual {
+	sorted := append([]dual(nil), params...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].x < sorted[j].x })
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return meanDual(sorted[mid-1 : mid+1])
+	}
+	return sorted[mid]
+}
+
+// Returns the population standard deviation of duals, whose derivative with respect to each of them is
+// its deviation from the mean over n times the standard deviation, and a subgradient of 0 when they are
+// all equal.
+func stddevDual(params []dual) dual {
+	mean := meanDual(params).x
+	n := float64(len(params))
+
+	variance := 0.0
+	for _, p := range params {
+		variance += (p.x - mean) * (p.x - mean)
+	}
+
+	res := dual{x: math.Sqrt(variance / n)}
+	if res.x == 0 {
+		return res
+	}
+
+	for _, p := range params {
+		res.dx = chain(1, res.dx, (p.x-mean)/(n*res.x), p.dx)
+	}
+	return res
+}
+
+// Returns the least of duals, or the greatest when greatest is set, as MIN and MAX do. The derivative
+// is that of the first one selected, a subgradient where several are equal.
+func extremeDual(params []dual, greatest bool) dual {
+	res := params[0]
+	for _, p := range params[1:] {
+		switch {
+		case math.IsNaN(res.x):
+		case math.IsNaN(p.x), greatest && p.x > res.x, !greatest && p.x < res.x:
+			res = p // NaN wins, as it does for math.Min and math.Max
+		}
+	}
+	return res
+}
+
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return 0
+}
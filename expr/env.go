@@ -0,0 +1,161 @@
+package expr
+
+// Resolver supplies the values of named variables while an expression is being evaluated.
+type Resolver interface {
+	Resolve(name string) (float64, bool)
+}
+
+// Vars is a Resolver backed by a map of variable names to their values.
+type Vars map[string]float64
+
+func (v Vars) Resolve(name string) (float64, bool) {
+	value, ok := v[name]
+	return value, ok
+}
+
+// The name %P identifiers are resolved by during evaluation.
+const placeholder = "%P"
+
+// Resolves %P to a single value supplied by EvalV.
+type placeholderVar struct{ value any }
+
+func (v placeholderVar) Resolve(name string) (float64, bool) {
+	value, ok := v.ResolveValue(name)
+	return value.Float(), ok
+}
+
+func (v placeholderVar) ResolveValue(name string) (Value, bool) {
+	if name != placeholder {
+		return Value{}, false
+	}
+
+	value, err := toValue(v.value)
+	if err != nil {
+		return Value{}, false
+	}
+	return value, true
+}
+
+// ValueResolver is implemented by Resolvers that supply typed values. Variables that are only
+// resolved through Resolve are floats.
+type ValueResolver interface {
+	Resolver
+	ResolveValue(name string) (Value, bool)
+}
+
+// Values is a ValueResolver backed by a map of variable names to their typed values.
+type Values map[string]Value
+
+func (v Values) Resolve(name string) (float64, bool) {
+	value, ok := v[name]
+	return value.Float(), ok
+}
+
+func (v Values) ResolveValue(name string) (Value, bool) {
+	value, ok := v[name]
+	return value, ok
+}
+
+func resolve(env Resolver, name string) (Value, bool) {
+	if typed, ok := env.(ValueResolver); ok {
+		return typed.ResolveValue(name)
+	}
+
+	value, ok := env.Resolve(name)
+	return FloatValue(value), ok
+}
+
+// Resolves numeric variables as decimals, for programs compiled by a parser in decimal mode.
+type decimalVars struct {
+	env Resolver
+	ctx *decimalContext
+}
+
+func (v decimalVars) Resolve(name string) (float64, bool) {
+	return v.env.Resolve(name)
+}
+
+func (v decimalVars) ResolveValue(name string) (Value, bool) {
+	value, ok := resolve(v.env, name)
+	if !ok || value.kind != Int && value.kind != Float {
+		return value, ok
+	}
+
+	// NaN and infinities have no decimal value, and are left as floats
+	if d, err := v.ctx.convert(value); err == nil {
+		return Value{kind: Decimal, d: d}, true
+	}
+	return value, true
+}
+
+// Resolves variables holding whole numbers as big integers, for programs compiled by a parser in integer mode.
+type integerVars struct {
+	env Resolver
+	ctx *integerContext
+}
+
+func (v integerVars) Resolve(name string) (float64, bool) {
+	return v.env.Resolve(name)
+}
+
+func (v integerVars) ResolveValue(name string) (Value, bool) {
+	value, ok := resolve(v.env, name)
+	if !ok || value.kind != Int && value.kind != Float && value.kind != BigInt {
+		return value, ok
+	}
+
+	if n, isInt := bigOperand(value); isInt {
+		return v.ctx.value(n), true
+	}
+	return value, true
+}
+
+// Resolves numeric variables as complex numbers, for programs compiled by a parser in complex mode, and
+// the complex constants that env, which may be nil, has no variable for.
+type complexVars struct {
+	env Resolver
+}
+
+func (v complexVars) Resolve(name string) (float64, bool) {
+	value, ok := v.ResolveValue(name)
+	return value.Float(), ok
+}
+
+func (v complexVars) ResolveValue(name string) (Value, bool) {
+	var value Value
+	ok := false
+	if v.env != nil {
+		value, ok = resolve(v.env, name)
+	}
+
+	if !ok {
+		c, isConst := complexConstants[name]
+		return ComplexValue(c), isConst
+	}
+
+	if c, isNum := complexOperand(value); isNum {
+		return ComplexValue(c), true
+	}
+	return value, true
+}
+
+// Resolves numeric variables as intervals, for programs compiled by a parser in interval mode.
+type intervalVars struct {
+	env Resolver
+}
+
+func (v intervalVars) Resolve(name string) (float64, bool) {
+	return v.env.Resolve(name)
+}
+
+func (v intervalVars) ResolveValue(name string) (Value, bool) {
+	value, ok := resolve(v.env, name)
+	if !ok {
+		return value, ok
+	}
+
+	if r, isNum := intervalOperand(value); isNum {
+		return intervalValue(r), true
+	}
+	return value, true
+}
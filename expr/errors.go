@@ -1,7 +1,88 @@
 package expr
 
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrorCode identifies the kind of failure behind a SyntaxError or EvalError. Codes are errors themselves,
+// so errors.Is(err, ErrDivideByZero) reports whether err was caused by a division by zero.
+type ErrorCode int
+
+const (
+	// Parse errors, reported as SyntaxError
+	ErrInvalidChar ErrorCode = iota + 1
+	ErrInvalidNumber
+	ErrUnbalancedParens
+	ErrUnexpectedTerm
+	ErrUnexpectedEnd
+	ErrUnknownFunction
+	ErrInvalidFuncArgs
+	ErrArgCount
+	ErrInvalidExpr
+	ErrInvalidString
+	ErrUnknownUnit
+
+	// Evaluation errors, reported as EvalError
+	ErrDivideByZero
+	ErrNegativeShift
+	ErrUndefinedVariable
+	ErrInvalidValue
+	ErrFunctionFailed
+	ErrTypeMismatch
+	ErrDimensionMismatch
+	ErrIndeterminate
+	ErrNotDifferentiable
+	ErrNoConvergence
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrInvalidChar:       "invalid character",
+	ErrInvalidNumber:     "invalid number",
+	ErrUnbalancedParens:  "unbalanced parentheses",
+	ErrUnexpectedTerm:    "unexpected term",
+	ErrUnexpectedEnd:     "unexpected end of expression",
+	ErrUnknownFunction:   "unknown function",
+	ErrInvalidFuncArgs:   "invalid function arguments",
+	ErrArgCount:          "wrong number of arguments",
+	ErrInvalidExpr:       "invalid expression",
+	ErrInvalidString:     "invalid string",
+	ErrUnknownUnit:       "unknown unit",
+	ErrDivideByZero:      "division by zero",
+	ErrNegativeShift:     "negative shift count",
+	ErrUndefinedVariable: "undefined variable",
+	ErrInvalidValue:      "invalid value",
+	ErrFunctionFailed:    "function failed",
+	ErrTypeMismatch:      "type mismatch",
+	ErrDimensionMismatch: "dimension mismatch",
+	ErrIndeterminate:     "indeterminate comparison",
+	ErrNotDifferentiable: "not differentiable",
+	ErrNoConvergence:     "no convergence",
+}
+
+func (c ErrorCode) Error() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error code %d", int(c))
+}
+
+// Position locates the offending portion of the input, input[Offset:End]. Line and Column are 1-based
+// and count runes, so they can be used directly to underline the span.
+type Position struct {
+	Offset int
+	End    int
+	Line   int
+	Column int
+}
+
+// SyntaxError reports input that could not be tokenized or parsed.
 type SyntaxError struct {
 	treeNode
+	Position
+	Code    ErrorCode
+	Hint    string // a suggested fix, when one is known
 	message string
 }
 
@@ -9,6 +90,99 @@ func (s SyntaxError) Error() string {
 	return s.message
 }
 
+func (s SyntaxError) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == s.Code
+}
+
+func (s SyntaxError) pos() span {
+	return span{s.Offset, s.End}
+}
+
+// EvalError reports a failure while evaluating a successfully parsed expression.
+type EvalError struct {
+	Position
+	Code    ErrorCode
+	Hint    string // a suggested fix, when one is known
+	message string
+	err     error // the error returned by a custom function, if any
+}
+
+func (e EvalError) Error() string {
+	return e.message
+}
+
+func (e EvalError) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == e.Code
+}
+
+func (e EvalError) Unwrap() error {
+	return e.err
+}
+
+func newSyntaxError(code ErrorCode, at span, format string, args ...any) SyntaxError {
+	return SyntaxError{Position: Position{Offset: at.start, End: at.end}, Code: code, Hint: errorHints[code], message: fmt.Sprintf(format, args...)}
+}
+
+func newEvalError(code ErrorCode, at span, format string, args ...any) EvalError {
+	return EvalError{Position: Position{Offset: at.start, End: at.end}, Code: code, Hint: errorHints[code], message: fmt.Sprintf(format, args...)}
+}
+
+// Attaches at to an evaluation error that does not yet know where it occurred, such as one raised inside
+// a builtin. Errors from custom functions are wrapped so they gain a position and code as well.
+func locate(err error, at span) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(SyntaxError); ok {
+		return err
+	}
+
+	var evalErr EvalError
+	if !errors.As(err, &evalErr) {
+		return EvalError{Position: Position{Offset: at.start, End: at.end}, Code: ErrFunctionFailed, message: err.Error(), err: err}
+	}
+
+	if evalErr.End == 0 {
+		evalErr.Offset, evalErr.End = at.start, at.end
+	}
+	return evalErr
+}
+
+// Fills in the line and column of an error's position within src.
+func withLineCol(err error, src string) error {
+	switch e := err.(type) {
+	case SyntaxError:
+		e.Line, e.Column = lineCol(src, e.Offset)
+		return e
+	case EvalError:
+		e.Line, e.Column = lineCol(src, e.Offset)
+		return e
+	}
+	return err
+}
+
+func lineCol(src string, offset int) (line, column int) {
+	if offset > len(src) {
+		offset = len(src)
+	}
+
+	line, column = 1, 1
+	for ix := 0; ix < offset; {
+		ch, size := utf8.DecodeRuneInString(src[ix:])
+		if ch == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+		ix += size
+	}
+	return line, column
+}
+
 var (
 	UNEXPECTED_TERM_AFTER        = "Unexpected term after %v"
 	UNEXPECTED_TERM_AT           = "Unexpected term at %v"
@@ -23,10 +197,45 @@ var (
 	INVALID_FNC_ARGS_FOR         = "Invalid argument(s) for function '%v'"
 	INVALID_FNC_DECL             = "Invalid function declaration"
 	INVALID_FNC_DECL_FOR         = "Invalid function declaration for '%v'"
+	INVALID_FNC_NAME             = "Invalid function name '%v'"
+	INVALID_FNC_ARITY            = "Invalid argument count %v for function '%v'"
+	FNC_ALREADY_DEFINED          = "Function '%v' is already defined"
 	UNBAL_PARENS                 = "Parenthesis missing in expression"
 	DIVIDE_BY_ZERO               = "Cannot divide by zero"
+	NEGATIVE_SHIFT_COUNT         = "Shift count cannot be negative"
 	INVALID_IDENTIFIER           = "Invalid identifier in expression"
+	UNDEFINED_VARIABLE           = "Undefined variable '%v'"
 	INVALID_NUMBER               = "Invalid number in expression"
+	UNTERMINATED_STRING          = "String literal is missing its closing %v"
+	INVALID_STRING               = "Invalid escape sequence in string literal"
 	INVALID_EXPR_GENERAL         = "Invalid expression"
 	VALID_EXPR                   = "Valid expression"
+	OPERATOR_NOT_DEFINED         = "Operator %v is not defined on %v"
+	OPERATOR_NOT_DEFINED_FOR     = "Operator %v is not defined on %v and %v"
+	OPERAND_NOT_INTEGER          = "%v needs integer operands, but got %v"
+	FNC_NOT_DEFINED_ON           = "Function '%v' is not defined on %v"
+	NUMBER_EXPECTED              = "Expected a number, but got %v"
+	DECIMAL_OUT_OF_RANGE         = "Decimal result is out of range"
+	NOT_A_DECIMAL                = "%v cannot be represented as a decimal"
+	INTEGER_OUT_OF_RANGE         = "Integer result exceeds %v bits"
+	REAL_EXPECTED                = "Expected a real number, but got %v"
+	UNKNOWN_UNIT                 = "Unknown unit '%v'"
+	DIMENSION_MISMATCH           = "Operator %v needs operands of the same dimension, but got %v and %v"
+	CANNOT_CONVERT_UNIT          = "Cannot convert %v to %v, which has another dimension"
+	QUANTITY_POWER               = "Quantities can only be raised to a dimensionless integer power, but got %v"
+	DIMENSIONLESS_EXPECTED       = "Expected a dimensionless number, but got %v"
+	DIMENSION_OUT_OF_RANGE       = "Unit exponents are limited to %v through %v"
+	DIVISOR_CONTAINS_ZERO        = "Divisor %v contains zero"
+	OUTSIDE_DOMAIN               = "%v is not defined on all of %v"
+	INDETERMINATE_COMPARISON     = "Comparison %v %v %v holds for some values within the intervals but not for others"
+	INDETERMINATE_CONDITION      = "Condition %v is true for some values within the interval but false for others"
+	POINT_EXPECTED               = "Expected a single number, but got %v"
+	NOT_DIFFERENTIABLE           = "%v is not differentiable"
+	NO_SYMBOLIC_DERIVATIVE       = "%v has no derivative as a formula; use Gradient instead"
+	NO_CONVERGENCE               = "No root was found within %v iterations"
+	NOT_BRACKETED                = "The expression does not cross %v between %v and %v, and Newton's method found no root there"
+	NOT_A_NUMBER_AT              = "The expression is not a number at %v = %v"
+	POLE_AT                      = "The expression changes sign at %v = %v without crossing %v"
+	FAILED_AT                    = "The expression fails at %v = %v: %v"
+	HINT_DID_YOU_MEAN            = "did you mean %v?"
 )
@@ -1,10 +1,222 @@
 package expr
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Variadic marks a function that accepts any number of arguments beyond its minimum.
+const Variadic = -1
 
 type fncDescriptor struct {
-	args   int
-	invoke func(args []treeNode) (any, error)
+	args     int                                                          // the exact argument count, or the minimum when maxArgs is set
+	maxArgs  int                                                          // the maximum argument count when above args, or Variadic
+	eval     func(params ...float64) (float64, error)                     // called with the evaluated arguments as floats
+	typed    func(params ...Value) (Value, error)                         // called instead of eval with the evaluated arguments as they are
+	decimal  func(params ...*decimal) (Value, error)                      // called instead of either when an argument is a decimal, with all of them converted
+	integer  func(ctx *integerContext, params ...*big.Int) (Value, error) // called instead of either when an argument is a big integer and all of them are integers
+	complex  func(params ...complex128) (Value, error)                    // called instead of either when an argument is a complex number, with all of them converted
+	quantity func(params ...Value) (Value, error)                         // called instead of either when an argument is a quantity
+	interval func(params ...interval) (Value, error)                      // called instead of either when an argument is an interval, with all of them converted
+	dual     func(params ...dual) (Value, error)                          // called instead of any other when an argument is a dual, with all of them converted
+	invoke   func(args []treeNode, env Resolver) (Value, error)           // called instead of either by lazy functions, with the unevaluated arguments
+	impure   bool                                                         // the result may differ between calls with the same arguments, so calls are never folded
+}
+
+// Reports whether the function can be invoked with n arguments.
+func (d *fncDescriptor) accepts(n int) bool {
+	switch {
+	case n < d.args:
+		return false
+	case d.maxArgs == Variadic:
+		return true
+	case d.maxArgs > d.args:
+		return n <= d.maxArgs
+	}
+	return n == d.args
+}
+
+// Invokes the function, evaluating its arguments first unless it is lazy.
+func (d *fncDescriptor) call(args []treeNode, env Resolver) (Value, error) {
+	if d.invoke != nil {
+		return d.invoke(args, env)
+	}
+
+	params := make([]Value, len(args))
+	for ix, arg := range args {
+		value, err := evalNode(arg, env)
+		if err != nil {
+			return Value{}, err
+		}
+		params[ix] = value
+	}
+	return d.apply(params, make([]float64, len(params)))
+}
+
+// Invokes a function that is not lazy with its evaluated arguments, using its implementation for the kind of
+// number they hold, or computing it as floats. floats must be at least as long as params.
+func (d *fncDescriptor) apply(params []Value, floats []float64) (Value, error) {
+	switch {
+	case d.dual != nil && dualArg(params):
+		return d.applyDual(params)
+	case d.quantity != nil && quantityArg(params):
+		return d.quantity(params...)
+	case d.complex != nil && complexArg(params):
+		return d.applyComplex(params)
+	case d.interval != nil && intervalArg(params):
+		return d.applyInterval(params)
+	}
+
+	if ctx := integerArg(params); ctx != nil && d.integer != nil {
+		if ints, ok := bigOperands(params); ok {
+			return d.integer(ctx, ints...)
+		}
+	}
+
+	if ctx := decimalArg(params); ctx != nil && d.decimal != nil {
+		return d.applyDecimal(ctx, params)
+	}
+
+	switch {
+	case d.typed != nil:
+		return d.typed(params...)
+	case dualArg(params):
+		return Value{}, newEvalError(ErrNotDifferentiable, span{}, NOT_DIFFERENTIABLE, "The function")
+	}
+	return d.applyFloats(params, floats)
+}
+
+func (d *fncDescriptor) applyDual(params []Value) (Value, error) {
+	duals := make([]dual, len(params))
+	for ix, param := range params {
+		g, ok := dualOperand(param)
+		if !ok {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, NUMBER_EXPECTED, param.describe())
+		}
+		duals[ix] = g
+	}
+	return d.dual(duals...)
+}
+
+func (d *fncDescriptor) applyComplex(params []Value) (Value, error) {
+	nums := make([]complex128, len(params))
+	for ix, param := range params {
+		c, ok := complexOperand(param)
+		if !ok {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, NUMBER_EXPECTED, param.describe())
+		}
+		nums[ix] = c
+	}
+	return d.complex(nums...)
+}
+
+func (d *fncDescriptor) applyInterval(params []Value) (Value, error) {
+	bounds := make([]interval, len(params))
+	for ix, param := range params {
+		r, ok := intervalOperand(param)
+		if !ok {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, NUMBER_EXPECTED, param.describe())
+		}
+		bounds[ix] = r
+	}
+	return d.interval(bounds...)
+}
+
+func (d *fncDescriptor) applyDecimal(ctx *decimalContext, params []Value) (Value, error) {
+	decimals := make([]*decimal, len(params))
+	for ix, param := range params {
+		dec, err := ctx.convert(param)
+		if err != nil {
+			return Value{}, err
+		}
+		decimals[ix] = dec
+	}
+	return d.decimal(decimals...)
+}
+
+// Computes the function as floats, passing bools as 1 or 0 and rejecting strings, quantities, imaginary parts
+// and intervals holding more than one number. The result takes the kind of complex, interval or decimal arguments.
+func (d *fncDescriptor) applyFloats(params []Value, floats []float64) (Value, error) {
+	floats = floats[:len(params)]
+	for ix, param := range params {
+		if param.kind == String {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, NUMBER_EXPECTED, param.describe())
+		}
+		if param.kind == Complex && imag(param.c) != 0 {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, REAL_EXPECTED, param.describe())
+		}
+		if param.kind == Quantity {
+			return Value{}, newEvalError(ErrDimensionMismatch, span{}, DIMENSIONLESS_EXPECTED, param.describe())
+		}
+		if param.kind == Interval && !param.r.isPoint() {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, POINT_EXPECTED, param.describe())
+		}
+		floats[ix] = param.Float()
+	}
+
+	res, err := d.eval(floats...)
+	if err != nil {
+		return FloatValue(res), err
+	}
+
+	ctx := decimalArg(params)
+	switch {
+	case complexArg(params):
+		return ComplexValue(complex(res, 0)), nil
+	case intervalArg(params):
+		return intervalValue(point(res)), nil
+	case ctx == nil || math.IsNaN(res) || math.IsInf(res, 0):
+		return FloatValue(res), nil
+	}
+	return decimalValue(ctx.convert(FloatValue(res)))
+}
+
+// Reports whether any of the arguments is a quantity.
+func quantityArg(params []Value) bool {
+	for _, param := range params {
+		if param.kind == Quantity {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the arguments as big integers, reporting false when one of them is not an int or a big integer.
+func bigOperands(params []Value) ([]*big.Int, bool) {
+	ints := make([]*big.Int, len(params))
+	for ix, param := range params {
+		if param.kind != Int && param.kind != BigInt {
+			return nil, false
+		}
+		ints[ix], _ = bigOperand(param)
+	}
+	return ints, true
+}
+
+// Returns the context of the first decimal argument, or nil when there is none.
+func decimalArg(params []Value) *decimalContext {
+	for _, param := range params {
+		if param.kind == Decimal {
+			return param.d.ctx
+		}
+	}
+	return nil
+}
+
+// Describes the accepted argument counts for error messages.
+func (d *fncDescriptor) arity() string {
+	switch {
+	case d.maxArgs == Variadic:
+		return fmt.Sprintf("at least %v", d.args)
+	case d.maxArgs > d.args:
+		return fmt.Sprintf("%v to %v", d.args, d.maxArgs)
+	}
+	return fmt.Sprint(d.args)
 }
 
 // Functions arguments require validation before invocation.
@@ -12,294 +224,973 @@ var funcTable = map[string]*fncDescriptor{
 
 	// NEG(X): Returns the negation of X
 	"NEG": {
-		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return -params[0], nil }, args...)
-		},
+		args:  1,
+		typed: func(params ...Value) (Value, error) { return unaryOp(opNeg, params[0]) },
 	},
 
 	// ABS(X): Returns the absolute value of X
 	"ABS": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Abs(params[0]), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			x := params[0]
+			switch {
+			case x.kind == Bool || x.kind == String:
+				return Value{}, newEvalError(ErrTypeMismatch, span{}, FNC_NOT_DEFINED_ON, "ABS", x.kind)
+			case x.kind == Float:
+				return FloatValue(math.Abs(x.f)), nil
+			case x.kind == Decimal:
+				if x.d.coef.Sign() < 0 {
+					return unaryOp(opNeg, x)
+				}
+				return x, nil
+			case x.kind == BigInt:
+				if x.b.n.Sign() < 0 {
+					return unaryOp(opNeg, x)
+				}
+				return x, nil
+			case x.kind == Quantity:
+				return quantityValue(math.Abs(x.f), *x.u), nil
+			case x.i < 0:
+				return unaryOp(opNeg, x)
+			}
+			return x, nil
+		},
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(complex(cmplx.Abs(params[0]), 0)), nil },
+		interval: func(params ...interval) (Value, error) {
+			x := params[0]
+			switch {
+			case x.lo >= 0:
+				return intervalValue(x), nil
+			case x.hi <= 0:
+				return intervalValue(interval{-x.hi, -x.lo}), nil
+			}
+			return intervalValue(interval{0, math.Max(-x.lo, x.hi)}), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			return params[0].then(math.Abs(params[0].x), sign(params[0].x)), nil
 		},
 	},
 
 	// ACOS(X): Returns the arc cosine of X radians
 	"ACOS": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Acos(params[0]), nil }, args...)
+		eval: func(params ...float64) (float64, error) { return math.Acos(params[0]), nil },
+		interval: func(params ...interval) (Value, error) {
+			if err := checkDomain("ACOS", params[0], -1, 1); err != nil {
+				return Value{}, err
+			}
+			res := monotonic(params[0], true, math.Acos)
+			return intervalValue(interval{math.Max(res.lo, 0), res.hi}), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			x := params[0].x
+			return params[0].then(math.Acos(x), -1/math.Sqrt(1-x*x)), nil
+		},
+	},
+
+	// ARG(X): Returns the argument of X, the angle in radians between the positive real axis and X
+	"ARG": {
+		args: 1,
+		eval: func(params ...float64) (float64, error) { return math.Atan2(0, params[0]), nil },
+		complex: func(params ...complex128) (Value, error) {
+			return ComplexValue(complex(cmplx.Phase(params[0]), 0)), nil
 		},
+		dual: func(params ...dual) (Value, error) { return params[0].then(math.Atan2(0, params[0].x), 0), nil },
 	},
 
 	// ASIN(X): Returns the arc sine of X radians
 	"ASIN": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Asin(params[0]), nil }, args...)
+		eval: func(params ...float64) (float64, error) { return math.Asin(params[0]), nil },
+		interval: func(params ...interval) (Value, error) {
+			if err := checkDomain("ASIN", params[0], -1, 1); err != nil {
+				return Value{}, err
+			}
+			return intervalValue(monotonic(params[0], false, math.Asin)), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			x := params[0].x
+			return params[0].then(math.Asin(x), 1/math.Sqrt(1-x*x)), nil
 		},
 	},
 
 	// ATAN(X): Returns the arc tangent of X radians
 	"ATAN": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Atan(params[0]), nil }, args...)
+		eval: func(params ...float64) (float64, error) { return math.Atan(params[0]), nil },
+		interval: func(params ...interval) (Value, error) {
+			return intervalValue(monotonic(params[0], false, math.Atan)), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			x := params[0].x
+			return params[0].then(math.Atan(x), 1/(1+x*x)), nil
 		},
 	},
 
 	// BAND(X,Y): Returns the bitwise AND of X and Y
 	"BAND": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) & int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("BAND", params[0], params[1])
+			return IntValue(a & b), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.value(new(big.Int).And(params[0], params[1])), nil
 		},
 	},
 
 	// BANDNOT(X,Y): Returns the bitwise AND NOT of X and Y
 	"BANDNOT": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) &^ int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("BANDNOT", params[0], params[1])
+			return IntValue(a &^ b), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.value(new(big.Int).AndNot(params[0], params[1])), nil
 		},
 	},
 
 	// BNOT(X): Returns the bitwise NOT of X
 	"BNOT": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(^int(params[0])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, err := intOperand("BNOT", params[0])
+			return IntValue(^a), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.value(new(big.Int).Not(params[0])), nil
 		},
 	},
 
 	// BOR(X,Y): Returns the bitwise OR of X and Y
 	"BOR": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) | int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("BOR", params[0], params[1])
+			return IntValue(a | b), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.value(new(big.Int).Or(params[0], params[1])), nil
 		},
 	},
 
 	// BXOR(X,Y): Returns the bitwise XOR of X and Y
 	"BXOR": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) ^ int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("BXOR", params[0], params[1])
+			return IntValue(a ^ b), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.value(new(big.Int).Xor(params[0], params[1])), nil
 		},
 	},
 
 	// CEIL(X): Returns the nearest integer greater than or equal to X
 	"CEIL": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Ceil(params[0]), nil }, args...)
+		eval: func(params ...float64) (float64, error) { return math.Ceil(params[0]), nil },
+		interval: func(params ...interval) (Value, error) {
+			return intervalValue(interval{math.Ceil(params[0].lo), math.Ceil(params[0].hi)}), nil
 		},
+		quantity: func(params ...Value) (Value, error) {
+			return quantityValue(math.Ceil(params[0].f), *params[0].u), nil
+		},
+		decimal: func(params ...*decimal) (Value, error) {
+			return decimalValue(params[0].quantize(0, big.ToPositiveInf), nil)
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) { return ctx.value(params[0]), nil },
+		dual:    func(params ...dual) (Value, error) { return params[0].then(math.Ceil(params[0].x), 0), nil },
+	},
+
+	// CONJ(X): Returns the complex conjugate of X
+	"CONJ": {
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return params[0], nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Conj(params[0])), nil },
+		dual:    func(params ...dual) (Value, error) { return params[0].then(params[0].x, 1), nil },
 	},
 
 	// COS(X): Returns the cosine of X radians
 	"COS": {
-		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Cos(params[0]), nil }, args...)
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return math.Cos(params[0]), nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Cos(params[0])), nil },
+		interval: func(params ...interval) (Value, error) {
+			return intervalValue(periodic(params[0], 0, math.Pi, math.Cos)), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			return params[0].then(math.Cos(params[0].x), -math.Sin(params[0].x)), nil
 		},
 	},
 
+	// EXP(X): Returns e raised to the power of X
+	"EXP": {
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return math.Exp(params[0]), nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Exp(params[0])), nil },
+		interval: func(params ...interval) (Value, error) {
+			res := monotonic(params[0], false, math.Exp)
+			return intervalValue(interval{math.Max(res.lo, 0), res.hi}), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := math.Exp(params[0].x)
+			return params[0].then(res, res), nil
+		},
+	},
+
+	// HI(X): Returns the upper bound of the interval X, or X when it is a number
+	"HI": {
+		args:     1,
+		eval:     func(params ...float64) (float64, error) { return params[0], nil },
+		interval: func(params ...interval) (Value, error) { return intervalValue(point(params[0].hi)), nil },
+		dual:     func(params ...dual) (Value, error) { return params[0].then(params[0].x, 1), nil },
+	},
+
+	// IM(X): Returns the imaginary part of X
+	"IM": {
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return 0, nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(complex(imag(params[0]), 0)), nil },
+		dual:    func(params ...dual) (Value, error) { return params[0].then(0, 0), nil },
+	},
+
+	// LN(X): Returns the natural logarithm of X
+	"LN": {
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return math.Log(params[0]), nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Log(params[0])), nil },
+		interval: func(params ...interval) (Value, error) {
+			if err := checkDomain("LN", params[0], 0, math.Inf(1)); err != nil {
+				return Value{}, err
+			}
+			return intervalValue(monotonic(params[0], false, math.Log)), nil
+		},
+		dual: func(params ...dual) (Value, error) { return params[0].then(math.Log(params[0].x), 1/params[0].x), nil },
+	},
+
+	// LO(X): Returns the lower bound of the interval X, or X when it is a number
+	"LO": {
+		args:     1,
+		eval:     func(params ...float64) (float64, error) { return params[0], nil },
+		interval: func(params ...interval) (Value, error) { return intervalValue(point(params[0].lo)), nil },
+		dual:     func(params ...dual) (Value, error) { return params[0].then(params[0].x, 1), nil },
+	},
+
 	// MOD(X,Y): Returns the value of X modulo Y
 	"MOD": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Mod(params[0], params[1]), nil }, args...)
+		args:     2,
+		eval:     func(params ...float64) (float64, error) { return math.Mod(params[0], params[1]), nil },
+		decimal:  func(params ...*decimal) (Value, error) { return decimalOp(opMod, params[0], params[1]) },
+		interval: func(params ...interval) (Value, error) { return intervalOp(opMod, params[0], params[1]) },
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.op(opMod, params[0], params[1])
 		},
+		dual: func(params ...dual) (Value, error) { return dualOp(opMod, params[0], params[1]) },
 	},
 
 	// POW(X,Y): Returns the X raised to the power of Y
 	"POW": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Pow(params[0], params[1]), nil }, args...)
+		args:     2,
+		eval:     func(params ...float64) (float64, error) { return math.Pow(params[0], params[1]), nil },
+		decimal:  func(params ...*decimal) (Value, error) { return decimalOp(opPow, params[0], params[1]) },
+		complex:  func(params ...complex128) (Value, error) { return ComplexValue(powComplex(params[0], params[1])), nil },
+		interval: func(params ...interval) (Value, error) { return intervalOp(opPow, params[0], params[1]) },
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.op(opPow, params[0], params[1])
 		},
+		dual: func(params ...dual) (Value, error) { return dualOp(opPow, params[0], params[1]) },
+	},
+
+	// RE(X): Returns the real part of X
+	"RE": {
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return params[0], nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(complex(real(params[0]), 0)), nil },
+		dual:    func(params ...dual) (Value, error) { return params[0].then(params[0].x, 1), nil },
 	},
 
 	// RND(X): Returns the integer nearest to X
 	"RND": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.RoundToEven(params[0]), nil }, args...)
+		eval: func(params ...float64) (float64, error) { return math.RoundToEven(params[0]), nil },
+		interval: func(params ...interval) (Value, error) {
+			return intervalValue(interval{math.RoundToEven(params[0].lo), math.RoundToEven(params[0].hi)}), nil
+		},
+		quantity: func(params ...Value) (Value, error) {
+			return quantityValue(math.RoundToEven(params[0].f), *params[0].u), nil
+		},
+		decimal: func(params ...*decimal) (Value, error) {
+			return decimalValue(params[0].quantize(0, big.ToNearestEven), nil)
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) { return ctx.value(params[0]), nil },
+		dual:    func(params ...dual) (Value, error) { return params[0].then(math.RoundToEven(params[0].x), 0), nil },
+	},
+
+	// ROUND(X[,D]): Returns X rounded to D decimal places, or to an integer when D is omitted. Halves
+	// are rounded to even, or in the rounding mode of a parser in decimal mode. Negative places round
+	// to tens, hundreds and so on
+	"ROUND": {
+		args:    1,
+		maxArgs: 2,
+		typed:   func(params ...Value) (Value, error) { return roundNumber(params[0], params[1:]) },
+		complex: func(params ...complex128) (Value, error) {
+			places := make([]Value, len(params)-1)
+			for ix, p := range params[1:] {
+				places[ix] = ComplexValue(p)
+			}
+
+			re, err := roundNumber(FloatValue(real(params[0])), places)
+			if err != nil {
+				return Value{}, err
+			}
+
+			im, err := roundNumber(FloatValue(imag(params[0])), places)
+			return ComplexValue(complex(re.f, im.f)), err
+		},
+		decimal: func(params ...*decimal) (Value, error) {
+			places := make([]Value, len(params)-1)
+			for ix, p := range params[1:] {
+				places[ix] = Value{kind: Decimal, d: p}
+			}
+			return roundDecimal(params[0], places)
+		},
+		interval: func(params ...interval) (Value, error) {
+			places := make([]Value, len(params)-1)
+			for ix, p := range params[1:] {
+				if !p.isPoint() {
+					return Value{}, newEvalError(ErrTypeMismatch, span{}, POINT_EXPECTED, intervalValue(p).describe())
+				}
+				places[ix] = FloatValue(p.lo)
+			}
+
+			// Rounding never decreases, so the ends round to the bounds
+			lo, err := roundNumber(FloatValue(params[0].lo), places)
+			if err != nil {
+				return Value{}, err
+			}
+
+			hi, err := roundNumber(FloatValue(params[0].hi), places)
+			return intervalValue(interval{lo.Float(), hi.Float()}), err
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			if len(params) == 1 || params[1].Sign() >= 0 {
+				return ctx.value(params[0]), nil
+			}
+
+			places := new(big.Int).Neg(params[1])
+			if !places.IsInt64() {
+				return ctx.value(new(big.Int)), nil
+			}
+			return ctx.round(params[0], places.Int64()), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			places := make([]Value, len(params)-1)
+			for ix, p := range params[1:] {
+				places[ix] = FloatValue(p.x)
+			}
+
+			// Rounding steps, so its derivative is zero wherever it has one
+			res, err := roundNumber(FloatValue(params[0].x), places)
+			return params[0].then(res.Float(), 0), err
 		},
 	},
 
 	// SHL(X,Y): Returns the value of X shifted left by Y bits
 	"SHL": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) << int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("SHL", params[0], params[1])
+			if err != nil {
+				return Value{}, err
+			}
+			return shift(a, b, true)
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.shift(params[0], params[1], true)
 		},
 	},
 
 	// SHR(X,Y): Returns the value of X shifted right by Y bits
 	"SHR": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return float64(int(params[0]) >> int(params[1])), nil }, args...)
+		typed: func(params ...Value) (Value, error) {
+			a, b, err := intOperands("SHR", params[0], params[1])
+			if err != nil {
+				return Value{}, err
+			}
+			return shift(a, b, false)
+		},
+		integer: func(ctx *integerContext, params ...*big.Int) (Value, error) {
+			return ctx.shift(params[0], params[1], false)
 		},
 	},
 
 	// SIN(X): Returns the sine of X radians
 	"SIN": {
-		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Sin(params[0]), nil }, args...)
+		args:    1,
+		eval:    func(params ...float64) (float64, error) { return math.Sin(params[0]), nil },
+		complex: func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Sin(params[0])), nil },
+		interval: func(params ...interval) (Value, error) {
+			return intervalValue(periodic(params[0], math.Pi/2, -math.Pi/2, math.Sin)), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			return params[0].then(math.Sin(params[0].x), math.Cos(params[0].x)), nil
 		},
 	},
 
 	// SQR(X): Returns the square root of X
 	"SQR": {
-		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Sqrt(params[0]), nil }, args...)
+		args:     1,
+		eval:     func(params ...float64) (float64, error) { return math.Sqrt(params[0]), nil },
+		quantity: func(params ...Value) (Value, error) { return sqrtQuantity(params[0]) },
+		decimal:  func(params ...*decimal) (Value, error) { return decimalValue(params[0].sqrt()) },
+		complex:  func(params ...complex128) (Value, error) { return ComplexValue(cmplx.Sqrt(params[0])), nil },
+		interval: func(params ...interval) (Value, error) {
+			if err := checkDomain("SQR", params[0], 0, math.Inf(1)); err != nil {
+				return Value{}, err
+			}
+			return intervalValue(interval{sqrtRounded(params[0].lo, false), sqrtRounded(params[0].hi, true)}), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := math.Sqrt(params[0].x)
+			return params[0].then(res, 1/(2*res)), nil
 		},
 	},
 
 	// TAN(X): Returns the tangent of X radians
 	"TAN": {
-		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Tan(params[0]), nil }, args...)
+		args:     1,
+		eval:     func(params ...float64) (float64, error) { return math.Tan(params[0]), nil },
+		interval: func(params ...interval) (Value, error) { return intervalValue(tanInterval(params[0])), nil },
+		dual: func(params ...dual) (Value, error) {
+			cos := math.Cos(params[0].x)
+			return params[0].then(math.Tan(params[0].x), 1/(cos*cos)), nil
 		},
 	},
 
-	// EQ(X,Y): Returns 1 if X is equal to Y, otherwise 0
+	// EQ(X,Y): Returns true if X is equal to Y, otherwise false
 	"EQ": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] == params[1] {
-					return 1.0, nil
-				}
-				return 0.0, nil
-			}, args...)
-		},
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opEq, params[0], params[1]) },
 	},
 
-	// NE(X,Y): Returns 1 if X is not equal to Y, otherwise 0
+	// NE(X,Y): Returns true if X is not equal to Y, otherwise false
 	"NE": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] != params[1] {
-					return 1.0, nil
-				}
-				return 0.0, nil
-			}, args...)
-		},
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opNeq, params[0], params[1]) },
 	},
 
-	// GE(X,Y): Returns 1 if X is greater than or equal to Y, otherwise 0
+	// GE(X,Y): Returns true if X is greater than or equal to Y, otherwise false
 	"GE": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] >= params[1] {
-					return 1.0, nil
-				}
-				return 0.0, nil
-			}, args...)
-		},
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opGte, params[0], params[1]) },
 	},
 
-	// GT(X,Y): Returns 1 if X is greater than Y, otherwise 0
+	// GT(X,Y): Returns true if X is greater than Y, otherwise false
 	"GT": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] > params[1] {
-					return 1.0, nil
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opGt, params[0], params[1]) },
+	},
+
+	// LE(X,Y): Returns true if X is less than or equal to Y, otherwise false
+	"LE": {
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opLte, params[0], params[1]) },
+	},
+
+	// LT(X,Y): Returns true if X is less than Y, otherwise false
+	"LT": {
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return binaryOp(opLt, params[0], params[1]) },
+	},
+
+	// MIN(X,...): Returns the minimum of its arguments
+	"MIN": {
+		args:    1,
+		maxArgs: Variadic,
+		typed: func(params ...Value) (Value, error) {
+			res := params[0]
+			for _, p := range params {
+				less, err := binaryOp(opLt, p, res)
+				if err != nil {
+					return Value{}, err
 				}
-				return 0.0, nil
-			}, args...)
+
+				// NaN wins, as it does for math.Min and math.Max
+				if less.Bool() || p.kind == Float && math.IsNaN(p.f) {
+					res = p
+				}
+			}
+
+			return widest(res, params)
+		},
+		interval: func(params ...interval) (Value, error) {
+			res := params[0]
+			for _, p := range params[1:] {
+				res = interval{math.Min(res.lo, p.lo), math.Min(res.hi, p.hi)}
+			}
+			return intervalValue(res), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := extremeDual(params, false)
+			return dualValue(res.x, res.dx), nil
 		},
 	},
 
-	// LE(X,Y): Returns 1 if X is less than or equal to Y, otherwise 0
-	"LE": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] <= params[1] {
-					return 1.0, nil
+	// MAX(X,...): Returns the maximum of its arguments
+	"MAX": {
+		args:    1,
+		maxArgs: Variadic,
+		typed: func(params ...Value) (Value, error) {
+			res := params[0]
+			for _, p := range params {
+				less, err := binaryOp(opGt, p, res)
+				if err != nil {
+					return Value{}, err
+				}
+
+				// NaN wins, as it does for math.Min and math.Max
+				if less.Bool() || p.kind == Float && math.IsNaN(p.f) {
+					res = p
 				}
-				return 0.0, nil
-			}, args...)
+			}
+
+			return widest(res, params)
+		},
+		interval: func(params ...interval) (Value, error) {
+			res := params[0]
+			for _, p := range params[1:] {
+				res = interval{math.Max(res.lo, p.lo), math.Max(res.hi, p.hi)}
+			}
+			return intervalValue(res), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := extremeDual(params, true)
+			return dualValue(res.x, res.dx), nil
 		},
 	},
 
-	// LT(X,Y): Returns 1 if X is less than Y, otherwise 0
-	"LT": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] < params[1] {
-					return 1.0, nil
+	// SUM(X,...): Returns the sum of its arguments
+	"SUM": {
+		args:    1,
+		maxArgs: Variadic,
+		typed: func(params ...Value) (Value, error) {
+			if params[0].kind == Quantity {
+				return reduce(opAdd, params[0], params[1:]) // which cannot be added to 0
+			}
+			return reduce(opAdd, IntValue(0), params)
+		},
+	},
+
+	// PRODUCT(X,...): Returns the product of its arguments
+	"PRODUCT": {
+		args:    1,
+		maxArgs: Variadic,
+		typed:   func(params ...Value) (Value, error) { return reduce(opMul, IntValue(1), params) },
+	},
+
+	// AVG(X,...): Returns the arithmetic mean of its arguments
+	"AVG": {
+		args:    1,
+		maxArgs: Variadic,
+		eval:    func(params ...float64) (float64, error) { return sum(params) / float64(len(params)), nil },
+		quantity: func(params ...Value) (Value, error) {
+			total, err := reduce(opAdd, params[0], params[1:])
+			if err != nil {
+				return Value{}, err
+			}
+			return binaryOp(opDiv, total, IntValue(int64(len(params))))
+		},
+		decimal: func(params ...*decimal) (Value, error) {
+			total := params[0]
+			for _, p := range params[1:] {
+				res, err := decimalOp(opAdd, total, p)
+				if err != nil {
+					return Value{}, err
 				}
-				return 0.0, nil
-			}, args...)
+				total = res.d
+			}
+			return decimalOp(opDiv, total, &decimal{coef: big.NewInt(int64(len(params))), ctx: total.ctx})
+		},
+		interval: func(params ...interval) (Value, error) {
+			total := params[0]
+			for _, p := range params[1:] {
+				total = interval{addRounded(total.lo, p.lo, false), addRounded(total.hi, p.hi, true)}
+			}
+			return intervalOp(opDiv, total, point(float64(len(params))))
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := meanDual(params)
+			return dualValue(res.x, res.dx), nil
 		},
 	},
 
-	// MIN(X,Y): Returns the minimum of X and Y
-	"MIN": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Min(params[0], params[1]), nil }, args...)
+	// MEDIAN(X,...): Returns the median of its arguments
+	"MEDIAN": {
+		args:    1,
+		maxArgs: Variadic,
+		decimal: func(params ...*decimal) (Value, error) {
+			sorted := append([]*decimal(nil), params...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i].cmp(sorted[j]) < 0 })
+
+			mid := len(sorted) / 2
+			if len(sorted)%2 == 0 {
+				total, err := decimalOp(opAdd, sorted[mid-1], sorted[mid])
+				if err != nil {
+					return Value{}, err
+				}
+				return decimalOp(opDiv, total.d, &decimal{coef: big.NewInt(2), ctx: total.d.ctx})
+			}
+			return Value{kind: Decimal, d: sorted[mid]}, nil
+		},
+		interval: func(params ...interval) (Value, error) { return intervalValue(medianInterval(params)), nil },
+		eval: func(params ...float64) (float64, error) {
+			sorted := append([]float64(nil), params...)
+			sort.Float64s(sorted)
+
+			mid := len(sorted) / 2
+			if len(sorted)%2 == 0 {
+				return (sorted[mid-1] + sorted[mid]) / 2, nil
+			}
+			return sorted[mid], nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := medianDual(params)
+			return dualValue(res.x, res.dx), nil
 		},
 	},
 
-	// MAX(X,Y): Returns the maximum of X and Y
-	"MAX": {
-		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) { return math.Max(params[0], params[1]), nil }, args...)
+	// STDDEV(X,...): Returns the population standard deviation of its arguments
+	"STDDEV": {
+		args:    1,
+		maxArgs: Variadic,
+		eval: func(params ...float64) (float64, error) {
+			mean := sum(params) / float64(len(params))
+			variance := 0.0
+			for _, p := range params {
+				variance += (p - mean) * (p - mean)
+			}
+			return math.Sqrt(variance / float64(len(params))), nil
+		},
+		dual: func(params ...dual) (Value, error) {
+			res := stddevDual(params)
+			return dualValue(res.x, res.dx), nil
 		},
 	},
 
+	// COUNT(X,...): Returns the number of arguments
+	"COUNT": {
+		args:    1,
+		maxArgs: Variadic,
+		typed:   func(params ...Value) (Value, error) { return IntValue(int64(len(params))), nil },
+	},
+
 	// AND(X,Y): Returns the logical AND of X and Y
 	"AND": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] == 1 && params[1] == 1 {
-					return 1.0, nil
-				}
-				return 0.0, nil
-			}, args...)
+		typed: func(params ...Value) (Value, error) {
+			return BoolValue(params[0].Float() == 1 && params[1].Float() == 1), nil
 		},
 	},
 
 	// OR(X,Y): Returns the logical OR of X and Y
 	"OR": {
 		args: 2,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] == 1 || params[1] == 1 {
-					return 1.0, nil
-				}
-				return 0.0, nil
-			}, args...)
+		typed: func(params ...Value) (Value, error) {
+			return BoolValue(params[0].Float() == 1 || params[1].Float() == 1), nil
 		},
 	},
 
 	// NOT(X): Returns the logical NOT of X
 	"NOT": {
+		args:  1,
+		typed: func(params ...Value) (Value, error) { return BoolValue(params[0].Float() != 1), nil },
+	},
+
+	// IF(C,X,Y): Returns X if C is non-zero, otherwise Y. Only the selected argument is evaluated
+	"IF": {
+		args: 3,
+		invoke: func(args []treeNode, env Resolver) (Value, error) {
+			return newConditional(args[0], args[1], args[2], span{}).Eval(env)
+		},
+	},
+
+	// IFERROR(X,Y): Returns X, or Y if evaluating X fails. Y is only evaluated when needed
+	"IFERROR": {
+		args: 2,
+		invoke: func(args []treeNode, env Resolver) (Value, error) {
+			res, err := evalNode(args[0], env)
+			if err == nil {
+				return res, nil
+			}
+			return evalNode(args[1], env)
+		},
+	},
+
+	// LEN(S): Returns the number of characters in S
+	"LEN": {
 		args: 1,
-		invoke: func(args []treeNode) (any, error) {
-			return evalT(func(params ...float64) (any, error) {
-				if params[0] == 1.0 {
-					return 0.0, nil
+		typed: func(params ...Value) (Value, error) {
+			s, err := stringArg("LEN", params[0])
+			return IntValue(int64(utf8.RuneCountInString(s))), err
+		},
+	},
+
+	// UPPER(S): Returns S with all letters in upper case
+	"UPPER": {
+		args:  1,
+		typed: func(params ...Value) (Value, error) { return mapString("UPPER", params[0], strings.ToUpper) },
+	},
+
+	// LOWER(S): Returns S with all letters in lower case
+	"LOWER": {
+		args:  1,
+		typed: func(params ...Value) (Value, error) { return mapString("LOWER", params[0], strings.ToLower) },
+	},
+
+	// TRIM(S): Returns S without leading and trailing white space
+	"TRIM": {
+		args:  1,
+		typed: func(params ...Value) (Value, error) { return mapString("TRIM", params[0], strings.TrimSpace) },
+	},
+
+	// SUBSTR(S,I[,N]): Returns the N characters of S starting at the zero-based index I, or all of them
+	// to the end of S when N is omitted. Ranges reaching outside of S are clipped to it
+	"SUBSTR": {
+		args:    2,
+		maxArgs: 3,
+		typed: func(params ...Value) (Value, error) {
+			s, err := stringArg("SUBSTR", params[0])
+			if err != nil {
+				return Value{}, err
+			}
+
+			start, err := intOperand("SUBSTR", params[1])
+			if err != nil {
+				return Value{}, err
+			}
+
+			chars := []rune(s)
+			count := int64(len(chars))
+			if len(params) > 2 {
+				if count, err = intOperand("SUBSTR", params[2]); err != nil {
+					return Value{}, err
+				}
+			}
+			return StringValue(substr(chars, start, count)), nil
+		},
+	},
+
+	// CONTAINS(S,T): Returns true if T occurs within S, otherwise false
+	"CONTAINS": {
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return testStrings("CONTAINS", params, strings.Contains) },
+	},
+
+	// STARTSWITH(S,T): Returns true if S begins with T, otherwise false
+	"STARTSWITH": {
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return testStrings("STARTSWITH", params, strings.HasPrefix) },
+	},
+
+	// ENDSWITH(S,T): Returns true if S ends with T, otherwise false
+	"ENDSWITH": {
+		args:  2,
+		typed: func(params ...Value) (Value, error) { return testStrings("ENDSWITH", params, strings.HasSuffix) },
+	},
+
+	// REPLACE(S,OLD,NEW): Returns S with every occurrence of OLD replaced by NEW
+	"REPLACE": {
+		args: 3,
+		typed: func(params ...Value) (Value, error) {
+			var strs [3]string
+			for ix, param := range params {
+				s, err := stringArg("REPLACE", param)
+				if err != nil {
+					return Value{}, err
 				}
-				return 1.0, nil
-			}, args...)
+				strs[ix] = s
+			}
+			return StringValue(strings.ReplaceAll(strs[0], strs[1], strs[2])), nil
+		},
+	},
+
+	// FORMAT(F,X,...): Returns the arguments formatted according to the format string F, whose verbs
+	// are those of Go's fmt package, such as %d, %.2f, %s and %v
+	"FORMAT": {
+		args:    1,
+		maxArgs: Variadic,
+		typed: func(params ...Value) (Value, error) {
+			format, err := stringArg("FORMAT", params[0])
+			if err != nil {
+				return Value{}, err
+			}
+
+			args := make([]any, len(params)-1)
+			for ix, param := range params[1:] {
+				args[ix] = param.native()
+			}
+			return StringValue(fmt.Sprintf(format, args...)), nil
+		},
+	},
+
+	// TO(X,U): Returns the quantity X converted to the unit U, such as "km/h", which must have the
+	// same dimension
+	"TO": {
+		args: 2,
+		typed: func(params ...Value) (Value, error) {
+			name, err := stringArg("TO", params[1])
+			if err != nil {
+				return Value{}, err
+			}
+
+			u, err := parseUnit(name)
+			if err != nil {
+				return Value{}, err
+			}
+			return convertQuantity(params[0], u)
 		},
 	},
 }
+
+func sum(params []float64) float64 {
+	var res float64
+	for _, p := range params {
+		res += p
+	}
+	return res
+}
+
+// Combines the arguments of a function with a binary operator, from left to right.
+func reduce(op opcode, res Value, params []Value) (Value, error) {
+	var err error
+	for _, p := range params {
+		if res, err = binaryOp(op, res, p); err != nil {
+			return Value{}, err
+		}
+	}
+	return res, nil
+}
+
+// Returns both operands as ints for a bitwise function.
+func intOperands(name string, x, y Value) (int64, int64, error) {
+	a, err := intOperand(name, x)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	b, err := intOperand(name, y)
+	return a, b, err
+}
+
+// Returns the argument of a string function, which must be a string.
+func stringArg(name string, v Value) (string, error) {
+	if v.kind != String {
+		return "", newEvalError(ErrTypeMismatch, span{}, FNC_NOT_DEFINED_ON, name, v.describe())
+	}
+	return v.s, nil
+}
+
+func mapString(name string, v Value, fn func(string) string) (Value, error) {
+	s, err := stringArg(name, v)
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(fn(s)), nil
+}
+
+func testStrings(name string, params []Value, fn func(s, t string) bool) (Value, error) {
+	s, err := stringArg(name, params[0])
+	if err != nil {
+		return Value{}, err
+	}
+
+	t, err := stringArg(name, params[1])
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(fn(s, t)), nil
+}
+
+// Returns up to count characters starting at start, clipping the range to the characters there are.
+func substr(chars []rune, start, count int64) string {
+	end := int64(len(chars))
+	if count < end-start {
+		end = start + count
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if start >= end {
+		return ""
+	}
+	return string(chars[start:end])
+}
+
+// Rounds x to the number of decimal places given by the optional second argument of ROUND.
+func roundDecimal(x *decimal, places []Value) (Value, error) {
+	var digits int64
+	if len(places) > 0 {
+		var err error
+		if digits, err = intOperand("ROUND", places[0]); err != nil {
+			return Value{}, err
+		}
+	}
+
+	// Beyond the exponent range, rounding either keeps every digit or none of them
+	limit := int64(decimalMaxExp) + int64(x.ctx.prec)
+	if digits > limit {
+		digits = limit
+	} else if digits < -limit {
+		digits = -limit
+	}
+	return Value{kind: Decimal, d: x.quantize(-digits, x.ctx.mode)}, nil
+}
+
+// Returns res promoted to the widest kind among the arguments, so that the arguments of MIN and MAX
+// being mixed ints and floats gives a float.
+func widest(res Value, params []Value) (Value, error) {
+	var err error
+	for _, p := range params {
+		if res, err = promote(res, p); err != nil {
+			return Value{}, err
+		}
+	}
+	return res, nil
+}
+
+// Rounds an int or a float to the number of decimal places given by the optional second argument of ROUND,
+// through a decimal so that the digits rounded are the ones the float is written with.
+func roundNumber(x Value, places []Value) (Value, error) {
+	if x.kind == Quantity {
+		res, err := roundNumber(FloatValue(x.f), places)
+		return quantityValue(res.f, *x.u), err
+	}
+
+	if x.kind != Int && x.kind != Float {
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, FNC_NOT_DEFINED_ON, "ROUND", x.describe())
+	}
+
+	if x.kind == Float && (math.IsNaN(x.f) || math.IsInf(x.f, 0)) {
+		return x, nil
+	}
+
+	dec, err := defaultDecimal.convert(x)
+	if err != nil {
+		return Value{}, err
+	}
+
+	rounded, err := roundDecimal(dec, places)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if i, ok := rounded.d.int64(); ok && x.kind == Int {
+		return IntValue(i), nil
+	}
+	return FloatValue(rounded.d.float()), nil
+}
@@ -0,0 +1,104 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Suggested fixes that do not depend on the offending input.
+var errorHints = map[ErrorCode]string{
+	ErrUnbalancedParens:  "remove this ')' or add a matching '(' before it",
+	ErrDivideByZero:      "guard the divisor with IF(...) or IFERROR(...)",
+	ErrNegativeShift:     "shift in the opposite direction instead",
+	ErrUndefinedVariable: "provide a value for it when evaluating the expression",
+	ErrInvalidString:     "close the string with the quote it opens with, and escape quotes and backslashes inside it with \\",
+	ErrTypeMismatch:      "turn a bool into a number with C ? 1 : 0, or a float into an int with RND(...)",
+	ErrUnknownUnit:       "units are case sensitive SI symbols with an optional prefix, such as m, kg, km/h or m/s^2",
+	ErrDimensionMismatch: "check the units of the operands, or divide a quantity by a unit, as in x / (1 m), to drop it",
+	ErrIndeterminate:     "compare the bounds with LO(...) or HI(...) instead",
+	ErrNotDifferentiable: "apply it to constants only, or take the derivative of the expression without it",
+	ErrNoConvergence:     "choose bounds the expression crosses the target between, or narrow them around a single root",
+}
+
+// Fills in hints that depend on the offending input, such as the function a misspelled name was meant to be.
+func (p *Parser) withHint(err error, input string) error {
+	e, ok := err.(SyntaxError)
+	if !ok || e.End > len(input) {
+		return err
+	}
+
+	text := input[e.Offset:e.End]
+	switch {
+	case e.Code == ErrUnknownFunction:
+		if name := closest(text, p.funcNames()); name != "" {
+			e.Hint = fmt.Sprintf(HINT_DID_YOU_MEAN, name)
+		}
+
+	case e.Code == ErrInvalidChar && text == "=":
+		e.Hint = fmt.Sprintf(HINT_DID_YOU_MEAN, "==")
+	}
+	return e
+}
+
+// Lists the builtins and the functions registered on this parser, sorted by name.
+func (p *Parser) funcNames() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(funcTable)+len(p.funcs))
+	for name := range funcTable {
+		names = append(names, name)
+	}
+
+	for name := range p.funcs {
+		if _, builtin := funcTable[name]; !builtin {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Finds the candidate closest to name, ignoring case, or "" when none are close enough to be a likely typo.
+func closest(name string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, candidate := range candidates {
+		dist := editDistance(strings.ToUpper(name), strings.ToUpper(candidate))
+		if dist < bestDist && dist < len(candidate) {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best
+}
+
+// Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v < first {
+			first = v
+		}
+	}
+	return first
+}
@@ -0,0 +1,439 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// IntervalMode selects interval arithmetic for the parser: number literals, and the numeric variables of the
+// programs it compiles, are intervals, and the operators and interval-aware builtins return an interval holding
+// every value the result could take for values anywhere within their operands. Bounds are rounded outward, so
+// the exact result is always within them, and literals that no float holds exactly, such as 0.1, are the
+// narrowest interval around their value. Intervals hold floats, so the mode replaces any other number mode
+// given before it.
+func IntervalMode() ParserOption {
+	return func(p *Parser) {
+		p.resetMode()
+		p.interval = true
+	}
+}
+
+// A closed interval of floats, which is unbounded on a side whose bound is an infinity.
+type interval struct {
+	lo, hi float64
+}
+
+// IntervalValue returns a Value holding the interval between lo and hi, which may be given in either order.
+func IntervalValue(lo, hi float64) Value {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return intervalValue(interval{lo, hi})
+}
+
+func intervalValue(r interval) Value { return Value{kind: Interval, r: &r} }
+
+func point(x float64) interval { return interval{x, x} }
+
+func (r interval) isPoint() bool { return r.lo == r.hi }
+
+func (r interval) String() string {
+	return "[" + strconv.FormatFloat(r.lo, 'g', -1, 64) + ", " + strconv.FormatFloat(r.hi, 'g', -1, 64) + "]"
+}
+
+// Parses a number literal as the narrowest interval holding its exact value, which is a single float when
+// one holds it.
+func intervalLiteral(lit string) (Value, bool) {
+	if _, ok := parseNumber(lit); !ok && !isOutOfRange(lit) {
+		return Value{}, false
+	}
+
+	x, _, err := big.ParseFloat(lit, 0, 53, big.ToNearestEven)
+	if err != nil {
+		return Value{}, false
+	}
+
+	f, acc := x.Float64()
+	switch {
+	case acc != big.Exact || math.IsInf(f, 0): // beyond the range of floats, or among the subnormal ones
+		return intervalValue(interval{nextDown(f), nextUp(f)}), true
+	case x.Acc() == big.Above:
+		return intervalValue(interval{nextDown(f), f}), true
+	case x.Acc() == big.Below:
+		return intervalValue(interval{f, nextUp(f)}), true
+	}
+	return intervalValue(point(f)), true
+}
+
+// Converts a number into an interval, which is a single float unless the number has no exact float value,
+// reporting false for bools, strings, complex numbers, quantities and duals.
+func intervalOperand(v Value) (interval, bool) {
+	switch v.kind {
+	case Interval:
+		return *v.r, true
+	case Float:
+		return point(v.f), true
+	case Bool, String, Complex, Quantity, dualKind:
+		return interval{}, false
+	}
+
+	f := v.Float()
+	if exact, r := FloatValue(f).Rat(), v.Rat(); exact != nil && r != nil && exact.Cmp(r) == 0 {
+		return point(f), true
+	}
+	return interval{nextDown(f), nextUp(f)}, true
+}
+
+// Reports whether any of the arguments is an interval.
+func intervalArg(params []Value) bool {
+	for _, param := range params {
+		if param.kind == Interval {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies an arithmetic or comparison operator to two intervals.
+func intervalOp(op opcode, a, b interval) (Value, error) {
+	switch op {
+	case opAdd:
+		return intervalValue(interval{addRounded(a.lo, b.lo, false), addRounded(a.hi, b.hi, true)}), nil
+	case opSub:
+		return intervalValue(interval{addRounded(a.lo, -b.hi, false), addRounded(a.hi, -b.lo, true)}), nil
+	case opMul:
+		return intervalValue(corners(a, b, mulRounded)), nil
+	case opDiv:
+		if err := checkDivisor(b); err != nil {
+			return Value{}, err
+		}
+		return intervalValue(corners(a, b, divRounded)), nil
+	case opMod:
+		return modInterval(a, b)
+	case opPow:
+		return powInterval(a, b)
+	}
+	return compareIntervals(op, a, b)
+}
+
+// Returns the hull of an operation rounded outward at the four corners of a and b, which bound the operation
+// when it is monotonic in each operand.
+func corners(a, b interval, f func(x, y float64, up bool) float64) interval {
+	res := interval{math.Inf(1), math.Inf(-1)}
+	for _, x := range [...]float64{a.lo, a.hi} {
+		for _, y := range [...]float64{b.lo, b.hi} {
+			res.lo = math.Min(res.lo, f(x, y, false))
+			res.hi = math.Max(res.hi, f(x, y, true))
+		}
+	}
+	return res
+}
+
+// Fails for a divisor holding zero, which has no bounded quotient.
+func checkDivisor(b interval) error {
+	switch {
+	case b == point(0):
+		return newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+	case b.lo <= 0 && b.hi >= 0:
+		return newEvalError(ErrDivideByZero, span{}, DIVISOR_CONTAINS_ZERO, b)
+	}
+	return nil
+}
+
+// Bounds the remainder of a divided by b, which takes the sign of a and is smaller than b in magnitude, as
+// for floats.
+func modInterval(a, b interval) (Value, error) {
+	if err := checkDivisor(b); err != nil {
+		return Value{}, err
+	}
+
+	// The remainder rises with a, but for falling back by |b| where a crosses a non-zero multiple of b, which
+	// an a narrower than |b| crosses at most once. The remainders of its ends, which are exact, bound it
+	// unless it does.
+	if b.isPoint() {
+		lo, hi := math.Mod(a.lo, b.lo), math.Mod(a.hi, b.lo)
+		if lo <= hi && addRounded(a.hi, -a.lo, true) < math.Abs(b.lo) {
+			return intervalValue(interval{lo, hi}), nil
+		}
+	}
+
+	least, most := math.Min(math.Abs(b.lo), math.Abs(b.hi)), math.Max(math.Abs(b.lo), math.Abs(b.hi))
+	switch {
+	case a.lo > -least && a.hi < least:
+		return intervalValue(a), nil
+	case a.lo >= 0:
+		return intervalValue(interval{0, math.Min(a.hi, most)}), nil
+	case a.hi <= 0:
+		return intervalValue(interval{math.Max(a.lo, -most), 0}), nil
+	}
+	return intervalValue(interval{math.Max(a.lo, -most), math.Min(a.hi, most)}), nil
+}
+
+// Raises a to the power of b. Integer powers are multiplied out with outward rounding, and any other power
+// is only defined for a non-negative base.
+func powInterval(a, b interval) (Value, error) {
+	if !b.isPoint() || b.lo != math.Trunc(b.lo) || math.Abs(b.lo) > 1<<53 {
+		if a.lo < 0 {
+			return Value{}, newEvalError(ErrInvalidValue, span{}, OUTSIDE_DOMAIN, "**", a)
+		}
+		return intervalValue(widen(corners(a, b, func(x, y float64, _ bool) float64 { return math.Pow(x, y) }))), nil
+	}
+
+	if b.lo < 0 {
+		den, err := powInterval(a, point(-b.lo))
+		if err != nil {
+			return Value{}, err
+		}
+		return intervalOp(opDiv, point(1), *den.r)
+	}
+
+	n := uint64(b.lo)
+	switch {
+	case n%2 == 1 || a.lo >= 0:
+		return intervalValue(interval{signedPow(a.lo, n, false), signedPow(a.hi, n, true)}), nil
+	case a.hi <= 0:
+		return intervalValue(interval{powRounded(-a.hi, n, false), powRounded(-a.lo, n, true)}), nil
+	}
+	return intervalValue(interval{0, powRounded(math.Max(-a.lo, a.hi), n, true)}), nil
+}
+
+// Compares two intervals, which is decided only when the comparison holds for every pair of values within
+// them, or for none.
+func compareIntervals(op opcode, a, b interval) (Value, error) {
+	var always, never bool
+	switch op {
+	case opLt:
+		always, never = a.hi < b.lo, a.lo >= b.hi
+	case opLte:
+		always, never = a.hi <= b.lo, a.lo > b.hi
+	case opGt:
+		always, never = a.lo > b.hi, a.hi <= b.lo
+	case opGte:
+		always, never = a.lo >= b.hi, a.hi < b.lo
+	case opEq, opNeq:
+		always, never = a.isPoint() && a == b, a.hi < b.lo || b.hi < a.lo
+		if op == opNeq {
+			always, never = never, always
+		}
+	default:
+		return Value{}, newEvalError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+	}
+
+	if !always && !never {
+		return Value{}, newEvalError(ErrIndeterminate, span{}, INDETERMINATE_COMPARISON, a, opSymbols[op], b)
+	}
+	return BoolValue(always), nil
+}
+
+// Results of a magnitude below this may have rounding errors that are not floats themselves, as they
+// underflow, so they are rounded outward without checking which way they were rounded.
+const minExact = 0x1p-969
+
+// The most the functions of the math package stray from their exact results, in units in the last place.
+// Unlike the arithmetic operators and math.Sqrt, they do not round correctly.
+const libraryError = 2
+
+// Beyond this magnitude, the rounding errors of a trigonometric argument are too large to locate it within
+// its period.
+const trigRange = 1 << 20
+
+func nextDown(x float64) float64 { return math.Nextafter(x, math.Inf(-1)) }
+func nextUp(x float64) float64   { return math.Nextafter(x, math.Inf(1)) }
+
+// Rounds x toward positive infinity when up is set, and toward negative infinity otherwise.
+func outward(x float64, up bool) float64 {
+	if up {
+		return nextUp(x)
+	}
+	return nextDown(x)
+}
+
+// Rounds x, the nearest float to an exact result that is x + err, toward positive infinity when up is set,
+// and toward negative infinity otherwise.
+func directed(x, err float64, up bool) float64 {
+	switch {
+	case up && err > 0:
+		return nextUp(x)
+	case !up && err < 0:
+		return nextDown(x)
+	}
+	return x
+}
+
+// Bounds a result that is NaN, from opposite infinities, which leaves it unbounded, or an infinity, which
+// is kept unless it comes from finite operands overflowing, which the largest float bounds from below.
+func unbounded(res float64, finite, up bool) float64 {
+	switch {
+	case math.IsNaN(res) && up:
+		return math.Inf(1)
+	case math.IsNaN(res):
+		return math.Inf(-1)
+	case finite && math.IsInf(res, 1) && !up:
+		return math.MaxFloat64
+	case finite && math.IsInf(res, -1) && up:
+		return -math.MaxFloat64
+	}
+	return res
+}
+
+func isFinite(a, b float64) bool { return !math.IsInf(a, 0) && !math.IsInf(b, 0) }
+
+// Returns a + b rounded in the direction up selects. s - a recovers the part of b that made it into the
+// sum s, which leaves its rounding error exactly.
+func addRounded(a, b float64, up bool) float64 {
+	s := a + b
+	if math.IsNaN(s) || math.IsInf(s, 0) {
+		return unbounded(s, isFinite(a, b), up)
+	}
+
+	part := s - a
+	return directed(s, (a-(s-part))+(b-part), up)
+}
+
+// Returns a * b rounded in the direction up selects, taking the rounding error from a fused multiply-add.
+// Zero times an infinity is zero, as the bound of an interval rather than a value within it.
+func mulRounded(a, b float64, up bool) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	p := a * b
+	switch {
+	case math.IsNaN(p) || math.IsInf(p, 0):
+		return unbounded(p, isFinite(a, b), up)
+	case math.Abs(p) < minExact:
+		return outward(p, up)
+	}
+	return directed(p, math.FMA(a, b, -p), up)
+}
+
+// Returns a / b rounded in the direction up selects, taking the rounding error from the remainder a - q * b.
+func divRounded(a, b float64, up bool) float64 {
+	q := a / b
+	switch {
+	case math.IsNaN(q) || math.IsInf(q, 0):
+		return unbounded(q, isFinite(a, b), up)
+	case a == 0 || math.IsInf(b, 0):
+		return q
+	case math.Abs(q) < minExact || math.Abs(a) < minExact:
+		return outward(q, up)
+	}
+
+	rem := -math.FMA(q, b, -a)
+	if b < 0 {
+		rem = -rem
+	}
+	return directed(q, rem, up)
+}
+
+// Returns the square root of x, which is not negative, rounded in the direction up selects.
+func sqrtRounded(x float64, up bool) float64 {
+	s := math.Sqrt(x)
+	switch {
+	case x == 0 || math.IsInf(x, 1):
+		return s
+	case x < minExact:
+		return outward(s, up)
+	}
+	return directed(s, math.FMA(-s, s, x), up)
+}
+
+// Returns x ** n for x >= 0 rounded in the direction up selects, by squaring. Every factor is rounded the same
+// way, which bounds the exact power from that side as none of them is negative.
+func powRounded(x float64, n uint64, up bool) float64 {
+	res := 1.0
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			res = mulRounded(res, x, up)
+		}
+		x = mulRounded(x, x, up)
+	}
+	return res
+}
+
+// Returns x ** n for an odd n, rounded in the direction up selects.
+func signedPow(x float64, n uint64, up bool) float64 {
+	if x < 0 {
+		return -powRounded(-x, n, !up)
+	}
+	return powRounded(x, n, up)
+}
+
+// Widens an interval computed by the math package by its error.
+func widen(r interval) interval {
+	for k := 0; k < libraryError; k++ {
+		r.lo, r.hi = nextDown(r.lo), nextUp(r.hi)
+	}
+	return r
+}
+
+// Applies a monotonic function of the math package to an interval, which is non-decreasing unless
+// decreasing is set.
+func monotonic(x interval, decreasing bool, f func(float64) float64) interval {
+	if decreasing {
+		return widen(interval{f(x.hi), f(x.lo)})
+	}
+	return widen(interval{f(x.lo), f(x.hi)})
+}
+
+// Fails when x reaches outside of the domain of the function name, lo to hi.
+func checkDomain(name string, x interval, lo, hi float64) error {
+	if x.lo < lo || x.hi > hi {
+		return newEvalError(ErrInvalidValue, span{}, OUTSIDE_DOMAIN, name, x)
+	}
+	return nil
+}
+
+// Reports whether x may hold offset + 2kπ for some integer k. It errs toward reporting true near the ends
+// of x, which only widens the bounds of the caller.
+func hitsPeriod(x interval, offset float64) bool {
+	lo := (x.lo - offset) / (2 * math.Pi)
+	hi := (x.hi - offset) / (2 * math.Pi)
+	return math.Floor(hi+1e-9) >= math.Ceil(lo-1e-9)
+}
+
+// Bounds SIN or COS, f, over x, taking the values at the ends of x unless it holds one of the maxima at
+// maxAt + 2kπ or the minima at minAt + 2kπ, between which f is monotonic.
+func periodic(x interval, maxAt, minAt float64, f func(float64) float64) interval {
+	if !(x.hi-x.lo < 2*math.Pi) || math.Abs(x.lo) > trigRange || math.Abs(x.hi) > trigRange {
+		return interval{-1, 1}
+	}
+
+	a, b := f(x.lo), f(x.hi)
+	res := widen(interval{math.Min(a, b), math.Max(a, b)})
+	if hitsPeriod(x, maxAt) {
+		res.hi = 1
+	}
+	if hitsPeriod(x, minAt) {
+		res.lo = -1
+	}
+	return interval{math.Max(res.lo, -1), math.Min(res.hi, 1)}
+}
+
+// Bounds TAN over x, which is unbounded when x holds one of its poles at π/2 + kπ.
+func tanInterval(x interval) interval {
+	if !(x.hi-x.lo < math.Pi) || math.Abs(x.lo) > trigRange || math.Abs(x.hi) > trigRange ||
+		hitsPeriod(x, math.Pi/2) || hitsPeriod(x, -math.Pi/2) {
+		return interval{math.Inf(-1), math.Inf(1)}
+	}
+	return monotonic(x, false, math.Tan)
+}
+
+// Bounds the median of intervals, which is non-decreasing in each of them.
+func medianInterval(params []interval) interval {
+	los, his := make([]float64, len(params)), make([]float64, len(params))
+	for ix, p := range params {
+		los[ix], his[ix] = p.lo, p.hi
+	}
+	sort.Float64s(los)
+	sort.Float64s(his)
+
+	mid := len(params) / 2
+	if len(params)%2 == 1 {
+		return interval{los[mid], his[mid]}
+	}
+	lo := divRounded(addRounded(los[mid-1], los[mid], false), 2, false)
+	return interval{lo, divRounded(addRounded(his[mid-1], his[mid], true), 2, true)}
+}
@@ -1,101 +1,230 @@
 package expr
 
-import (
-	"fmt"
-	"strconv"
-)
+import "fmt"
 
 type treeNode interface {
 	Print()
-	Eval() (any, error)
+	Eval(env Resolver) (Value, error)
+	pos() span
 }
 
-type addition struct{ left, right treeNode }
-type subtraction struct{ left, right treeNode }
-type multiplication struct{ left, right treeNode }
-type division struct{ left, right treeNode }
-type negation struct{ arg treeNode }
-type identifer struct{ value any }
-type number struct{ value any }
+// The byte range [start, end) of the input a token or node was parsed from.
+type span struct{ start, end int }
 
-type functionArgs struct {
-	owner string
-	args  []treeNode
+type binary struct {
+	left, right treeNode
+	at          span
 }
 
-type function struct {
+type unary struct {
+	arg treeNode
+	at  span
+}
+
+func (o binary) pos() span { return o.at }
+func (o unary) pos() span  { return o.at }
+
+type addition struct{ binary }
+type subtraction struct{ binary }
+type multiplication struct{ binary }
+type division struct{ binary }
+type negation struct{ unary }
+type equality struct{ binary }
+type inequality struct{ binary }
+type lessThan struct{ binary }
+type lessOrEqual struct{ binary }
+type greaterThan struct{ binary }
+type greaterOrEqual struct{ binary }
+type conjunction struct{ binary }
+type disjunction struct{ binary }
+type logicalNegation struct{ unary }
+type power struct{ binary }
+type modulo struct{ binary }
+type bitAnd struct{ binary }
+type bitOr struct{ binary }
+type bitXor struct{ binary }
+type bitNot struct{ unary }
+type shiftLeft struct{ binary }
+type shiftRight struct{ binary }
+
+type conditional struct {
+	cond, then, otherwise treeNode
+	at                    span
+}
+
+type variable struct {
 	name string
-	args []treeNode
+	at   span
 }
 
-func newAdd(left, right treeNode) *addition            { return &addition{left, right} }
-func newSubtract(left, right treeNode) *subtraction    { return &subtraction{left, right} }
-func newMultiply(left, right treeNode) *multiplication { return &multiplication{left, right} }
-func newDivide(left, right treeNode) *division         { return &division{left, right} }
-func newNegate(arg treeNode) *negation                 { return &negation{arg} }
-func newIdentifer(t *token) *identifer                 { return &identifer{t.lexeme} }
-func newNumber(t *token) *number                       { return &number{t.lexeme} }
-func newFunctionArgs(args []treeNode) *functionArgs    { return &functionArgs{args: args} }
+type number struct {
+	value Value
+	lit   string // the literal as written in the input
+	at    span
+}
 
-func newFunction(fnc string, args []treeNode) *function {
-	return &function{fnc, args}
+type text struct {
+	value string
+	lit   string // the literal as written in the input, quotes included
+	at    span
 }
 
-func (o *addition) Eval() (any, error) {
-	return evalT(func(params ...float64) (any, error) { return params[0] + params[1], nil }, o.left, o.right)
+// An argument list that was not consumed by a function call.
+type functionArgs struct {
+	args []treeNode
+	at   span
 }
 
-func (o *subtraction) Eval() (any, error) {
-	return evalT(func(params ...float64) (any, error) { return params[0] - params[1], nil }, o.left, o.right)
+type function struct {
+	name string
+	fn   *fncDescriptor
+	args []treeNode
+	at   span
 }
 
-func (o *multiplication) Eval() (any, error) {
-	return evalT(func(params ...float64) (any, error) { return params[0] * params[1], nil }, o.left, o.right)
+func newAdd(left, right treeNode, at span) *addition { return &addition{binary{left, right, at}} }
+func newSubtract(left, right treeNode, at span) *subtraction {
+	return &subtraction{binary{left, right, at}}
+}
+func newMultiply(left, right treeNode, at span) *multiplication {
+	return &multiplication{binary{left, right, at}}
+}
+func newDivide(left, right treeNode, at span) *division { return &division{binary{left, right, at}} }
+func newNegate(arg treeNode, at span) *negation         { return &negation{unary{arg, at}} }
+func newEqual(left, right treeNode, at span) *equality  { return &equality{binary{left, right, at}} }
+func newNotEqual(left, right treeNode, at span) *inequality {
+	return &inequality{binary{left, right, at}}
+}
+func newLess(left, right treeNode, at span) *lessThan { return &lessThan{binary{left, right, at}} }
+func newLessEqual(left, right treeNode, at span) *lessOrEqual {
+	return &lessOrEqual{binary{left, right, at}}
 }
+func newGreater(left, right treeNode, at span) *greaterThan {
+	return &greaterThan{binary{left, right, at}}
+}
+func newGreaterEqual(left, right treeNode, at span) *greaterOrEqual {
+	return &greaterOrEqual{binary{left, right, at}}
+}
+func newAnd(left, right treeNode, at span) *conjunction { return &conjunction{binary{left, right, at}} }
+func newOr(left, right treeNode, at span) *disjunction  { return &disjunction{binary{left, right, at}} }
+func newNot(arg treeNode, at span) *logicalNegation     { return &logicalNegation{unary{arg, at}} }
+func newPower(left, right treeNode, at span) *power     { return &power{binary{left, right, at}} }
+func newModulo(left, right treeNode, at span) *modulo   { return &modulo{binary{left, right, at}} }
+func newBitAnd(left, right treeNode, at span) *bitAnd   { return &bitAnd{binary{left, right, at}} }
+func newBitOr(left, right treeNode, at span) *bitOr     { return &bitOr{binary{left, right, at}} }
+func newBitXor(left, right treeNode, at span) *bitXor   { return &bitXor{binary{left, right, at}} }
+func newBitNot(arg treeNode, at span) *bitNot           { return &bitNot{unary{arg, at}} }
+func newShiftLeft(left, right treeNode, at span) *shiftLeft {
+	return &shiftLeft{binary{left, right, at}}
+}
+func newShiftRight(left, right treeNode, at span) *shiftRight {
+	return &shiftRight{binary{left, right, at}}
+}
+func newVariable(t *token) *variable                         { return &variable{t.lexeme.(string), t.at} }
+func newNumber(t *token, lit string) *number                 { return &number{t.lexeme.(Value), lit, t.at} }
+func newText(t *token, lit string) *text                     { return &text{t.lexeme.(string), lit, t.at} }
+func newFunctionArgs(args []treeNode, at span) *functionArgs { return &functionArgs{args, at} }
 
-func (o *division) Eval() (any, error) {
-	return evalT(func(params ...float64) (any, error) {
-		if params[1] == 0 {
-			return nil, SyntaxError{message: DIVIDE_BY_ZERO}
-		}
-		return params[0] / params[1], nil
-	}, o.left, o.right)
+func newFunction(fnc string, fn *fncDescriptor, args []treeNode, at span) *function {
+	return &function{fnc, fn, args, at}
 }
 
-func (o *negation) Eval() (any, error) {
-	return evalT(func(params ...float64) (any, error) { return -params[0], nil }, o.arg)
+func newConditional(cond, then, otherwise treeNode, at span) *conditional {
+	return &conditional{cond, then, otherwise, at}
 }
 
-func (o *identifer) Eval() (any, error) {
-	return evalN(o.value)
+func (o *conditional) pos() span  { return o.at }
+func (o *variable) pos() span     { return o.at }
+func (o *number) pos() span       { return o.at }
+func (o *text) pos() span         { return o.at }
+func (o *functionArgs) pos() span { return o.at }
+func (o *function) pos() span     { return o.at }
+
+func (o *addition) Eval(env Resolver) (Value, error)       { return evalBinary(opAdd, o.binary, env) }
+func (o *subtraction) Eval(env Resolver) (Value, error)    { return evalBinary(opSub, o.binary, env) }
+func (o *multiplication) Eval(env Resolver) (Value, error) { return evalBinary(opMul, o.binary, env) }
+func (o *division) Eval(env Resolver) (Value, error)       { return evalBinary(opDiv, o.binary, env) }
+func (o *modulo) Eval(env Resolver) (Value, error)         { return evalBinary(opMod, o.binary, env) }
+func (o *power) Eval(env Resolver) (Value, error)          { return evalBinary(opPow, o.binary, env) }
+func (o *equality) Eval(env Resolver) (Value, error)       { return evalBinary(opEq, o.binary, env) }
+func (o *inequality) Eval(env Resolver) (Value, error)     { return evalBinary(opNeq, o.binary, env) }
+func (o *lessThan) Eval(env Resolver) (Value, error)       { return evalBinary(opLt, o.binary, env) }
+func (o *lessOrEqual) Eval(env Resolver) (Value, error)    { return evalBinary(opLte, o.binary, env) }
+func (o *greaterThan) Eval(env Resolver) (Value, error)    { return evalBinary(opGt, o.binary, env) }
+func (o *greaterOrEqual) Eval(env Resolver) (Value, error) { return evalBinary(opGte, o.binary, env) }
+func (o *bitAnd) Eval(env Resolver) (Value, error)         { return evalBinary(opBitAnd, o.binary, env) }
+func (o *bitOr) Eval(env Resolver) (Value, error)          { return evalBinary(opBitOr, o.binary, env) }
+func (o *bitXor) Eval(env Resolver) (Value, error)         { return evalBinary(opBitXor, o.binary, env) }
+func (o *shiftLeft) Eval(env Resolver) (Value, error)      { return evalBinary(opShl, o.binary, env) }
+func (o *shiftRight) Eval(env Resolver) (Value, error)     { return evalBinary(opShr, o.binary, env) }
+
+func (o *negation) Eval(env Resolver) (Value, error)        { return evalUnary(opNeg, o.unary, env) }
+func (o *logicalNegation) Eval(env Resolver) (Value, error) { return evalUnary(opNot, o.unary, env) }
+func (o *bitNot) Eval(env Resolver) (Value, error)          { return evalUnary(opBitNot, o.unary, env) }
+
+// The right operand is only evaluated when the left one is true.
+func (o *conjunction) Eval(env Resolver) (Value, error) {
+	left, err := evalB(o.left, env)
+	if err != nil || !left {
+		return BoolValue(left), err
+	}
+
+	right, err := evalB(o.right, env)
+	return BoolValue(right), err
 }
 
-func (o *number) Eval() (any, error) {
-	return evalN(o.value)
+// The right operand is only evaluated when the left one is false.
+func (o *disjunction) Eval(env Resolver) (Value, error) {
+	left, err := evalB(o.left, env)
+	if err != nil || left {
+		return BoolValue(left), err
+	}
+
+	right, err := evalB(o.right, env)
+	return BoolValue(right), err
 }
 
-func (o *function) Eval() (any, error) {
-	fn, ok := funcTable[o.name]
-	if !ok {
-		return nil, SyntaxError{message: fmt.Sprintf(EXPECTED_FNC_NAME, o.name)}
+// Only the branch selected by the condition is evaluated.
+func (o *conditional) Eval(env Resolver) (Value, error) {
+	cond, err := evalB(o.cond, env)
+	if err != nil {
+		return Value{}, err
 	}
 
-	if len(o.args) != fn.args {
-		return nil, SyntaxError{message: fmt.Sprintf(INVALID_FNC_ARG_COUNT, fn.args, len(o.args))}
+	if cond {
+		return evalNode(o.then, env)
 	}
-	return fn.invoke(o.args)
+	return evalNode(o.otherwise, env)
 }
 
-func (o *functionArgs) Eval() (any, error) {
-	fn, ok := funcTable[o.owner]
-	if !ok {
-		return nil, SyntaxError{message: fmt.Sprintf(EXPECTED_FNC_NAME, o.owner)}
+func (o *variable) Eval(env Resolver) (Value, error) {
+	if env != nil {
+		if value, ok := resolve(env, o.name); ok {
+			return value, nil
+		}
 	}
+	return Value{}, newEvalError(ErrUndefinedVariable, o.at, UNDEFINED_VARIABLE, o.name)
+}
+
+func (o *number) Eval(env Resolver) (Value, error) {
+	return o.value, nil
+}
+
+func (o *text) Eval(env Resolver) (Value, error) {
+	return StringValue(o.value), nil
+}
 
-	if len(o.args) != fn.args {
-		return nil, SyntaxError{message: fmt.Sprintf(INVALID_FNC_ARG_COUNT, fn.args, len(o.args))}
+// The argument count was validated when the call was parsed.
+func (o *function) Eval(env Resolver) (Value, error) {
+	res, err := o.fn.call(o.args, env)
+	if err != nil {
+		return Value{}, locate(err, o.at)
 	}
-	return fn.invoke(o.args)
+	return res, nil
+}
+
+func (o *functionArgs) Eval(env Resolver) (Value, error) {
+	return Value{}, newSyntaxError(ErrUnexpectedTerm, o.at, UNEXPECTED_TERM_CONNECTED_BY, ",")
 }
 
 func (o *addition) Print() {
@@ -134,16 +263,66 @@ func (o *negation) Print() {
 	fmt.Printf("(")
 	fmt.Printf("-")
 	o.arg.Print()
+	fmt.Printf(")")
 }
 
-func (o *identifer) Print() {
-	fmt.Printf("%v", o.value)
+func (o *equality) Print()       { printBinary(o.left, "==", o.right) }
+func (o *inequality) Print()     { printBinary(o.left, "!=", o.right) }
+func (o *lessThan) Print()       { printBinary(o.left, "<", o.right) }
+func (o *lessOrEqual) Print()    { printBinary(o.left, "<=", o.right) }
+func (o *greaterThan) Print()    { printBinary(o.left, ">", o.right) }
+func (o *greaterOrEqual) Print() { printBinary(o.left, ">=", o.right) }
+func (o *conjunction) Print()    { printBinary(o.left, "&&", o.right) }
+func (o *disjunction) Print()    { printBinary(o.left, "||", o.right) }
+
+func (o *power) Print()      { printBinary(o.left, "**", o.right) }
+func (o *modulo) Print()     { printBinary(o.left, "%", o.right) }
+func (o *bitAnd) Print()     { printBinary(o.left, "&", o.right) }
+func (o *bitOr) Print()      { printBinary(o.left, "|", o.right) }
+func (o *bitXor) Print()     { printBinary(o.left, "^", o.right) }
+func (o *shiftLeft) Print()  { printBinary(o.left, "<<", o.right) }
+func (o *shiftRight) Print() { printBinary(o.left, ">>", o.right) }
+
+func (o *conditional) Print() {
+	fmt.Printf("(")
+	o.cond.Print()
+	fmt.Printf("?")
+	o.then.Print()
+	fmt.Printf(":")
+	o.otherwise.Print()
+	fmt.Printf(")")
+}
+
+func (o *bitNot) Print() {
+	fmt.Printf("~")
+	o.arg.Print()
+}
+
+func (o *logicalNegation) Print() {
+	fmt.Printf("!")
+	o.arg.Print()
+}
+
+func printBinary(left treeNode, op string, right treeNode) {
+	fmt.Printf("(")
+	left.Print()
+	fmt.Printf("%v", op)
+	right.Print()
+	fmt.Printf(")")
+}
+
+func (o *variable) Print() {
+	fmt.Printf("%v", o.name)
 }
 
 func (o *number) Print() {
 	fmt.Printf("%v", o.value)
 }
 
+func (o *text) Print() {
+	fmt.Printf("%v", o.lit)
+}
+
 func (o *functionArgs) Print() {
 	for ix, arg := range o.args {
 		arg.Print()
@@ -165,46 +344,46 @@ func (o *function) Print() {
 	fmt.Printf(")")
 }
 
-func evalT(fn func(params ...float64) (any, error), nodes ...treeNode) (any, error) {
-	var ct any
-	var cv float64
-	var err error
-	var args []float64
-
-	for _, curr := range nodes {
+// Evaluates a node, surfacing any SyntaxError the parser left in the tree.
+func evalNode(node treeNode, env Resolver) (Value, error) {
+	if err, ok := node.(SyntaxError); ok {
+		return Value{}, err
+	}
+	return node.Eval(env)
+}
 
-		if err, ok := curr.(SyntaxError); ok {
-			return nil, err
-		}
+// Evaluates a node for its truth value; any non-zero number is true.
+func evalB(node treeNode, env Resolver) (bool, error) {
+	res, err := evalNode(node, env)
+	if err != nil {
+		return false, err
+	}
 
-		ct, err = curr.Eval()
-		if err != nil {
-			return nil, err
-		}
+	truth, err := res.truth()
+	return truth, locate(err, node.pos())
+}
 
-		cv, err = evalN(ct)
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, cv)
+func evalUnary(op opcode, o unary, env Resolver) (Value, error) {
+	x, err := evalNode(o.arg, env)
+	if err != nil {
+		return Value{}, err
 	}
-	return fn(args...)
-}
 
-func evalN(value any) (float64, error) {
-	switch v := value.(type) {
-	case string:
-		num, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			return 0, err
-		}
-		return num, nil
+	res, err := unaryOp(op, x)
+	return res, locate(err, o.at)
+}
 
-	case int:
-		return float64(v), nil
+func evalBinary(op opcode, o binary, env Resolver) (Value, error) {
+	x, err := evalNode(o.left, env)
+	if err != nil {
+		return Value{}, err
+	}
 
-	case float64:
-		return v, nil
+	y, err := evalNode(o.right, env)
+	if err != nil {
+		return Value{}, err
 	}
-	return 0, SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_AT, value)}
+
+	res, err := binaryOp(op, x, y)
+	return res, locate(err, o.at)
 }
@@ -0,0 +1,193 @@
+package expr
+
+import (
+	"math"
+
+	"github.com/js10x/expr-evaluator/expr/ast"
+)
+
+// Tokenizes, parses and optimizes the input, returning a Program whose String method shows what it reduced to.
+func (p *Parser) CompileOptimized(input string) (*Program, error) {
+
+	node, err := p.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := p.fromAST(p.Optimize(node))
+	if err != nil {
+		return nil, withLineCol(err, input)
+	}
+	return p.newProgram(tree, input), nil
+}
+
+// Returns a copy of the tree with constant subtrees folded into numbers, conditionals with a constant
+// condition replaced by the selected branch, and identities such as x * 1, x + 0 and - -x removed where x
+// is a number. Variables are taken to hold numbers, except in unit, complex and interval mode. Calls are only folded when their function is pure. Subtrees that fail to
+// evaluate, such as 1 / 0, are kept so that the error is still reported, at the same position, when the
+// program is evaluated.
+func (p *Parser) Optimize(node ast.Node) ast.Node {
+	return ast.Rewrite(node, func(node ast.Node) ast.Node {
+		if folded, ok := p.fold(node); ok {
+			return folded
+		}
+		return p.simplify(node)
+	})
+}
+
+// Folds a constant node into a number. Bools are left unfolded, as there is no literal for them, but
+// still select the branch of a conditional. The operands were already folded, bottom up.
+func (p *Parser) fold(node ast.Node) (ast.Node, bool) {
+	if n, ok := node.(*ast.CondExpr); ok {
+		res, ok := p.constant(n.Cond)
+		if !ok {
+			return nil, false
+		}
+
+		cond, err := res.truth()
+		if err != nil {
+			return nil, false
+		}
+
+		if cond {
+			return n.Then, true
+		}
+		return n.Else, true
+	}
+
+	switch node.(type) {
+	case *ast.Number, *ast.StringLit:
+		return nil, false
+	}
+
+	// Complex numbers with an imaginary part have no single literal either, quantities are left as they
+	// are written, and intervals have no literal at all
+	res, ok := p.constant(node)
+	if !ok || res.kind == Bool || res.kind == Quantity || res.kind == Interval || res.kind != String && (math.IsNaN(res.Float()) || math.IsInf(res.Float(), 0)) {
+		return nil, false
+	}
+
+	at := ast.Span{Start: node.Pos(), Stop: node.End()}
+	if res.kind == String {
+		return &ast.StringLit{Span: at, Value: res.s, Lit: res.literal()}, true
+	}
+	return &ast.Number{Span: at, Value: res.Float(), Lit: res.literal()}, true
+}
+
+// Evaluates a node built only from numbers, operators and calls to pure functions.
+func (p *Parser) constant(node ast.Node) (Value, bool) {
+	if !p.isConst(node) {
+		return Value{}, false
+	}
+
+	prog, err := p.CompileNode(node)
+	if err != nil {
+		return Value{}, false
+	}
+
+	res, err := prog.EvalValue(nil)
+	return res, err == nil
+}
+
+func (p *Parser) isConst(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.Number, *ast.StringLit:
+		return true
+	case *ast.UnaryExpr:
+		return p.isConst(n.X)
+	case *ast.BinaryExpr:
+		return p.isConst(n.X) && p.isConst(n.Y)
+	case *ast.CallExpr:
+		if desc, ok := p.lookupFunc(n.Func); !ok || desc.impure {
+			return false
+		}
+
+		for _, arg := range n.Args {
+			if !p.isConst(arg) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Removes operations that leave their operand unchanged, when that operand is a number. Dividing by or
+// raising to 1 is only removed from operands without variables, as an int variable divided by 1 is a
+// float, and a decimal one is rounded.
+func (p *Parser) simplify(node ast.Node) ast.Node {
+	switch n := node.(type) {
+	case *ast.UnaryExpr:
+		if inner, ok := n.X.(*ast.UnaryExpr); ok && n.Op == ast.Neg && inner.Op == ast.Neg && p.isNumeric(inner.X) {
+			return inner.X
+		}
+
+	case *ast.BinaryExpr:
+		switch {
+		case n.Op == ast.Add && isValue(n.X, 0) && p.isNumeric(n.Y):
+			return n.Y
+		case (n.Op == ast.Add || n.Op == ast.Sub) && isValue(n.Y, 0) && p.isNumeric(n.X):
+			return n.X
+		case n.Op == ast.Mul && isValue(n.X, 1) && p.isNumeric(n.Y):
+			return n.Y
+		case n.Op == ast.Mul && isValue(n.Y, 1) && p.isNumeric(n.X):
+			return n.X
+		case (n.Op == ast.Div || n.Op == ast.Pow) && isValue(n.Y, 1) && p.isNumeric(n.X) && !hasVariable(n.X):
+			return n.X
+		}
+	}
+	return node
+}
+
+// Reports whether the node, when it evaluates, is a number without a unit: a number literal, a variable,
+// the result of arithmetic on such numbers, or of a call to a registered function, which returns floats.
+// In unit mode a variable may hold a quantity, and in complex and interval mode x * 1 may round, so
+// variables are only numbers for these identities in float, decimal and integer mode.
+func (p *Parser) isNumeric(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.Number:
+		_, ok := parseNumber(n.Lit) // quantities and imaginary numbers have literals of their own
+		return ok
+	case *ast.Ident:
+		return !p.units && !p.complex && !p.interval
+	case *ast.UnaryExpr:
+		return n.Op == ast.Neg && p.isNumeric(n.X)
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case ast.Add, ast.Sub, ast.Mul, ast.Div, ast.Mod, ast.Pow:
+			return p.isNumeric(n.X) && p.isNumeric(n.Y)
+		}
+	case *ast.CallExpr:
+		desc, ok := p.lookupFunc(n.Func)
+		return ok && desc != funcTable[n.Func]
+	}
+	return false
+}
+
+// Reports whether the node reads a variable outside the arguments of a call, whose result does not
+// take its kind from them.
+func hasVariable(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.Ident:
+			found = true
+		case *ast.CallExpr:
+			return false
+		}
+		return !found
+	})
+	return found
+}
+
+// Reports whether the node is the int literal value. Float identities such as x * 1.0 are kept, as they
+// turn an int x into a float.
+func isValue(node ast.Node, value int64) bool {
+	num, ok := node.(*ast.Number)
+	if !ok {
+		return false
+	}
+
+	lit, ok := parseNumber(num.Lit)
+	return ok && lit == IntValue(value)
+}
@@ -1,78 +1,365 @@
 package expr
 
-import "fmt"
+import "sync"
 
+// Parser is safe for concurrent use; each call to Compile borrows its own scanner.
 type Parser struct {
-	scn *scanner
+	scanners sync.Pool
+	mu       sync.RWMutex
+	funcs    map[string]*fncDescriptor // functions registered on this parser only
+	decimal  *decimalContext           // set when numbers are evaluated as decimals
+	integer  *integerContext           // set when integers are evaluated as big integers
+	complex  bool                      // set when numbers are evaluated as complex numbers
+	units    bool                      // set when number literals may carry a unit
+	interval bool                      // set when numbers are evaluated as intervals
 }
 
-func NewParser() *Parser {
-	return &Parser{scn: newScanner()}
+// ParserOption configures a Parser when it is created. DecimalMode, IntegerMode, ComplexMode, UnitMode and
+// IntervalMode select how numbers are evaluated and are mutually exclusive: each replaces any mode given
+// before it, so only the last one takes effect.
+type ParserOption func(*Parser)
+
+// Clears the number mode selected by an earlier option.
+func (p *Parser) resetMode() {
+	p.decimal, p.integer, p.complex, p.units, p.interval = nil, nil, false, false, false
+}
+
+func NewParser(opts ...ParserOption) *Parser {
+	p := &Parser{
+		scanners: sync.Pool{New: func() any { return newScanner() }},
+		funcs:    map[string]*fncDescriptor{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 func (p *Parser) EvalV(input string, variable any) (float64, error) {
 
-	defer p.scn.reset()
+	prog, err := p.Compile(input)
+	if err != nil {
+		return 0, err
+	}
+	return prog.EvalV(variable)
+}
 
-	err := tokenize(input, p.scn, variable)
+func (p *Parser) Eval(input string) (float64, error) {
+
+	prog, err := p.Compile(input)
 	if err != nil {
 		return 0, err
 	}
+	return prog.Eval(nil)
+}
+
+// Evaluates the input, resolving any named variables through env.
+func (p *Parser) EvalEnv(input string, env Resolver) (float64, error) {
 
-	res, err := parse(p.scn)
+	prog, err := p.Compile(input)
 	if err != nil {
 		return 0, err
 	}
-	return res, nil
+	return prog.Eval(env)
 }
 
-func (p *Parser) Eval(input string) (float64, error) {
+// Evaluates the input like EvalEnv, but returns the result with its kind.
+func (p *Parser) EvalValue(input string, env Resolver) (Value, error) {
+
+	prog, err := p.Compile(input)
+	if err != nil {
+		return Value{}, err
+	}
+	return prog.EvalValue(env)
+}
 
-	defer p.scn.reset()
+// Tokenizes and parses the input once, returning a Program that can be evaluated repeatedly.
+func (p *Parser) Compile(input string) (*Program, error) {
 
-	err := tokenize(input, p.scn, nil)
+	scn := p.scanners.Get().(*scanner)
+	scn.funcs, scn.decimal, scn.integer, scn.complex, scn.units = p.lookupFunc, p.decimal, p.integer, p.complex, p.units
+	scn.interval = p.interval
+	defer func() {
+		scn.reset()
+		p.scanners.Put(scn)
+	}()
+
+	err := tokenize(input, scn)
 	if err != nil {
-		return 0, err
+		return nil, withLineCol(p.withHint(err, input), input)
 	}
 
-	res, err := parse(p.scn)
+	ast, err := parse(scn)
 	if err != nil {
-		return 0, err
+		return nil, withLineCol(p.withHint(err, input), input)
 	}
-	return res, nil
+	return p.newProgram(ast, input), nil
 }
 
-func parse(sc *scanner) (float64, error) {
+// Finds a function registered on this parser, falling back to the builtins.
+func (p *Parser) lookupFunc(name string) (*fncDescriptor, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	ast := parseE(sc)
-	if ast == nil {
-		return 0, SyntaxError{message: INVALID_EXPR_GENERAL}
+	if fn, ok := p.funcs[name]; ok {
+		return fn, true
 	}
 
+	fn, ok := funcTable[name]
+	return fn, ok
+}
+
+func parse(sc *scanner) (treeNode, error) {
+
+	ast := parseE(sc)
 	if err, ok := ast.(SyntaxError); ok {
-		return 0, err
+		return nil, err
 	}
 
-	evaluated, err := ast.Eval()
-	if err != nil {
-		return 0, err
+	if next := sc.peek(); next != nil {
+		return nil, newSyntaxError(ErrUnexpectedTerm, next.at, UNEXPECTED_TERM_AT, next)
 	}
 
-	res, ok := evaluated.(float64)
-	if !ok {
-		return 0, SyntaxError{message: INVALID_EXPR_GENERAL}
+	if ast == nil {
+		return nil, newSyntaxError(ErrInvalidExpr, span{0, sc.end}, INVALID_EXPR_GENERAL)
+	}
+
+	if args, ok := ast.(*functionArgs); ok {
+		return nil, newSyntaxError(ErrUnexpectedTerm, args.at, UNEXPECTED_TERM_CONNECTED_BY, ",")
 	}
-	return res, nil
+	return ast, nil
 }
 
-// Expression: E -> T { +|-|, T}
+// Expression: E -> C {, C}
 func parseE(sc *scanner) treeNode {
 
-	var lookahead *token
 	var nA, nB treeNode
+	var op *token
 	var args []treeNode
+	start := sc.here().start
 
-	nA = parseT(sc)
+	nA = parseC(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != comma {
+			if len(args) > 0 {
+				return newFunctionArgs(append(args, nA), sc.from(start))
+			}
+			return nA
+		}
+
+		op = sc.next() // scan past ','
+		nB = parseC(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, ",")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+
+		args = append(args, nA)
+		nA = nB
+	}
+}
+
+// Conditional: C -> O [? C : C]
+func parseC(sc *scanner) treeNode {
+
+	var nA, nB, nC treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseO(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	if sc.peek() == nil || sc.peek().typeof != question {
+		return nA
+	}
+
+	op = sc.next() // scan past '?'
+	nB = parseC(sc)
+	if nA == nil || nB == nil {
+		return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "?")
+	}
+
+	if err, ok := nB.(SyntaxError); ok {
+		return err
+	}
+
+	if sc.peek() == nil || sc.peek().typeof != colon {
+		return newSyntaxError(ErrUnexpectedEnd, sc.here(), UNEXPECTED_END_OF_EXPR, ":")
+	}
+
+	op = sc.next() // scan past ':'
+	nC = parseC(sc)
+	if nC == nil {
+		return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, ":")
+	}
+
+	if err, ok := nC.(SyntaxError); ok {
+		return err
+	}
+	return newConditional(nA, nB, nC, sc.from(start))
+}
+
+// Or: O -> A { || A}
+func parseO(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseA(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != lor {
+			return nA
+		}
+
+		op = sc.next() // scan past '||'
+		nB = parseA(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "||")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+		nA = newOr(nA, nB, sc.from(start))
+	}
+}
+
+// And: A -> I { && I}
+func parseA(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseI(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != land {
+			return nA
+		}
+
+		op = sc.next() // scan past '&&'
+		nB = parseI(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "&&")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+		nA = newAnd(nA, nB, sc.from(start))
+	}
+}
+
+// Bitwise OR: I -> X { | X}
+func parseI(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseX(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != bor {
+			return nA
+		}
+
+		op = sc.next() // scan past '|'
+		nB = parseX(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "|")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+		nA = newBitOr(nA, nB, sc.from(start))
+	}
+}
+
+// Bitwise XOR: X -> N { ^ N}
+func parseX(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseN(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != bxor {
+			return nA
+		}
+
+		op = sc.next() // scan past '^'
+		nB = parseN(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "^")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+		nA = newBitXor(nA, nB, sc.from(start))
+	}
+}
+
+// Bitwise AND: N -> Q { & Q}
+func parseN(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseQ(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil || sc.peek().typeof != band {
+			return nA
+		}
+
+		op = sc.next() // scan past '&'
+		nB = parseQ(sc)
+		if nA == nil || nB == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "&")
+		}
+
+		if err, ok := nB.(SyntaxError); ok {
+			return err
+		}
+		nA = newBitAnd(nA, nB, sc.from(start))
+	}
+}
+
+// Equality: Q -> R { ==|!= R}
+func parseQ(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseR(sc)
 	if err, ok := nA.(SyntaxError); ok {
 		return err
 	}
@@ -83,70 +370,207 @@ func parseE(sc *scanner) treeNode {
 		}
 
 		switch sc.peek().typeof {
-		case add:
-			sc.next() // scan past '+'
-			nB = parseT(sc)
+		case eq:
+			op = sc.next() // scan past '=='
+			nB = parseR(sc)
 			if nA == nil || nB == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, '+')}
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "==")
 			}
 
-			nA = newAdd(nA, nB)
-			if len(args) > 0 {
-				lookahead = sc.peek()
-				if lookahead == nil || lookahead.typeof == rparen {
-					args = append(args, nA)
-					nA = newFunctionArgs(args)
-				}
+			if err, ok := nB.(SyntaxError); ok {
+				return err
 			}
+			nA = newEqual(nA, nB, sc.from(start))
 
-		case subtract:
-			sc.next() // scan past '-'
-			nB = parseT(sc)
+		case neq:
+			op = sc.next() // scan past '!='
+			nB = parseR(sc)
 			if nA == nil || nB == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, '-')}
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "!=")
 			}
 
-			nA = newSubtract(nA, nB)
-			if len(args) > 0 {
-				lookahead = sc.peek()
-				if lookahead == nil || lookahead.typeof == rparen {
-					args = append(args, nA)
-					nA = newFunctionArgs(args)
-				}
+			if err, ok := nB.(SyntaxError); ok {
+				return err
 			}
+			nA = newNotEqual(nA, nB, sc.from(start))
 
-		case comma:
-			sc.next() // scan past ','
-			if nA == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, ',')}
+		default:
+			return nA
+		}
+	}
+}
+
+// Relational: R -> H { <|<=|>|>= H}
+func parseR(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseH(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil {
+			return nA
+		}
+
+		switch sc.peek().typeof {
+		case lt:
+			op = sc.next() // scan past '<'
+			nB = parseH(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "<")
 			}
 
-			args = append(args, nA)
-			nA = parseT(sc)
-			if nA == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, ',')}
+			if err, ok := nB.(SyntaxError); ok {
+				return err
 			}
+			nA = newLess(nA, nB, sc.from(start))
 
-			lookahead = sc.peek()
-			if lookahead == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, ',')}
+		case lte:
+			op = sc.next() // scan past '<='
+			nB = parseH(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "<=")
 			}
 
-			if lookahead.typeof == rparen {
-				args = append(args, nA)
-				nA = newFunctionArgs(args)
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newLessEqual(nA, nB, sc.from(start))
+
+		case gt:
+			op = sc.next() // scan past '>'
+			nB = parseH(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, ">")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newGreater(nA, nB, sc.from(start))
+
+		case gte:
+			op = sc.next() // scan past '>='
+			nB = parseH(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, ">=")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newGreaterEqual(nA, nB, sc.from(start))
+
+		default:
+			return nA
+		}
+	}
+}
+
+// Shift: H -> S { <<|>> S}
+func parseH(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseS(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil {
+			return nA
+		}
+
+		switch sc.peek().typeof {
+		case shl:
+			op = sc.next() // scan past '<<'
+			nB = parseS(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "<<")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newShiftLeft(nA, nB, sc.from(start))
+
+		case shr:
+			op = sc.next() // scan past '>>'
+			nB = parseS(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, ">>")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newShiftRight(nA, nB, sc.from(start))
+
+		default:
+			return nA
+		}
+	}
+}
+
+// Sum: S -> T { +|- T}
+func parseS(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseT(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	for {
+		if sc.peek() == nil {
+			return nA
+		}
+
+		switch sc.peek().typeof {
+		case add:
+			op = sc.next() // scan past '+'
+			nB = parseT(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "+")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newAdd(nA, nB, sc.from(start))
+
+		case subtract:
+			op = sc.next() // scan past '-'
+			nB = parseT(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "-")
 			}
 
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newSubtract(nA, nB, sc.from(start))
+
 		default:
 			return nA
 		}
 	}
 }
 
-// Term: T -> F { *|/ F}
+// Term: T -> F { *|/|% F}
 func parseT(sc *scanner) treeNode {
 
 	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
 	nA = parseF(sc)
 	if err, ok := nA.(SyntaxError); ok {
 		return err
@@ -159,20 +583,40 @@ func parseT(sc *scanner) treeNode {
 
 		switch sc.peek().typeof {
 		case multiply:
-			sc.next() // scan past '*'
+			op = sc.next() // scan past '*'
 			nB = parseF(sc)
 			if nA == nil || nB == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, '*')}
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "*")
 			}
-			nA = newMultiply(nA, nB)
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newMultiply(nA, nB, sc.from(start))
 
 		case divide:
-			sc.next() // scan past '/'
+			op = sc.next() // scan past '/'
+			nB = parseF(sc)
+			if nA == nil || nB == nil {
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "/")
+			}
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newDivide(nA, nB, sc.from(start))
+
+		case mod:
+			op = sc.next() // scan past '%'
 			nB = parseF(sc)
 			if nA == nil || nB == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_CONNECTED_BY, '/')}
+				return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "%")
 			}
-			nA = newDivide(nA, nB)
+
+			if err, ok := nB.(SyntaxError); ok {
+				return err
+			}
+			nA = newModulo(nA, nB, sc.from(start))
 
 		default:
 			return nA
@@ -180,13 +624,95 @@ func parseT(sc *scanner) treeNode {
 	}
 }
 
-// Factor: F -> VAR | NUM | (E) | -F | FNC
+// Factor: F -> -F | !F | ~F | P
 func parseF(sc *scanner) treeNode {
 
-	var next, lookahead *token
+	var nA treeNode
+	var op *token
+	if sc.peek() == nil {
+		return nA
+	}
+
+	switch sc.peek().typeof {
+
+	case subtract:
+		op = sc.next() // scan past the '-'
+		nA = parseF(sc)
+		if nA == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_AFTER, "-")
+		}
+
+		if err, ok := nA.(SyntaxError); ok {
+			return err
+		}
+		return newNegate(nA, sc.from(op.at.start))
+
+	case lnot:
+		op = sc.next() // scan past the '!'
+		nA = parseF(sc)
+		if nA == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_AFTER, "!")
+		}
+
+		if err, ok := nA.(SyntaxError); ok {
+			return err
+		}
+		return newNot(nA, sc.from(op.at.start))
+
+	case bnot:
+		op = sc.next() // scan past the '~'
+		nA = parseF(sc)
+		if nA == nil {
+			return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_AFTER, "~")
+		}
+
+		if err, ok := nA.(SyntaxError); ok {
+			return err
+		}
+		return newBitNot(nA, sc.from(op.at.start))
+
+	default:
+		return parseP(sc)
+	}
+}
+
+// Power: P -> B [** F]
+func parseP(sc *scanner) treeNode {
+
+	var nA, nB treeNode
+	var op *token
+	start := sc.here().start
+	nA = parseB(sc)
+	if err, ok := nA.(SyntaxError); ok {
+		return err
+	}
+
+	if sc.peek() == nil || sc.peek().typeof != pow {
+		return nA
+	}
+
+	// Right associative, and the exponent may itself be negated: 2 ** -1 ** 2
+	op = sc.next() // scan past '**'
+	nB = parseF(sc)
+	if nA == nil || nB == nil {
+		return newSyntaxError(ErrUnexpectedTerm, op.at, UNEXPECTED_TERM_CONNECTED_BY, "**")
+	}
+
+	if err, ok := nB.(SyntaxError); ok {
+		return err
+	}
+	return newPower(nA, nB, sc.from(start))
+}
+
+// Base: B -> VAR | NUM | (E) | FNC
+func parseB(sc *scanner) treeNode {
+
+	var next, lookahead, open *token
 	var nA treeNode
 	var ok bool
 	var fn string
+	var desc *fncDescriptor
+	var args []treeNode
 
 	for {
 		if sc.peek() == nil {
@@ -195,90 +721,87 @@ func parseF(sc *scanner) treeNode {
 
 		switch sc.peek().typeof {
 
-		case id:
-			nA = newIdentifer(sc.next())
+		case named:
+			nA = newVariable(sc.next())
 			return nA
 
 		case num:
-			nA = newNumber(sc.next())
+			next = sc.next()
+			nA = newNumber(next, sc.text(next))
+			return nA
+
+		case str:
+			next = sc.next()
+			nA = newText(next, sc.text(next))
 			return nA
 
 		case lparen:
-			sc.next() // scan past the '('
+			open = sc.next() // scan past the '('
 			nA = parseE(sc)
 			if nA == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_AFTER, '(')}
+				return newSyntaxError(ErrUnexpectedTerm, open.at, UNEXPECTED_TERM_AFTER, "(")
+			}
+
+			switch node := nA.(type) {
+			case SyntaxError:
+				return node
+			case *functionArgs:
+				return newSyntaxError(ErrUnexpectedTerm, node.at, UNEXPECTED_TERM_CONNECTED_BY, ",")
 			}
 
 			lookahead = sc.peek()
 			if lookahead == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_AFTER, '(')}
+				return newSyntaxError(ErrUnexpectedEnd, sc.here(), UNEXPECTED_END_OF_EXPR, ")")
 			}
 
 			if lookahead.typeof == rparen {
 				sc.next() // scan past the ')'
 				return nA
 			} else {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_END_OF_EXPR, ')')}
+				return newSyntaxError(ErrUnexpectedEnd, lookahead.at, UNEXPECTED_END_OF_EXPR, ")")
 			}
 
-		case subtract:
-			sc.next() // scan past the '-'
-			nA = parseF(sc)
-			if nA == nil {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_TERM_AFTER, '-')}
-			}
-			nA = newNegate(nA)
-			return nA
-
 		case fnc:
 			next = sc.next() // scan past the 'function name'
 			if fn, ok = next.lexeme.(string); !ok {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_END_OF_EXPR, "function")}
+				return newSyntaxError(ErrUnexpectedEnd, next.at, UNEXPECTED_END_OF_EXPR, "function")
 			}
 
-			next = sc.next() // scan past the '('
-			if next == nil || next.typeof != lparen {
-				return SyntaxError{message: INVALID_FNC_DECL}
+			if desc, ok = sc.funcs(fn); !ok {
+				return newSyntaxError(ErrUnknownFunction, next.at, EXPECTED_FNC_NAME, fn)
+			}
+
+			open = sc.next() // scan past the '('
+			if open == nil || open.typeof != lparen {
+				return newSyntaxError(ErrInvalidFuncArgs, next.at, INVALID_FNC_DECL)
 			}
 
 			nA = parseE(sc)
 
 			switch node := nA.(type) {
 
-			case *function:
-				nA = newFunction(fn, []treeNode{node})
-
 			case *functionArgs:
-				node.owner = fn
-				nA = newFunction(fn, node.args)
-
-			case *number:
-				nA = newFunction(fn, []treeNode{node})
-
-			case *identifer:
-				nA = newFunction(fn, []treeNode{node})
+				args = node.args
 
-			case *addition:
-				nA = newFunction(fn, []treeNode{node})
+			case SyntaxError:
+				return node
 
-			case *subtraction:
-				nA = newFunction(fn, []treeNode{node})
-
-			case *multiplication:
-				nA = newFunction(fn, []treeNode{node})
-
-			case *division:
-				nA = newFunction(fn, []treeNode{node})
+			case nil:
+				args = nil // checked against the arity below, once past the ')'
 
 			default:
-				return SyntaxError{message: fmt.Sprintf(INVALID_FNC_ARGS_FOR, fn)}
+				args = []treeNode{node}
 			}
 
-			next = sc.next()
-			if next == nil || next.typeof != rparen {
-				return SyntaxError{message: fmt.Sprintf(INVALID_FNC_DECL_FOR, fn)}
+			lookahead = sc.next()
+			if lookahead == nil || lookahead.typeof != rparen {
+				return newSyntaxError(ErrInvalidFuncArgs, sc.from(next.at.start), INVALID_FNC_DECL_FOR, fn)
+			}
+
+			if !desc.accepts(len(args)) {
+				return newSyntaxError(ErrArgCount, sc.from(next.at.start), INVALID_FNC_ARG_COUNT, desc.arity(), fn, len(args))
 			}
+			return newFunction(fn, desc, args, sc.from(next.at.start))
 
 		default:
 			return nA
@@ -1,9 +1,17 @@
 package expr_test
 
 import (
+	"errors"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/js10x/expr-evaluator/expr"
+	"github.com/js10x/expr-evaluator/expr/ast"
 )
 
 const (
@@ -15,8 +23,19 @@ func TestEval(t *testing.T) {
 	tests := []struct {
 		input  string
 		expect float64
+		err    error
 	}{
 		{input: "2 + 3 * 4", expect: 14},
+		{input: "1e-3", expect: 0.001},
+		{input: "2.5E2 + 1e+1", expect: 260},
+		{input: "0x1F", expect: 31},
+		{input: "0XfF - 0b1010", expect: 245},
+		{input: "0o17 + 0B11", expect: 18},
+		{input: "1_000_000 / 1_000", expect: 1000},
+		{input: "0x_FF_FF", expect: 65535},
+		{input: ".5 + 5.", expect: 5.5},
+		{input: "-.25 * 4", expect: -1},
+		{input: "017", expect: 17},
 		{input: "2 + 3 / 4", expect: 2.75},
 		{input: "3 / 3", expect: 1},
 		{input: "-(7 + 5) * 2", expect: -24},
@@ -66,9 +85,72 @@ func TestEval(t *testing.T) {
 		{input: "NOT(1)", expect: 0},
 		{input: "BAND(5,-(CEIL(CEIL(CEIL(1.5)))))", expect: 4},
 		{input: "BAND(5,-(CEIL(SQR(SHL(5, 2))))) * -(5 + 1) * 1", expect: -6},
-		{input: "BAND(-(7 + 5) / 2, (7 * 5) / 2)", expect: 16},
-		{input: "BAND(-(7+5)/2, BANDNOT(-(7*5)/2,5))", expect: -22},
+		{input: "BAND(-(7 + 5) / 2, (7 * 5) / 2)", err: expr.ErrTypeMismatch},
+		{input: "BAND(-(7+5)/2, BANDNOT(-(7*5)/2,5))", err: expr.ErrTypeMismatch},
+		{input: "BAND(-(7 + 5) / 2, (7 * 5) / 5)", expect: 2},
+		{input: "BAND(-(7+5)/2, BANDNOT(-(7*5)/5,5))", expect: -8},
 		{input: "SHL(BAND(CEIL(BAND(CEIL(249.50), 15)), BAND(CEIL(219.50), 10)), 4)", expect: 128},
+		{input: "MAX(4, 12) - 1", expect: 11},
+		{input: "ABS(-3) - ABS(-2)", expect: 1},
+		{input: "8 > 4", expect: 1},
+		{input: "8 < 4", expect: 0},
+		{input: "8 >= 8 == (1 > 0)", expect: 1},
+		{input: "4 <= 3 + 1", expect: 1},
+		{input: "4 != 2 * 2", expect: 0},
+		{input: "4 == 2 * 2", expect: 1},
+		{input: "!0", expect: 1},
+		{input: "!(2 > 1)", expect: 0},
+		{input: "1 && 0 || 1", expect: 1},
+		{input: "1 || 0 && 0", expect: 1},
+		{input: "0 && 1 / 0", expect: 0},
+		{input: "1 || 1 / 0", expect: 1},
+		{input: "MAX(1 > 0 ? 1 : 0, 5 == 4 ? 1 : 0) + 1", expect: 2},
+		{input: "AND(GT(12,10),LE(12,20)) == (12 > 10 && 12 <= 20)", expect: 1},
+		{input: "2 ** 10", expect: 1024},
+		{input: "2 ** 3 ** 2", expect: 512},
+		{input: "-2 ** 2", expect: -4},
+		{input: "2 ** -1", expect: 0.5},
+		{input: "3 * 2 ** 2", expect: 12},
+		{input: "7 % 4", expect: 3},
+		{input: "1 + 7 % 4 * 2", expect: 7},
+		{input: "255 & 4", expect: 4},
+		{input: "15 | 2", expect: 15},
+		{input: "15 ^ 2", expect: 13},
+		{input: "~255", expect: -256},
+		{input: "255 << 8", expect: 65280},
+		{input: "255 >> 4", expect: 15},
+		{input: "1 << 2 + 1", expect: 8},
+		{input: "1 | 2 ^ 3 & 4", expect: 3},
+		{input: "(4 & 4) == 4", expect: 1},
+		{input: "5 & 3 && 1", expect: 1},
+		{input: "BAND(255,4) == (255 & 4)", expect: 1},
+		{input: "1 ? 2 : 3", expect: 2},
+		{input: "0 ? 2 : 3", expect: 3},
+		{input: "0 ? 1 : 0 ? 2 : 3", expect: 3},
+		{input: "1 ? 0 ? 4 : 5 : 6", expect: 5},
+		{input: "2 > 1 ? 10 + 1 : 1 / 0", expect: 11},
+		{input: "MAX(1 ? 4 : 5, 3)", expect: 4},
+		{input: "IF(1, 2, 3)", expect: 2},
+		{input: "IF(0, 1 / 0, 3)", expect: 3},
+		{input: "IF(2 > 1, 4 * 2, 1 / 0)", expect: 8},
+		{input: "IFERROR(1 / 0, -1)", expect: -1},
+		{input: "IFERROR(8 / 2, 1 / 0)", expect: 4},
+		{input: "IFERROR(1 << -1, 0) + 1", expect: 1},
+		{input: "MIN(5)", expect: 5},
+		{input: "MIN(8, 3, 5, -1, 2)", expect: -1},
+		{input: "MAX(8, 3, 12, -1, 2)", expect: 12},
+		{input: "SUM(1, 2, 3, 4)", expect: 10},
+		{input: "PRODUCT(1, 2, 3, 4)", expect: 24},
+		{input: "AVG(1, 2, 3, 4)", expect: 2.5},
+		{input: "MEDIAN(5, 1, 3)", expect: 3},
+		{input: "MEDIAN(4, 1, 3, 2)", expect: 2.5},
+		{input: "STDDEV(2, 4, 4, 4, 5, 5, 7, 9)", expect: 2},
+		{input: "COUNT(1, 1 + 1, MAX(1, 2, 3))", expect: 3},
+		{input: "SUM(MIN(3, 1, 2), MAX(3, 1, 2), 4 > 3 ? 10 : 0)", expect: 14},
+		{input: "8 >= 8 == 1", err: expr.ErrTypeMismatch},
+		{input: "MAX(1 > 0, 5 == 4) + 1", err: expr.ErrTypeMismatch},
+		{input: "4 & 4 == 4", err: expr.ErrTypeMismatch},
+		{input: "BAND(255,4) == 255 & 4", err: expr.ErrTypeMismatch},
 	}
 
 	var res float64
@@ -78,6 +160,13 @@ func TestEval(t *testing.T) {
 	for _, tc := range tests {
 
 		res, err = parser.Eval(tc.input)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf(expected_but_got_for_expr, tc.err, err, tc.input)
+			}
+			continue
+		}
+
 		if err != nil {
 			t.Fatalf(expected_but_got_for_expr, nil, err.Error(), tc.input)
 		}
@@ -94,6 +183,7 @@ func TestEvalV(t *testing.T) {
 		input    string
 		variable float64
 		expect   float64
+		err      error
 	}{
 		{input: "2 + %P * 4", variable: 3, expect: 14},
 		{input: "%P + %P / %P", variable: 4, expect: 5},
@@ -145,9 +235,22 @@ func TestEvalV(t *testing.T) {
 		{input: "NOT(%P)", variable: 0, expect: 1},
 		{input: "BAND(5,-(CEIL(CEIL(CEIL(%P)))))", variable: 1.5, expect: 4},
 		{input: "BAND(5,-(CEIL(SQR(SHL(%P, 2))))) * -(%P + 1) * 1", variable: 5, expect: -6},
-		{input: "BAND(-(%P + 5) / 2, (%P * 5) / 2)", variable: 7, expect: 16},
-		{input: "BAND(-(7+%P)/2, BANDNOT(-(7*%P)/2,%P))", variable: 5, expect: -22},
+		{input: "BAND(-(%P + 5) / 2, (%P * 5) / 2)", variable: 7, err: expr.ErrTypeMismatch},
+		{input: "BAND(-(7+%P)/2, BANDNOT(-(7*%P)/2,%P))", variable: 5, err: expr.ErrTypeMismatch},
+		{input: "BAND(-(%P + 5) / 2, (%P * 5) / 5)", variable: 7, expect: 2},
+		{input: "BAND(-(7+%P)/2, BANDNOT(-(7*%P)/%P,%P))", variable: 5, expect: -8},
 		{input: "SHL(BAND(CEIL(BAND(CEIL(249.50), 15)), BAND(CEIL(219.50), %P)), 4)", variable: 10, expect: 128},
+		{input: "%P > 10 && %P <= 20", variable: 15, expect: 1},
+		{input: "%P > 10 && %P <= 20", variable: 25, expect: 0},
+		{input: "%P < 0 || %P >= 100", variable: -1, expect: 1},
+		{input: "(%P != 7 ? 1 : 0) + 1", variable: 7, expect: 1},
+		{input: "%P % 4", variable: 7, expect: 3},
+		{input: "%P ** 2 - %P", variable: 3, expect: 6},
+		{input: "(%P << 2) | 1", variable: 3, expect: 13},
+		{input: "%P != 0 ? 10 / %P : 0", variable: 0, expect: 0},
+		{input: "%P != 0 ? 10 / %P : 0", variable: 4, expect: 2.5},
+		{input: "IFERROR(10 / %P, 0)", variable: 0, expect: 0},
+		{input: "!(%P == 7) + 1", variable: 7, err: expr.ErrTypeMismatch},
 	}
 
 	var res float64
@@ -157,6 +260,13 @@ func TestEvalV(t *testing.T) {
 	for _, tc := range tests {
 
 		res, err = parser.EvalV(tc.input, tc.variable)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf(expected_but_got_for_expr, tc.err, err, tc.input)
+			}
+			continue
+		}
+
 		if err != nil {
 			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc.input)
 		}
@@ -167,79 +277,1725 @@ func TestEvalV(t *testing.T) {
 	}
 }
 
-func TestEvalSyntaxErrors(t *testing.T) {
+func TestEvalEnv(t *testing.T) {
+
+	env := expr.Vars{
+		"speed":  12.5,
+		"time":   4,
+		"offset": -3,
+		"x1":     2,
+		"max_v":  255,
+	}
 
 	tests := []struct {
-		input string
+		input  string
+		expect float64
 	}{
-		{input: "ABS(0ABS(0))"},
-		{input: "ABS(0,0)"},
-		{input: "Abs(0)"},
-		{input: "(2/(2*0))*20"},
-		{input: ",,"},
-		{input: "(,,)"},
-		{input: "(),,"},
-		{input: ","},
-		{input: "()"},
-		{input: "((0)"},
-		{input: "(,"},
-		{input: ").(x"},
-		{input: "ABS(0) * 2,,0"},
-		{input: "SHL(,)"},
-		{input: "SHL(0,,0)"},
-		{input: "AND(-+)"},
-		{input: "AND(m,n)"},
-		{input: "A(0)"},
-		{input: "(4)*/28"},
-		{input: "<(0)>"},
-		{input: "SHL((2+2/))"},
-		{input: "(ABS(2)) * (0))"},
+		{input: "speed * time + offset", expect: 47},
+		{input: "-(speed - offset) / 2", expect: -7.75},
+		{input: "x1 * x1 * x1", expect: 8},
+		{input: "BAND(max_v, 4)", expect: 4},
+		{input: "MAX(speed, time) * x1", expect: 25},
+		{input: "ABS(offset)", expect: 3},
+		{input: "SHL(BAND(CEIL(BAND(CEIL(249.50), 15)), BAND(CEIL(219.50), x1 * 5)), time)", expect: 128},
 	}
 
-	parser := expr.NewParser()
+	var res float64
 	var err error
+	parser := expr.NewParser()
 
 	for _, tc := range tests {
 
-		_, err = parser.Eval(tc.input)
-		if _, ok := err.(expr.SyntaxError); !ok {
-			// Not convertible to syntax error
-			t.Errorf(expected_but_got_for_expr, "registered syntax error", err, tc.input)
+		res, err = parser.EvalEnv(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc.input)
+		}
+
+		if tc.expect != res {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
 		}
 	}
 }
 
-func BenchmarkEvaluate(b *testing.B) {
+func TestEvalValue(t *testing.T) {
+
+	env := expr.Values{
+		"n":    expr.IntValue(6),
+		"f":    expr.FloatValue(2.5),
+		"flag": expr.BoolValue(true),
+	}
+
+	tests := []struct {
+		input  string
+		expect expr.Value
+	}{
+		{input: "1 + 2", expect: expr.IntValue(3)},
+		{input: "1.5 + 1", expect: expr.FloatValue(2.5)},
+		{input: "2.0 * 3", expect: expr.FloatValue(6)},
+		{input: "7 / 2", expect: expr.FloatValue(3.5)},
+		{input: "6 / 3", expect: expr.FloatValue(2)},
+		{input: "7 % 3 + 2 ** 10", expect: expr.IntValue(1025)},
+		{input: "2 ** -1", expect: expr.FloatValue(0.5)},
+		{input: "1 < 2", expect: expr.BoolValue(true)},
+		{input: "!1", expect: expr.BoolValue(false)},
+		{input: "1 && 0 || 1", expect: expr.BoolValue(true)},
+		{input: "(1 < 2) == (2 < 1)", expect: expr.BoolValue(false)},
+		{input: "0x7F & 6.0", expect: expr.IntValue(6)},
+		{input: "~0", expect: expr.IntValue(-1)},
+		{input: "9223372036854775807 + 1", expect: expr.FloatValue(9223372036854775808)},
+		{input: "-9223372036854775807 - 2", expect: expr.FloatValue(-9223372036854775809)},
+		{input: "3037000500 * 3037000500", expect: expr.FloatValue(9223372037000250000)},
+		{input: "2 ** 63", expect: expr.FloatValue(9223372036854775808)},
+		{input: "1 << 62", expect: expr.IntValue(4611686018427387904)},
+		{input: "1 << 63", expect: expr.FloatValue(9223372036854775808)},
+		{input: "-1 << 63", expect: expr.IntValue(-9223372036854775808)},
+		{input: "SHL(255, 60)", expect: expr.FloatValue(255 * (1 << 60))},
+		{input: "3 << 64", expect: expr.FloatValue(3 * (1 << 64))},
+		{input: "0 << 100", expect: expr.IntValue(0)},
+		{input: "-8 >> 100", expect: expr.IntValue(-1)},
+		{input: "9223372036854775808", expect: expr.FloatValue(9223372036854775808)},
+		{input: "n * 2 + 1", expect: expr.IntValue(13)},
+		{input: "n * f", expect: expr.FloatValue(15)},
+		{input: "flag ? n : f", expect: expr.IntValue(6)},
+		{input: "!flag || n > f", expect: expr.BoolValue(true)},
+		{input: "SUM(1, 2, 3)", expect: expr.IntValue(6)},
+		{input: "SUM(1, 2.5)", expect: expr.FloatValue(3.5)},
+		{input: "MAX(1, 3, 2)", expect: expr.IntValue(3)},
+		{input: "MIN(1, 0.5)", expect: expr.FloatValue(0.5)},
+		{input: "MAX(1, 2.0)", expect: expr.FloatValue(2)},
+		{input: "ABS(-n)", expect: expr.IntValue(6)},
+		{input: "COUNT(f, flag)", expect: expr.IntValue(2)},
+		{input: "SHL(1, 4) + BAND(n, 3.0)", expect: expr.IntValue(18)},
+		{input: "GT(n, 1) && NOT(0)", expect: expr.BoolValue(true)},
+		{input: "CEIL(1.5)", expect: expr.FloatValue(2)},
+		{input: "IF(flag, 1, 2.5)", expect: expr.IntValue(1)},
+	}
 
 	parser := expr.NewParser()
-	for i := 0; i < b.N; i++ {
-		parser.EvalV("BAND(5, 10 * 1000.0)", 10)
+	for _, tc := range tests {
+
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc.input)
+			continue
+		}
+
+		if res != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect.Kind().String()+" "+tc.expect.String(), res.Kind().String()+" "+res.String(), tc.input)
+		}
+	}
+
+	// Eval converts the result to a float, with true as 1
+	if res, err := parser.Eval("2 > 1"); err != nil || res != 1 {
+		t.Errorf(expected_but_got_for_expr, 1, res, "2 > 1")
+	}
+
+	for _, input := range []string{"flag + 1", "BAND(f, 1)", "1 << flag", "-flag", "n ** 2 > flag"} {
+		if _, err := parser.EvalValue(input, env); !errors.Is(err, expr.ErrTypeMismatch) {
+			t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, input)
+		}
 	}
 }
 
-func FuzzEval(f *testing.F) {
+func TestStrings(t *testing.T) {
 
-	testcases := []string{
-		"BAND(-(7+5)/2, BANDNOT(-(7*5)/2,5))",
-		"1985 * 15 / 50.0",
-		"BAND(5,CEIL(CEIL(CEIL(1.5))))",
-		"CEIL(2)",
-		"NOT(1130.0) + ()",
-		"(,",
-		").(x",
-		"AND(-+)",
-		"'9(AND(0, 0)    * X * X / 0",
-		"0-0-0!",
-		"((((059.))))",
-		"!",
-		"OR(0,0) * -(2 * OR(1,1) / AND(0,1) * ((((0))))",
+	env := expr.Values{
+		"name": expr.StringValue("Ada Lovelace"),
+		"code": expr.StringValue("AB-1234"),
+		"n":    expr.IntValue(3),
 	}
-	for _, tc := range testcases {
-		f.Add(tc)
+
+	tests := []struct {
+		input  string
+		expect expr.Value
+	}{
+		{input: `"abc"`, expect: expr.StringValue("abc")},
+		{input: `'it"s'`, expect: expr.StringValue(`it"s`)},
+		{input: `"it's"`, expect: expr.StringValue("it's")},
+		{input: `'a\'b' + "\"\t\\\u00e9\x41"`, expect: expr.StringValue("a'b\"\t\\\u00e9A")},
+		{input: `"é(" + ')'`, expect: expr.StringValue("é()")},
+		{input: `""`, expect: expr.StringValue("")},
+		{input: `"ab" + "cd" == "abcd"`, expect: expr.BoolValue(true)},
+		{input: `"abc" < "abd" && "b" > "a" && "a" <= "a" && "b" >= "a" && "a" != "b"`, expect: expr.BoolValue(true)},
+		{input: `LEN(name) > 3 && STARTSWITH(code, "AB")`, expect: expr.BoolValue(true)},
+		{input: `LEN("héllo")`, expect: expr.IntValue(5)},
+		{input: `UPPER(name) + LOWER("!X")`, expect: expr.StringValue("ADA LOVELACE!x")},
+		{input: `SUBSTR(name, 4)`, expect: expr.StringValue("Lovelace")},
+		{input: `SUBSTR(name, 0, n)`, expect: expr.StringValue("Ada")},
+		{input: `SUBSTR("héllo", 1, 2)`, expect: expr.StringValue("él")},
+		{input: `SUBSTR("abc", -1, 2) + SUBSTR("abc", 2, 10) + SUBSTR("abc", 5) + SUBSTR("abc", 1, -1)`, expect: expr.StringValue("ac")},
+		{input: `CONTAINS(name, "Love") && !CONTAINS(name, "love")`, expect: expr.BoolValue(true)},
+		{input: `ENDSWITH(code, "34") && !ENDSWITH(code, "AB")`, expect: expr.BoolValue(true)},
+		{input: `REPLACE(code, "-", "")`, expect: expr.StringValue("AB1234")},
+		{input: `TRIM("  a b \n")`, expect: expr.StringValue("a b")},
+		{input: `FORMAT("%s has %d items at %.2f: %v", name, n, 2.5, n > 1)`, expect: expr.StringValue("Ada Lovelace has 3 items at 2.50: true")},
+		{input: `FORMAT("plain")`, expect: expr.StringValue("plain")},
+		{input: `IF(name == "", "anonymous", name)`, expect: expr.StringValue("Ada Lovelace")},
+		{input: `"" ? 1 : 2`, expect: expr.IntValue(2)},
+		{input: `MAX("pear", "apple") + MIN("b", "a")`, expect: expr.StringValue("peara")},
+		{input: `IFERROR(LEN(n), "n/a")`, expect: expr.StringValue("n/a")},
 	}
 
 	parser := expr.NewParser()
-	f.Fuzz(func(t *testing.T, input string) {
-		parser.Eval(input)
-	})
+	for _, tc := range tests {
+
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc.input)
+			continue
+		}
+
+		if res != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	// Strings have no float value
+	if _, err := parser.EvalEnv(`UPPER(name)`, env); !errors.Is(err, expr.ErrTypeMismatch) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, "UPPER(name)")
+	}
+}
+
+func TestDecimal(t *testing.T) {
+
+	env := expr.Values{"price": expr.FloatValue(19.99), "qty": expr.IntValue(3)}
+	tests := []struct {
+		input     string
+		precision uint
+		mode      big.RoundingMode
+		expect    string
+	}{
+		{input: "0.1 + 0.2", expect: "0.3"},
+		{input: "0.1 + 0.2 == 0.3", expect: "true"},
+		{input: "1 / 3", expect: "0.3333333333333333333333333333333333"},
+		{input: "2 / 3", precision: 5, expect: "0.66667"},
+		{input: "2 / 3", precision: 5, mode: big.ToZero, expect: "0.66666"},
+		{input: "price * qty", expect: "59.97"},
+		{input: "ROUND(2.675, 2)", expect: "2.68"},
+		{input: "ROUND(2.665, 2)", expect: "2.66"},
+		{input: "ROUND(2.665, 2)", mode: big.ToNearestAway, expect: "2.67"},
+		{input: "ROUND(1234.5, -2)", expect: "1200"},
+		{input: "ROUND(-2.5) + RND(3.5) + CEIL(1.01)", expect: "4"},
+		{input: "SQR(2)", precision: 10, expect: "1.414213562"},
+		{input: "POW(1.1, 2) + 2 ** -2", expect: "1.46"},
+		{input: "7 % 2.5 + MOD(7, 3)", expect: "3.0"},
+		{input: "AVG(1, 2) + MEDIAN(4, 1, 2, 3)", expect: "4.0"},
+		{input: "MIN(0.3, 0.1 + 0.1) + MAX(1, 2)", expect: "2.2"},
+		{input: "ABS(-1.50) + BAND(6, 3.0)", expect: "3.50"},
+		{input: `FORMAT("%.2f", 1 / 3)`, expect: "0.33"},
+		{input: "1e6000 * 1e6000 > 0", expect: "decimal out of range"},
+		{input: "10e9223372036854775807", expect: "decimal out of range"},
+		{input: "1e99999999999999999999 - 1", expect: "decimal out of range"},
+		{input: "1e-7000 * 1", expect: "0"},
+		{input: "0.5e-9223372036854775808", expect: "0"},
+		{input: "0.000 * 1", expect: "0.000"},
+	}
+
+	for _, tc := range tests {
+		if tc.precision == 0 {
+			tc.precision = expr.DefaultDecimalPrecision
+		}
+
+		parser := expr.NewParser(expr.DecimalMode(tc.precision, tc.mode))
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			if !errors.Is(err, expr.ErrInvalidValue) || tc.expect != "decimal out of range" {
+				t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			}
+			continue
+		}
+
+		if res.String() != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	// Outside of decimal mode, ROUND rounds the decimal digits of floats and keeps ints as ints
+	parser := expr.NewParser()
+	for input, expect := range map[string]expr.Value{
+		"ROUND(2.675, 2)":   expr.FloatValue(2.68),
+		"ROUND(-0.5)":       expr.FloatValue(-0),
+		"ROUND(1234, -2)":   expr.IntValue(1200),
+		"ROUND(1.25, 1e9)":  expr.FloatValue(1.25),
+		"ROUND(1.25, 1)":    expr.FloatValue(1.2),
+		"ROUND(0.1 + 0.2)":  expr.FloatValue(0),
+		"ROUND(5, 1) + 0.5": expr.FloatValue(5.5),
+		"ROUND(1e308 * 10)": expr.FloatValue(math.Inf(1)),
+	} {
+		res, err := parser.EvalValue(input, nil)
+		if err != nil || res != expect {
+			t.Errorf(expected_but_got_for_expr, expect, res, input)
+		}
+	}
+
+	if _, err := parser.EvalValue("ROUND(1.5, 0.5)", nil); !errors.Is(err, expr.ErrTypeMismatch) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, "ROUND(1.5, 0.5)")
+	}
+}
+
+func TestBigInt(t *testing.T) {
+
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	env := expr.Values{"mask": expr.IntValue(0xFF), "huge": expr.BigIntValue(huge), "f": expr.FloatValue(4)}
+	tests := []struct {
+		input  string
+		div    expr.DivisionMode
+		expect string
+	}{
+		{input: "SHL(255, 60)", expect: "293994983674745978880"},
+		{input: "mask << 120 | 1", expect: "338953138925153547590470800371487866881"},
+		{input: "SHR(1 << 200, 199) + (-1 >> 500)", expect: "1"},
+		{input: "BAND(0xFFFF_FFFF_FFFF_FFFF_FF, ~0) == 0xFFFF_FFFF_FFFF_FFFF_FF", expect: "true"},
+		{input: "BOR(1 << 64, 1) - BXOR(1 << 64, 1) + BANDNOT(7, 2) + BNOT(-1)", expect: "5"},
+		{input: "9223372036854775807 + 1", expect: "9223372036854775808"},
+		{input: "-9223372036854775808 * -1", expect: "9223372036854775808"},
+		{input: "huge * huge", expect: "15241578753238836750495351562536198787501905199875019052100"},
+		{input: "2 ** 100", expect: "1267650600228229401496703205376"},
+		{input: "POW(-3, 41) + MOD(10, 4)", expect: "-36472996377170786401"},
+		{input: "-7 / 2", expect: "-3"},
+		{input: "-7 % 2", expect: "-1"},
+		{input: "7 / -2", expect: "-3"},
+		{input: "-7 / 2", div: expr.FlooredDivision, expect: "-4"},
+		{input: "-7 % 2", div: expr.FlooredDivision, expect: "1"},
+		{input: "7 % -2", div: expr.FlooredDivision, expect: "-1"},
+		{input: "MOD(-7, 2)", div: expr.FlooredDivision, expect: "1"},
+		{input: "6 / 3 + (1 / 2 == 0 ? 1 : 0)", expect: "3"},
+		{input: "2 ** -1", expect: "0.5"},
+		{input: "1.5 + 1", expect: "2.5"},
+		{input: "f * 2 ** 64", expect: "73786976294838206464"},
+		{input: "SUM(1, 2 ** 70) + MAX(3, 2 ** 64) + ABS(-huge) - huge", expect: "1199038364791120855041"},
+		{input: "ROUND(125, -1) + ROUND(135, -1) + CEIL(2 ** 65) - 2 ** 65", expect: "260"},
+		{input: `FORMAT("%x", 1 << 64)`, expect: "10000000000000000"},
+		{input: "1 << 64 > 1 << 63 && (1 << 64) - 1 != 1 << 64", expect: "true"},
+	}
+
+	for _, tc := range tests {
+		parser := expr.NewParser(expr.IntegerMode(tc.div))
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			continue
+		}
+
+		if res.String() != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	parser := expr.NewParser(expr.IntegerMode(expr.TruncatedDivision))
+	for input, expect := range map[string]error{
+		"1 / (2 ** 64 - 2 ** 64)": expr.ErrDivideByZero,
+		"1 << -(2 ** 64)":         expr.ErrNegativeShift,
+		"2 ** 2 ** 30":            expr.ErrInvalidValue,
+		"1 << (1 << 40)":          expr.ErrInvalidValue,
+		"(1 << 64) & 1.5":         expr.ErrTypeMismatch,
+	} {
+		if _, err := parser.EvalValue(input, nil); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// The exact value is available to callers, and saturates when taken as an int64
+	res, err := parser.EvalValue("-(2 ** 64)", nil)
+	if err != nil || res.Kind() != expr.BigInt || res.BigInt().String() != "-18446744073709551616" || res.Int() != math.MinInt64 {
+		t.Errorf(expected_but_got_for_expr, "-18446744073709551616", res, "-(2 ** 64)")
+	}
+}
+
+func TestComplex(t *testing.T) {
+
+	env := expr.Values{"z": expr.ComplexValue(3 - 4i), "n": expr.IntValue(2)}
+	tests := []struct {
+		input  string
+		expect complex128
+	}{
+		{input: "4i", expect: 4i},
+		{input: "2.5e1i - 1", expect: -1 + 25i},
+		{input: "0x10i + i", expect: 17i},
+		{input: "(3 + 4i) * (3 - 4i)", expect: 25},
+		{input: "(1 + 2i) / (3 - 4i)", expect: -0.2 + 0.4i},
+		{input: "-(1 + 2i)", expect: -1 - 2i},
+		{input: "i ** 2 + i ** n", expect: -2},
+		{input: "(1 + 1i) ** -2", expect: -0.5i},
+		{input: "ABS(z) + ARG(1i) * 2 / PI", expect: 6},
+		{input: "CONJ(z) + RE(z) + IM(z)", expect: 2 + 4i},
+		{input: "SQR(-4)", expect: 2i},
+		{input: "LN(-1) / PI", expect: 1i},
+		{input: "EXP(i * PI) + 1", expect: complex(0, 1.2246467991473532e-16)},
+		{input: "(3 + 4i) * EXP(i * PI / 4)", expect: complex(-math.Sqrt2/2, 7*math.Sqrt2/2)},
+		{input: "E ** (i * PI) + LN(E)", expect: complex(0, 1.2246467991473532e-16)},
+		{input: "COS(1i) ** 2 + SIN(1i) ** 2", expect: 1},
+		{input: "POW(2i, 2) + ROUND(2.567 + 1.234i, 1)", expect: -1.4 + 1.2i},
+		{input: "CEIL(1.5) + MIN(3, 1 + 0i) + SUM(1i, 2)", expect: 5 + 1i},
+		{input: "1 < 2 && 1i == 1i && z != 0 ? z : 0", expect: 3 - 4i},
+		{input: "BAND(6, 3) + 7 % 4", expect: 5},
+	}
+
+	parser := expr.NewParser(expr.ComplexMode())
+	for _, tc := range tests {
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			continue
+		}
+
+		if res.Kind() != expr.Complex || cmplx.Abs(res.Complex()-tc.expect) > 1e-12 {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	for input, expect := range map[string]error{
+		"1i < 2":      expr.ErrTypeMismatch,
+		"5 % 2i":      expr.ErrTypeMismatch,
+		"BAND(1i, 1)": expr.ErrTypeMismatch,
+		"TAN(1i)":     expr.ErrTypeMismatch,
+		"1 / (i - i)": expr.ErrDivideByZero,
+	} {
+		if _, err := parser.EvalValue(input, env); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// Results print without the part that is zero, and have a float value only when they are real
+	for input, expect := range map[string]string{"3 - 4i": "3-4i", "-0.5i": "-0.5i", "2 + 0i": "2", "i": "1i"} {
+		if res, err := parser.EvalValue(input, nil); err != nil || res.String() != expect {
+			t.Errorf(expected_but_got_for_expr, expect, res, input)
+		}
+	}
+
+	if res, err := parser.Eval("SQR(-4) * 2i"); err != nil || res != -4 {
+		t.Errorf(expected_but_got_for_expr, -4, res, "SQR(-4) * 2i")
+	}
+
+	if _, err := parser.Eval("SQR(-4)"); !errors.Is(err, expr.ErrTypeMismatch) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, "SQR(-4)")
+	}
+
+	// Variables named PI or E take precedence over the constants
+	if res, err := parser.EvalEnv("PI * 2 + E", expr.Vars{"PI": 3}); err != nil || res != 6+math.E {
+		t.Errorf(expected_but_got_for_expr, 6+math.E, res, "PI * 2 + E")
+	}
+
+	if res, err := parser.EvalValue("PI + E", expr.Values{"E": expr.ComplexValue(1i)}); err != nil || res.Complex() != complex(math.Pi, 1) {
+		t.Errorf(expected_but_got_for_expr, complex(math.Pi, 1), res, "PI + E")
+	}
+
+	// Outside of complex mode, imaginary literals are invalid and i is a variable
+	if _, err := expr.NewParser().Eval("4i"); !errors.Is(err, expr.ErrInvalidNumber) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrInvalidNumber, err, "4i")
+	}
+}
+
+func TestUnits(t *testing.T) {
+
+	speed, err := expr.QuantityValue(36, "km/h")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "QuantityValue")
+	}
+
+	env := expr.Values{"v": speed, "n": expr.IntValue(3)}
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "5 m + 20 cm", expect: "5.2 m"},
+		{input: "20 cm + 5 m", expect: "520 cm"},
+		{input: "9.81 m/s^2 * 3 kg", expect: "29.43 N"},
+		{input: "TO(100 km / 2 h, \"km/h\")", expect: "50 km/h"},
+		{input: "TO(v * 30 min, \"m\")", expect: "18000 m"},
+		{input: "5 m/s * 2 s", expect: "10 m"},
+		{input: "5 N * m / 2", expect: "2.5 N*m"},
+		{input: "(3 cm) ** 2", expect: "9 cm^2"},
+		{input: "2 km * n - 500 m", expect: "5.5 km"},
+		{input: "-2 mA * 3", expect: "-6 mA"},
+		{input: "SQR(16 m^2) + ABS(-1 m)", expect: "5 m"},
+		{input: "SUM(1 m, 2 m) + AVG(1 m, 2 m)", expect: "4.5 m"},
+		{input: "ROUND(1.26 m, 1)", expect: "1.3 m"},
+		{input: "10 m / 5 m", expect: "2"},
+		{input: "5 m > 400 cm && 1 kg == 1000 g", expect: "true"},
+		{input: "5m + 20cm", expect: "5.2 m"},
+		{input: "1e3m + 0x10km", expect: "17000 m"},
+		{input: "1.5min / 30s", expect: "3"},
+		{input: "n * 1 m + 2 kg*m / 1 kg", expect: "5 m"},
+	}
+
+	parser := expr.NewParser(expr.UnitMode())
+	for _, tc := range tests {
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil || res.String() != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	for input, expect := range map[string]error{
+		"5 m + 2 s":           expr.ErrDimensionMismatch,
+		"1 m < 1 kg":          expr.ErrDimensionMismatch,
+		"TO(2 h, \"m\")":      expr.ErrDimensionMismatch,
+		"SIN(2 m)":            expr.ErrDimensionMismatch,
+		"SQR(2 m)":            expr.ErrDimensionMismatch,
+		"2 m ** 0.5":          expr.ErrDimensionMismatch,
+		"3 furlong":           expr.ErrUnknownUnit,
+		"3furlong":            expr.ErrUnknownUnit,
+		"TO(1 m, \"parsec\")": expr.ErrUnknownUnit,
+		"n m":                 expr.ErrUnexpectedTerm,
+		"2 kg m":              expr.ErrUnexpectedTerm,
+	} {
+		if _, err := parser.EvalValue(input, env); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// Without UnitMode, a name after a number is a syntax error
+	if _, err := expr.NewParser().Eval("5 m"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "an error", err, "5 m")
+	}
+
+	// The number modes are mutually exclusive, and the last one given applies
+	if res, err := expr.NewParser(expr.ComplexMode(), expr.UnitMode()).EvalValue("5 m", nil); err != nil || res.String() != "5 m" {
+		t.Errorf(expected_but_got_for_expr, "5 m", res, "5 m in complex then unit mode")
+	}
+
+	if _, err := expr.NewParser(expr.ComplexMode(), expr.UnitMode()).EvalValue("1i", nil); err == nil {
+		t.Errorf(expected_but_got_for_expr, "an error", err, "1i in complex then unit mode")
+	}
+
+	if res, err := expr.NewParser(expr.UnitMode(), expr.ComplexMode()).EvalValue("2i * i", nil); err != nil || res.Kind() != expr.Complex {
+		t.Errorf(expected_but_got_for_expr, "-2", res, "2i * i in unit then complex mode")
+	}
+
+	if _, err := expr.NewParser(expr.UnitMode(), expr.IntervalMode()).Eval("5 m"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "an error", err, "5 m in unit then interval mode")
+	}
+}
+
+func TestInterval(t *testing.T) {
+
+	env := expr.Values{"%P": expr.IntervalValue(6.9, 7.1), "x": expr.IntervalValue(2, -1), "n": expr.IntValue(3)}
+	tests := []struct {
+		input  string
+		lo, hi float64
+	}{
+		{input: "2 + 3 * n", lo: 11, hi: 11},
+		{input: "0.1", lo: math.Nextafter(0.1, 0), hi: 0.1},
+		{input: "%P * 2 - 1", lo: 12.8, hi: 13.2},
+		{input: "x * x", lo: -2, hi: 4},
+		{input: "x ** 2", lo: 0, hi: 4},
+		{input: "x ** 3 + -x", lo: -3, hi: 9},
+		{input: "SQR(4) + ABS(x) + CEIL(x / 2)", lo: 2, hi: 5},
+		{input: "SIN(x)", lo: math.Sin(-1), hi: 1},
+		{input: "COS(x)", lo: math.Cos(2), hi: 1},
+		{input: "TAN(x)", lo: math.Inf(-1), hi: math.Inf(1)},
+		{input: "%P % 3", lo: 0.9000000000000004, hi: 1.0999999999999996},
+		{input: "MIN(x, %P) + MAX(1, x)", lo: 0, hi: 4},
+		{input: "MEDIAN(x, %P, 3)", lo: 3, hi: 3},
+		{input: "LO(%P) + HI(x)", lo: 8.9, hi: 8.9},
+		{input: "%P > 6 ? 1 : 0", lo: 1, hi: 1},
+	}
+
+	parser := expr.NewParser(expr.IntervalMode())
+	for _, tc := range tests {
+		res, err := parser.EvalValue(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, expr.IntervalValue(tc.lo, tc.hi), err, tc.input)
+			continue
+		}
+
+		// Bounds are rounded outward, so they may be a few floats wider than the exact ones
+		lo, hi := res.Interval()
+		if res.Kind() != expr.Interval || lo > tc.lo || hi < tc.hi || tc.lo-lo > 1e-12 || hi-tc.hi > 1e-12 {
+			t.Errorf(expected_but_got_for_expr, expr.IntervalValue(tc.lo, tc.hi), res, tc.input)
+		}
+	}
+
+	// Every value the expression takes within the inputs is within the bounds
+	prog, err := parser.Compile("SQR(%P) * COS(%P / 3) - 1 / %P ** 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := prog.EvalValue(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lo, hi := res.Interval()
+	for p := 6.9; p <= 7.1; p += 0.001 {
+		value := math.Sqrt(p)*math.Cos(p/3) - 1/(p*p)
+		if value < lo || value > hi {
+			t.Errorf(expected_but_got_for_expr, res, value, p)
+		}
+	}
+
+	for input, expect := range map[string]error{
+		"1 / x":     expr.ErrDivideByZero,
+		"SQR(x)":    expr.ErrInvalidValue,
+		"x ** 0.5":  expr.ErrInvalidValue,
+		"%P > 7":    expr.ErrIndeterminate,
+		"x == 1":    expr.ErrIndeterminate,
+		"STDDEV(x)": expr.ErrTypeMismatch,
+	} {
+		if _, err := parser.EvalValue(input, env); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// An interval holding zero among other numbers is neither true nor false, in the tree and the VM alike
+	for _, input := range []string{"x ? 1 : 2", "x && 1", "0 || x", "!x", "IF(x, 1, 2)", "1 && x * 0 + x", "(0.1 - 0.1) ? 1 : 2"} {
+		if _, err := parser.EvalValue(input, env); !errors.Is(err, expr.ErrIndeterminate) {
+			t.Errorf(expected_but_got_for_expr, expr.ErrIndeterminate, err, input)
+		}
+
+		prog, err := parser.CompileOptimized(input)
+		if err == nil {
+			_, err = prog.EvalValue(env)
+		}
+		if !errors.Is(err, expr.ErrIndeterminate) {
+			t.Errorf(expected_but_got_for_expr, expr.ErrIndeterminate, err, input)
+		}
+	}
+
+	// Intervals that exclude zero are true, and exactly zero is false
+	for input, expect := range map[string]bool{
+		"%P ? 1 : 0":    true,
+		"%P && n":       true,
+		"!%P":           false,
+		"x * 0 || %P":   true,
+		"x * 0 ? 1 : 0": false,
+		"!(x * 0)":      true,
+		"x > -2 && %P":  true,
+	} {
+		res, err := parser.EvalValue(input, env)
+		if err != nil || res.Bool() != expect {
+			t.Errorf(expected_but_got_for_expr, expect, res, input)
+		}
+	}
+
+	// Intervals print their bounds, and have their midpoint as a float value
+	if res, err := parser.EvalValue("x * 2", env); err != nil || res.String() != "[-2, 4]" || res.Float() != 1 {
+		t.Errorf(expected_but_got_for_expr, "[-2, 4]", res, "x * 2")
+	}
+}
+
+func TestGradient(t *testing.T) {
+
+	env := expr.Values{"x": expr.FloatValue(2), "y": expr.IntValue(3)}
+	tests := []struct {
+		input  string
+		value  float64
+		dx, dy float64
+	}{
+		{input: "x * y + SIN(x)", value: 6 + math.Sin(2), dx: 3 + math.Cos(2), dy: 2},
+		{input: "x ** y", value: 8, dx: 12, dy: 8 * math.Ln2},
+		{input: "POW(x, 2) / y", value: 4.0 / 3, dx: 4.0 / 3, dy: -4.0 / 9},
+		{input: "SQR(x) * EXP(y)", value: math.Sqrt2 * math.Exp(3), dx: math.Exp(3) / (2 * math.Sqrt2), dy: math.Sqrt2 * math.Exp(3)},
+		{input: "LN(x) - ATAN(y)", value: math.Ln2 - math.Atan(3), dx: 0.5, dy: -0.1},
+		{input: "TAN(x / 4)", value: math.Tan(0.5), dx: 0.25 / (math.Cos(0.5) * math.Cos(0.5))},
+		{input: "ASIN(x / 4) + ACOS(y / 4)", value: math.Asin(0.5) + math.Acos(0.75), dx: 0.25 / math.Sqrt(0.75), dy: -0.25 / math.Sqrt(1-0.5625)},
+		{input: "x % 1.5 + MOD(y, x)", value: 1.5, dx: 0, dy: 1},
+		{input: "ABS(x - y)", value: 1, dx: -1, dy: 1},
+		{input: "MIN(x, y) + MAX(x, y) * 2", value: 8, dx: 1, dy: 2},
+		{input: "AVG(x, y, 1)", value: 2, dx: 1.0 / 3, dy: 1.0 / 3},
+		{input: "MEDIAN(x, y, 10)", value: 3, dx: 0, dy: 1},
+		{input: "STDDEV(x, y)", value: 0.5, dx: -0.5, dy: 0.5},
+		{input: "ROUND(x * y, 1) + CEIL(x)", value: 8, dx: 0, dy: 0},
+		{input: "x > 1 ? x * x : y", value: 4, dx: 4, dy: 0},
+		{input: "IF(x < 1, x, -y)", value: -3, dx: 0, dy: -1},
+		{input: "BAND(3, 1) + x", value: 3, dx: 1, dy: 0},
+	}
+
+	parser := expr.NewParser()
+	for _, tc := range tests {
+		value, partials, err := parser.Gradient(tc.input, env)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.value, err, tc.input)
+			continue
+		}
+
+		for _, got := range [][2]float64{{value, tc.value}, {partials["x"], tc.dx}, {partials["y"], tc.dy}} {
+			if math.Abs(got[0]-got[1]) > 1e-12*math.Max(1, math.Abs(got[1])) {
+				t.Errorf(expected_but_got_for_expr, tc.value, value, tc.input)
+				t.Errorf(expected_but_got_for_expr, map[string]float64{"x": tc.dx, "y": tc.dy}, partials, tc.input)
+				break
+			}
+		}
+	}
+
+	// Every variable has a partial, even where it is never evaluated, and constants have none
+	if _, partials, err := parser.Gradient("x > 0 ? 1 : y", env); err != nil || len(partials) != 2 || partials["y"] != 0 {
+		t.Errorf(expected_but_got_for_expr, map[string]float64{"x": 0, "y": 0}, partials, "x > 0 ? 1 : y")
+	}
+	if value, partials, err := parser.Gradient("2 + 3", env); err != nil || value != 5 || len(partials) != 0 {
+		t.Errorf(expected_but_got_for_expr, 5, value, "2 + 3")
+	}
+
+	// Numbers of other modes are constants
+	if _, partials, err := expr.NewParser(expr.ComplexMode()).Gradient("x * 2 + 1", env); err != nil || partials["x"] != 2 {
+		t.Errorf(expected_but_got_for_expr, 2, partials["x"], "x * 2 + 1")
+	}
+
+	parser.RegisterFunc("TWICE", 1, func(args ...float64) (float64, error) { return 2 * args[0], nil })
+	parser.RegisterLazyFunc("FIRST", 2, func(args ...expr.Thunk) (float64, error) { return args[0]() })
+	for input, expect := range map[string]error{
+		"BAND(x, 1)":  expr.ErrNotDifferentiable,
+		"x << 1":      expr.ErrNotDifferentiable,
+		"~y":          expr.ErrNotDifferentiable,
+		"TWICE(x)":    expr.ErrNotDifferentiable,
+		"FIRST(y, 0)": expr.ErrNotDifferentiable,
+		"x / (y - 3)": expr.ErrDivideByZero,
+		"x + w":       expr.ErrUndefinedVariable,
+	} {
+		if _, _, err := parser.Gradient(input, env); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// Constant arguments are fine
+	if value, _, err := parser.Gradient("TWICE(3) + FIRST(1, x)", env); err != nil || value != 7 {
+		t.Errorf(expected_but_got_for_expr, 7, value, "TWICE(3) + FIRST(1, x)")
+	}
+}
+
+func TestDerive(t *testing.T) {
+
+	parser := expr.NewParser()
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "SIN(x) * x", expect: "COS(x) * x + SIN(x)"},
+		{input: "x ** 3 + 2 * x - y", expect: "3 * x ** 2 + 2"},
+		{input: "1 / x", expect: "-1 / x ** 2"},
+		{input: "x ** -1", expect: "-x ** -2"},
+		{input: "x ** (2 * 3) - x ** -0.5", expect: "6 * x ** 5 + 0.5 * x ** -1.5"},
+		{input: "2 ** x", expect: "2 ** x * LN(2)"},
+		{input: "COS(2 * x) - TAN(x)", expect: "-2 * SIN(2 * x) - 1 / COS(x) ** 2"},
+		{input: "x > 0 ? x * x : -x", expect: "x > 0 ? 2 * x : -1"},
+		{input: "MAX(x, 2)", expect: "x >= 2 ? 1 : 0"},
+		{input: "CEIL(x) + y * 4", expect: "0"},
+	}
+
+	for _, tc := range tests {
+		node, err := parser.D(tc.input, "x")
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			continue
+		}
+		if res := ast.Format(node); res != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	// Derivatives evaluate to the partials Gradient finds
+	env := expr.Values{"x": expr.FloatValue(0.7), "y": expr.FloatValue(-1.3)}
+	for _, input := range []string{
+		"x * y / (x - y) + x % 0.3",
+		"x ** y + y ** x + POW(x, 2.5)",
+		"EXP(SIN(x * y)) * SQR(LN(x + 2))",
+		"ACOS(x) + ASIN(x / 2) + ATAN(x * y) + ABS(y)",
+		"MIN(x, y, 0) + MAX(x, y) * MOD(x, y)",
+		"SUM(x, y) * AVG(x, y, 1) + PRODUCT(x, y, x) + STDDEV(x, y, 2)",
+		"IF(x > y, -x * y, y) + (y > 0 ? x : y / x)",
+		"x ** -1 + (x + y) ** -y",
+	} {
+		_, partials, err := parser.Gradient(input, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, expect := range partials {
+			node, err := parser.D(input, name)
+			if err != nil {
+				t.Errorf(expected_but_got_for_expr, expect, err, input)
+				continue
+			}
+
+			prog, err := parser.CompileNode(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := prog.Eval(env)
+			if err != nil || math.Abs(res-expect) > 1e-12*math.Max(1, math.Abs(expect)) {
+				t.Errorf(expected_but_got_for_expr, expect, ast.Format(node), input)
+			}
+		}
+	}
+
+	parser.RegisterFunc("TWICE", 1, func(args ...float64) (float64, error) { return 2 * args[0], nil })
+	for _, input := range []string{"BAND(x, 1)", "x << 1", "TWICE(x)", "MEDIAN(x, 1)", "IFERROR(1 / x, 0)"} {
+		if _, err := parser.D(input, "x"); !errors.Is(err, expr.ErrNotDifferentiable) {
+			t.Errorf(expected_but_got_for_expr, expr.ErrNotDifferentiable, err, input)
+		}
+	}
+	if node, err := parser.D("TWICE(y) + BAND(y, 1) * x", "x"); err != nil || ast.Format(node) != "BAND(y, 1)" {
+		t.Errorf(expected_but_got_for_expr, "BAND(y, 1)", err, "TWICE(y) + BAND(y, 1) * x")
+	}
+}
+
+func TestSolve(t *testing.T) {
+
+	parser := expr.NewParser()
+	tests := []struct {
+		input          string
+		target, lo, hi float64
+		expect         float64
+	}{
+		{input: "x ** 2", target: 2, lo: 0, hi: 2, expect: math.Sqrt2},
+		{input: "x * 3 + 1", target: 100, lo: -1e300, hi: 1e300, expect: 33},
+		{input: "COS(x) - x", target: 0, lo: 1, hi: 0, expect: 0.7390851332151607},
+		{input: "EXP(x)", target: 1e-300, lo: -1000, hi: 10, expect: math.Log(1e-300)},
+		{input: "(x - 1) ** 2 - 0.25", target: 0, lo: 0.2, hi: 2, expect: 0.5}, // not bracketed, so by Newton's method
+		{input: "x ** 2", target: 0, lo: -1, hi: 1, expect: 0},                 // a root it only touches, which Newton's method nears slowly
+		{input: "(x - 0.3) ** 2", target: 0, lo: -1, hi: 1, expect: 0.3},
+		{input: "x ** 4", target: 0, lo: -2, hi: 3, expect: 0},
+		{input: "SQR(x)", target: 2, lo: -1, hi: 10, expect: 4}, // not a number below 0
+	}
+
+	for _, tc := range tests {
+		res, err := parser.Solve(tc.input, tc.target, "x", tc.lo, tc.hi)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+		} else if math.Abs(res-tc.expect) > 1e-12*math.Max(1, math.Abs(tc.expect)) {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	// Other variables are resolved through the environment
+	prog, err := parser.Compile("rate * %P + fee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := prog.Solve(100, "%P", 0, 1000, expr.Vars{"rate": 4, "fee": 20}); err != nil || res != 20 {
+		t.Errorf(expected_but_got_for_expr, 20, res, "rate * %P + fee")
+	}
+
+	prog, err = parser.Compile("SIN(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := prog.Roots(0, "x", -1, 10, nil)
+	if err != nil || len(roots) != 4 {
+		t.Fatalf(expected_but_got_for_expr, "4 roots", roots, "SIN(x)")
+	}
+	for ix, root := range roots {
+		if math.Abs(root-float64(ix)*math.Pi) > 1e-12 {
+			t.Errorf(expected_but_got_for_expr, float64(ix)*math.Pi, root, "SIN(x)")
+		}
+	}
+
+	for input, expect := range map[string]error{
+		"x ** 2 + 1":        expr.ErrNoConvergence,
+		"BAND(x, 1)":        expr.ErrNoConvergence,
+		"1 / (x - 0.1) + 5": expr.ErrNoConvergence, // a pole, where it changes sign without crossing 5
+		"SQR(x - 1)":        expr.ErrNoConvergence,
+		"1 / x + 5":         expr.ErrNoConvergence, // a pole at 0, which Brent's method lands on
+		"x + y":             expr.ErrUndefinedVariable,
+		"1 / (x + 1)":       expr.ErrDivideByZero, // at a bound
+	} {
+		if _, err := parser.Solve(input, 5, "x", -1, 1); !errors.Is(err, expect) {
+			t.Errorf(expected_but_got_for_expr, expect, err, input)
+		}
+	}
+
+	// The error hit between the bounds is kept
+	if _, err := parser.Solve("1 / x + 5", 5, "x", -1, 1); !errors.Is(err, expr.ErrDivideByZero) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrDivideByZero, err, "1 / x + 5")
+	}
+}
+
+func TestCompile(t *testing.T) {
+
+	parser := expr.NewParser()
+	prog, err := parser.Compile("BAND(-(%P + 5) / 2, (%P * 5) / 5) + offset")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err.Error(), "compile")
+	}
+
+	tests := []struct {
+		variable float64
+		offset   float64
+		expect   float64
+	}{
+		{variable: 7, offset: 0, expect: 2},
+		{variable: 7, offset: 4, expect: 6},
+		{variable: 5, offset: -1, expect: 0},
+		{variable: 1, offset: 0, expect: 1},
+	}
+
+	var res float64
+	for _, tc := range tests {
+
+		res, err = prog.Eval(expr.Vars{"%P": tc.variable, "offset": tc.offset})
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc)
+		}
+
+		if tc.expect != res {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc)
+		}
+	}
+
+	if _, err = prog.EvalV(7); err == nil {
+		t.Errorf(expected_but_got_for_expr, "undefined variable error", nil, "offset")
+	}
+
+	if _, err = parser.Compile("SHL(,)"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "syntax error", nil, "SHL(,)")
+	}
+
+	// BAND once truncated the float (%P * 5) / 2
+	prog, err = parser.Compile("BAND(-(%P + 5) / 2, (%P * 5) / 2) + offset")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err.Error(), "compile")
+	}
+
+	if _, err = prog.Eval(expr.Vars{"%P": 7, "offset": 0}); !errors.Is(err, expr.ErrTypeMismatch) {
+		t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, prog)
+	}
+}
+
+func TestConcurrentEval(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		variable float64
+		expect   float64
+	}{
+		{input: "2 + %P * 4", variable: 3, expect: 14},
+		{input: "BAND(-(%P + 5) / 2, (%P * 5) / 5)", variable: 7, expect: 2},
+		{input: "BAND(-(7+%P)/2, BANDNOT(-(7*%P)/%P,%P))", variable: 5, expect: -8},
+		{input: "SHL(BAND(CEIL(BAND(CEIL(249.50), 15)), BAND(CEIL(219.50), %P)), 4)", variable: 10, expect: 128},
+	}
+
+	parser := expr.NewParser()
+	prog, err := parser.Compile("MAX(%P, %P * 3) - 1")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err.Error(), "compile")
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				tc := tests[(worker+i)%len(tests)]
+				res, err := parser.EvalV(tc.input, tc.variable)
+				if err != nil || res != tc.expect {
+					t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+					return
+				}
+
+				// BAND once truncated the float (%P * 5) / 2
+				if _, err = parser.EvalV("BAND(-(%P + 5) / 2, (%P * 5) / 2)", 7); !errors.Is(err, expr.ErrTypeMismatch) {
+					t.Errorf(expected_but_got_for_expr, expr.ErrTypeMismatch, err, "BAND(-(%P + 5) / 2, (%P * 5) / 2)")
+					return
+				}
+
+				variable := float64(worker + i)
+				res, err = prog.EvalV(variable)
+				if err != nil || res != variable*3-1 {
+					t.Errorf(expected_but_got_for_expr, variable*3-1, res, "MAX(%P, %P * 3) - 1")
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func TestEvalArgCount(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "ABS(1, 2)", expect: "Expected 1 argument(s) for function 'ABS', but got 2"},
+		{input: "IF(1, 2)", expect: "Expected 3 argument(s) for function 'IF', but got 2"},
+		{input: "SUM(1, 2) + ABS()", expect: "Expected 1 argument(s) for function 'ABS', but got 0"},
+		{input: "SUM()", expect: "Expected at least 1 argument(s) for function 'SUM', but got 0"},
+		{input: "MEDIAN()", expect: "Expected at least 1 argument(s) for function 'MEDIAN', but got 0"},
+	}
+
+	parser := expr.NewParser()
+	for _, tc := range tests {
+
+		_, err := parser.Eval(tc.input)
+		if err == nil || err.Error() != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+		}
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+
+	parser := expr.NewParser()
+	mustRegister := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustRegister(parser.RegisterFunc("HYPOT", 2, func(args ...float64) (float64, error) {
+		return math.Hypot(args[0], args[1]), nil
+	}))
+
+	mustRegister(parser.RegisterFunc("GEOMEAN", expr.Variadic, func(args ...float64) (float64, error) {
+		res := 1.0
+		for _, arg := range args {
+			res *= arg
+		}
+		return math.Pow(res, 1/float64(len(args))), nil
+	}))
+
+	mustRegister(parser.RegisterFunc("FAIL", 1, func(args ...float64) (float64, error) {
+		return 0, errors.New("failed")
+	}))
+
+	// Returns the first argument that evaluates without error
+	mustRegister(parser.RegisterLazyFunc("FIRSTOK", expr.Variadic, func(args ...expr.Thunk) (float64, error) {
+		var err error
+		for _, arg := range args {
+			var res float64
+			if res, err = arg(); err == nil {
+				return res, nil
+			}
+		}
+		return 0, err
+	}))
+
+	tests := []struct {
+		input  string
+		expect float64
+	}{
+		{input: "HYPOT(3, 4)", expect: 5},
+		{input: "HYPOT(3, 4) * 2 - 1", expect: 9},
+		{input: "GEOMEAN(2, 8)", expect: 4},
+		{input: "GEOMEAN(HYPOT(6, 8))", expect: 10},
+		{input: "FIRSTOK(1 / 0, FAIL(1), 7)", expect: 7},
+		{input: "IFERROR(FAIL(1), 3)", expect: 3},
+	}
+
+	for _, tc := range tests {
+
+		res, err := parser.Eval(tc.input)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err.Error(), tc.input)
+		}
+
+		if tc.expect != res {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+	}
+
+	if _, err := parser.Eval("FAIL(2)"); err == nil || err.Error() != "failed" || !errors.Is(err, expr.ErrFunctionFailed) {
+		t.Errorf(expected_but_got_for_expr, "failed", err, "FAIL(2)")
+	}
+
+	if _, err := parser.Eval("HYPOT(3)"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "argument count error", nil, "HYPOT(3)")
+	}
+
+	// Functions may keep their arguments, which later calls do not overwrite
+	var kept [][]float64
+	mustRegister(parser.RegisterFunc("KEEP", expr.Variadic, func(args ...float64) (float64, error) {
+		kept = append(kept, args)
+		return 0, nil
+	}))
+
+	prog, err := parser.Compile("KEEP(x, 2) + KEEP(x + 1, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog.Eval(expr.Vars{"x": 1})
+	prog.Eval(expr.Vars{"x": 5})
+	if expect := [][]float64{{1, 2}, {2, 3}, {5, 2}, {6, 3}}; !reflect.DeepEqual(kept, expect) {
+		t.Errorf(expected_but_got_for_expr, expect, kept, "KEEP(x, 2) + KEEP(x + 1, 3)")
+	}
+
+	// Functions are scoped to the parser they were registered on
+	if _, err := expr.NewParser().Eval("HYPOT(3, 4)"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "unknown function error", nil, "HYPOT(3, 4)")
+	}
+
+	// Builtins and existing registrations are only replaced when overriding
+	double := func(args ...float64) (float64, error) { return args[0] * 2, nil }
+	if err := parser.RegisterFunc("ABS", 1, double); err == nil {
+		t.Errorf(expected_but_got_for_expr, "already defined error", nil, "ABS")
+	}
+
+	if err := parser.RegisterFunc("HYPOT", 1, double); err == nil {
+		t.Errorf(expected_but_got_for_expr, "already defined error", nil, "HYPOT")
+	}
+
+	prog, err = parser.Compile("ABS(-2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustRegister(parser.RegisterFunc("ABS", 1, double, expr.Override()))
+	if res, _ := parser.Eval("ABS(-2)"); res != -4 {
+		t.Errorf(expected_but_got_for_expr, -4, res, "ABS(-2)")
+	}
+
+	if res, _ := prog.Eval(nil); res != 2 {
+		t.Errorf(expected_but_got_for_expr, 2, res, "ABS(-2) compiled before override")
+	}
+
+	if res, _ := expr.NewParser().Eval("ABS(-2)"); res != 2 {
+		t.Errorf(expected_but_got_for_expr, 2, res, "ABS(-2) on a new parser")
+	}
+
+	for _, name := range []string{"", "2X", "MY FN", "F-1", "F(", "F%P", "ÉCART", "F²"} {
+		if err := parser.RegisterFunc(name, 1, double); err == nil {
+			t.Errorf(expected_but_got_for_expr, "invalid name error", nil, name)
+		}
+	}
+
+	if err := parser.RegisterFunc("NOARGS", 0, double); err == nil {
+		t.Errorf(expected_but_got_for_expr, "invalid arity error", nil, "NOARGS")
+	}
+}
+
+func TestEvalSyntaxErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+	}{
+		{input: "ABS(0ABS(0))"},
+		{input: "."},
+		{input: "1..2"},
+		{input: "1e"},
+		{input: "1e+"},
+		{input: "0x"},
+		{input: "0b102"},
+		{input: "0o8"},
+		{input: "0x1p2"},
+		{input: "1__000"},
+		{input: "1_"},
+		{input: "2x"},
+		{input: "1e400"},
+		{input: "ABS(0,0)"},
+		{input: "Abs(0)"},
+		{input: ",,"},
+		{input: "(,,)"},
+		{input: "(),,"},
+		{input: ","},
+		{input: "()"},
+		{input: "((0)"},
+		{input: "(,"},
+		{input: ").(x"},
+		{input: "ABS(0) * 2,,0"},
+		{input: "SHL(,)"},
+		{input: "SHL(0,,0)"},
+		{input: "AND(-+)"},
+		{input: "A(0)"},
+		{input: "(4)*/28"},
+		{input: "<(0)>"},
+		{input: "SHL((2+2/))"},
+		{input: "(ABS(2)) * (0))"},
+		{input: "speed(2)"},
+		{input: "1 = 2"},
+		{input: "1 === 1"},
+		{input: "1 ==="},
+		{input: "1 <"},
+		{input: "&& 1"},
+		{input: "1,2"},
+		{input: "(1,2) + 1"},
+		{input: "2 ***"},
+		{input: "%"},
+		{input: "10%P"},
+		{input: "2 3"},
+		{input: "1 ? 2"},
+		{input: "1 ? : 2"},
+		{input: "1 ? 2 :"},
+		{input: "? 1 : 2"},
+		{input: "IF(1, 2)"},
+	}
+
+	parser := expr.NewParser()
+	var err error
+
+	for _, tc := range tests {
+
+		_, err = parser.Eval(tc.input)
+		if _, ok := err.(expr.SyntaxError); !ok {
+			// Not convertible to syntax error
+			t.Errorf(expected_but_got_for_expr, "registered syntax error", err, tc.input)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		code   expr.ErrorCode
+		offset int
+		end    int
+		line   int
+		column int
+	}{
+		// Parse errors
+		{input: "2 + $", code: expr.ErrInvalidChar, offset: 4, end: 5, line: 1, column: 5},
+		{input: "1.2.3 + 1", code: expr.ErrInvalidNumber, offset: 0, end: 5, line: 1, column: 1},
+		{input: "2 * 0b102 + 1", code: expr.ErrInvalidNumber, offset: 4, end: 9, line: 1, column: 5},
+		{input: "1 + 1e-", code: expr.ErrInvalidNumber, offset: 4, end: 7, line: 1, column: 5},
+		{input: "(1 + 2))", code: expr.ErrUnbalancedParens, offset: 7, end: 8, line: 1, column: 8},
+		{input: "(1 + 2", code: expr.ErrUnexpectedEnd, offset: 6, end: 6, line: 1, column: 7},
+		{input: "1 +\n  * 2", code: expr.ErrUnexpectedTerm, offset: 6, end: 7, line: 2, column: 3},
+		{input: "1 +\n2 3", code: expr.ErrUnexpectedTerm, offset: 6, end: 7, line: 2, column: 3},
+		{input: "1 + Abs(2)", code: expr.ErrUnknownFunction, offset: 4, end: 7, line: 1, column: 5},
+		{input: "1 + ABS(2, 3)", code: expr.ErrArgCount, offset: 4, end: 13, line: 1, column: 5},
+		{input: "ABS()", code: expr.ErrArgCount, offset: 0, end: 5, line: 1, column: 1},
+		{input: "1 + SUM()", code: expr.ErrArgCount, offset: 4, end: 9, line: 1, column: 5},
+		{input: "PRODUCT()", code: expr.ErrArgCount, offset: 0, end: 9, line: 1, column: 1},
+		{input: "AVG()", code: expr.ErrArgCount, offset: 0, end: 5, line: 1, column: 1},
+		{input: "MEDIAN()", code: expr.ErrArgCount, offset: 0, end: 8, line: 1, column: 1},
+		{input: "STDDEV()", code: expr.ErrArgCount, offset: 0, end: 8, line: 1, column: 1},
+		{input: "COUNT()", code: expr.ErrArgCount, offset: 0, end: 7, line: 1, column: 1},
+		{input: "MIN()", code: expr.ErrArgCount, offset: 0, end: 5, line: 1, column: 1},
+		{input: "MAX()", code: expr.ErrArgCount, offset: 0, end: 5, line: 1, column: 1},
+		{input: "SUM(", code: expr.ErrInvalidFuncArgs, offset: 0, end: 4, line: 1, column: 1},
+		{input: "MAX(1, 2 *)", code: expr.ErrUnexpectedTerm, offset: 9, end: 10, line: 1, column: 10},
+		{input: "1 ? 2", code: expr.ErrUnexpectedEnd, offset: 5, end: 5, line: 1, column: 6},
+		{input: "LEN('abc) + 1", code: expr.ErrInvalidString, offset: 4, end: 13, line: 1, column: 5},
+		{input: "1 + \"a\\qb\"", code: expr.ErrInvalidString, offset: 4, end: 10, line: 1, column: 5},
+		{input: "'a' 'b'", code: expr.ErrUnexpectedTerm, offset: 4, end: 7, line: 1, column: 5},
+
+		// Evaluation errors
+		{input: "(2/(2*0))*20", code: expr.ErrDivideByZero, offset: 1, end: 8, line: 1, column: 2},
+		{input: "AND(m,n)", code: expr.ErrUndefinedVariable, offset: 4, end: 5, line: 1, column: 5},
+		{input: "1 +\n  speed * 2", code: expr.ErrUndefinedVariable, offset: 6, end: 11, line: 2, column: 3},
+		{input: "1 && 1 / 0", code: expr.ErrDivideByZero, offset: 5, end: 10, line: 1, column: 6},
+		{input: "5 % 0", code: expr.ErrDivideByZero, offset: 0, end: 5, line: 1, column: 1},
+		{input: "1 << -1", code: expr.ErrNegativeShift, offset: 0, end: 7, line: 1, column: 1},
+		{input: "2 * SHR(1, -1)", code: expr.ErrNegativeShift, offset: 4, end: 14, line: 1, column: 5},
+		{input: "SHL(1, -1)", code: expr.ErrNegativeShift, offset: 0, end: 10, line: 1, column: 1},
+		{input: "1 >> -1", code: expr.ErrNegativeShift, offset: 0, end: 7, line: 1, column: 1},
+		{input: "IFERROR(1 / 0, (1 / 0))", code: expr.ErrDivideByZero, offset: 16, end: 21, line: 1, column: 17},
+		{input: "BAND(-(7 + 5) / 2, (7 * 5) / 2)", code: expr.ErrTypeMismatch, offset: 0, end: 31, line: 1, column: 1},
+		{input: "1 + 2.5 & 1", code: expr.ErrTypeMismatch, offset: 0, end: 11, line: 1, column: 1},
+		{input: "!(2 == 7) + 1", code: expr.ErrTypeMismatch, offset: 0, end: 13, line: 1, column: 1},
+		{input: "4 & 4 == 4", code: expr.ErrTypeMismatch, offset: 0, end: 10, line: 1, column: 1},
+		{input: "MAX(1 > 0, 5 == 4) + 1", code: expr.ErrTypeMismatch, offset: 0, end: 18, line: 1, column: 1},
+		{input: "-(1 < 2)", code: expr.ErrTypeMismatch, offset: 0, end: 8, line: 1, column: 1},
+		{input: "'abc' + 1", code: expr.ErrTypeMismatch, offset: 0, end: 9, line: 1, column: 1},
+		{input: "LEN(12)", code: expr.ErrTypeMismatch, offset: 0, end: 7, line: 1, column: 1},
+		{input: "1 + SQR('4')", code: expr.ErrTypeMismatch, offset: 4, end: 12, line: 1, column: 5},
+		{input: "'a' * 'b'", code: expr.ErrTypeMismatch, offset: 0, end: 9, line: 1, column: 1},
+		{input: "UPPER('a')", code: expr.ErrTypeMismatch, offset: 0, end: 10, line: 1, column: 1},
+		{input: "ABS(1 < 2)", code: expr.ErrTypeMismatch, offset: 0, end: 10, line: 1, column: 1},
+	}
+
+	parser := expr.NewParser()
+	for _, tc := range tests {
+
+		_, err := parser.Eval(tc.input)
+		if !errors.Is(err, tc.code) {
+			t.Errorf(expected_but_got_for_expr, tc.code, err, tc.input)
+			continue
+		}
+
+		var pos expr.Position
+		var syntaxErr expr.SyntaxError
+		var evalErr expr.EvalError
+
+		switch {
+		case errors.As(err, &syntaxErr):
+			pos = syntaxErr.Position
+			if tc.code >= expr.ErrDivideByZero {
+				t.Errorf(expected_but_got_for_expr, "evaluation error", err, tc.input)
+			}
+
+		case errors.As(err, &evalErr):
+			pos = evalErr.Position
+			if tc.code < expr.ErrDivideByZero {
+				t.Errorf(expected_but_got_for_expr, "syntax error", err, tc.input)
+			}
+		}
+
+		expect := expr.Position{Offset: tc.offset, End: tc.end, Line: tc.line, Column: tc.column}
+		if pos != expect {
+			t.Errorf(expected_but_got_for_expr, expect, pos, tc.input)
+		}
+	}
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+
+	parser := expr.NewParser()
+	for i := 0; i < b.N; i++ {
+		parser.EvalV("BAND(5, 10 * 1000.0)", 10)
+	}
+}
+
+func BenchmarkProgramEval(b *testing.B) {
+
+	prog, err := expr.NewParser().Compile("BAND(5, 10 * 1000.0)")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		prog.EvalV(10)
+	}
+}
+
+func FuzzEval(f *testing.F) {
+
+	testcases := []string{
+		"BAND(-(7+5)/2, BANDNOT(-(7*5)/2,5))",
+		"1985 * 15 / 50.0",
+		"BAND(5,CEIL(CEIL(CEIL(1.5))))",
+		"CEIL(2)",
+		"NOT(1130.0) + ()",
+		"(,",
+		").(x",
+		"AND(-+)",
+		"'9(AND(0, 0)    * X * X / 0",
+		"0-0-0!",
+		"((((059.))))",
+		"!",
+		"OR(0,0) * -(2 * OR(1,1) / AND(0,1) * ((((0))))",
+		`SUBSTR("a\"(b", 1) + 'c\x41' == FORMAT("%d", LEN("\u00e9"))`,
+		`"\`,
+	}
+	for _, tc := range testcases {
+		f.Add(tc)
+	}
+
+	parser := expr.NewParser()
+	f.Fuzz(func(t *testing.T, input string) {
+		parser.Eval(input)
+	})
+}
+
+func TestEvalErrorHints(t *testing.T) {
+
+	parser := expr.NewParser()
+	if err := parser.RegisterFunc("CLAMP", 3, func(args ...float64) (float64, error) {
+		return math.Max(args[1], math.Min(args[0], args[2])), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input string
+		hint  string
+	}{
+		{input: "1 + Abs(2)", hint: "did you mean ABS?"},
+		{input: "SQRT(4)", hint: "did you mean SQR?"},
+		{input: "CLAMPS(1, 2, 3)", hint: "did you mean CLAMP?"},
+		{input: "2 = 3", hint: "did you mean ==?"},
+		{input: "(1 + 2))", hint: "remove this ')' or add a matching '(' before it"},
+		{input: "1 / (2 - 2)", hint: "guard the divisor with IF(...) or IFERROR(...)"},
+		{input: "speed * 2", hint: "provide a value for it when evaluating the expression"},
+		{input: "QWERTY(1)", hint: ""},
+		{input: "1 +", hint: ""},
+	}
+
+	for _, tc := range tests {
+
+		_, err := parser.Eval(tc.input)
+		if err == nil {
+			t.Errorf(expected_but_got_for_expr, "an error", nil, tc.input)
+			continue
+		}
+
+		var hint string
+		var syntaxErr expr.SyntaxError
+		var evalErr expr.EvalError
+
+		switch {
+		case errors.As(err, &syntaxErr):
+			hint = syntaxErr.Hint
+		case errors.As(err, &evalErr):
+			hint = evalErr.Hint
+		}
+
+		if hint != tc.hint {
+			t.Errorf(expected_but_got_for_expr, tc.hint, hint, tc.input)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	parser := expr.NewParser()
+	tests := []struct {
+		input string
+		funcs []string
+		vars  []string
+	}{
+		{input: "1 + 2", funcs: nil, vars: nil},
+		{input: "speed * time + offset", funcs: nil, vars: []string{"offset", "speed", "time"}},
+		{input: "MAX(a, ABS(-b), 3) > limit ? SQR(a) : %P", funcs: []string{"ABS", "MAX", "SQR"}, vars: []string{"%P", "a", "b", "limit"}},
+		{input: "IF(x, SUM(x, x), 0)", funcs: []string{"IF", "SUM"}, vars: []string{"x"}},
+	}
+
+	for _, tc := range tests {
+
+		root, err := parser.Parse(tc.input)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, nil, err, tc.input)
+			continue
+		}
+
+		funcs, vars := map[string]bool{}, map[string]bool{}
+		ast.Inspect(root, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.CallExpr:
+				funcs[n.Func] = true
+			case *ast.Ident:
+				vars[n.Name] = true
+			}
+			return true
+		})
+
+		if got := sortedKeys(funcs); !reflect.DeepEqual(got, tc.funcs) {
+			t.Errorf(expected_but_got_for_expr, tc.funcs, got, tc.input)
+		}
+
+		if got := sortedKeys(vars); !reflect.DeepEqual(got, tc.vars) {
+			t.Errorf(expected_but_got_for_expr, tc.vars, got, tc.input)
+		}
+	}
+
+	root, err := parser.Parse("1 + -2 * x")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "1 + -2 * x")
+	}
+
+	expect := &ast.BinaryExpr{Span: ast.Span{Start: 0, Stop: 10}, Op: ast.Add,
+		X: &ast.Number{Span: ast.Span{Start: 0, Stop: 1}, Value: 1, Lit: "1"},
+		Y: &ast.BinaryExpr{Span: ast.Span{Start: 4, Stop: 10}, Op: ast.Mul,
+			X: &ast.UnaryExpr{Span: ast.Span{Start: 4, Stop: 6}, Op: ast.Neg, X: &ast.Number{Span: ast.Span{Start: 5, Stop: 6}, Value: 2, Lit: "2"}},
+			Y: &ast.Ident{Span: ast.Span{Start: 9, Stop: 10}, Name: "x"},
+		},
+	}
+
+	if !reflect.DeepEqual(root, ast.Node(expect)) {
+		t.Errorf(expected_but_got_for_expr, expect, root, "1 + -2 * x")
+	}
+
+	for _, input := range []string{"1 +", "Abs(1)", "(1, 2)"} {
+		if _, err := parser.Parse(input); err == nil {
+			t.Errorf(expected_but_got_for_expr, "syntax error", nil, input)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+
+	parser := expr.NewParser()
+	root, err := parser.Parse("rate * hours + MAX(bonus, 0)")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "parse")
+	}
+
+	// Replace every variable with its value, then double the result.
+	values := map[string]float64{"rate": 20, "hours": 8, "bonus": 15}
+	rewritten := ast.Rewrite(root, func(node ast.Node) ast.Node {
+		if ident, ok := node.(*ast.Ident); ok {
+			return ast.NewNumber(values[ident.Name])
+		}
+		return node
+	})
+	rewritten = &ast.BinaryExpr{Op: ast.Mul, X: rewritten, Y: ast.NewNumber(2)}
+
+	prog, err := parser.CompileNode(rewritten)
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "compile")
+	}
+
+	res, err := prog.Eval(nil)
+	if err != nil || res != 350 {
+		t.Errorf(expected_but_got_for_expr, 350, res, "rewritten")
+	}
+
+	// The original tree is left untouched and still compiles with its variables.
+	prog, err = parser.CompileNode(root)
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "compile")
+	}
+
+	if res, err = prog.Eval(expr.Vars{"rate": 10, "hours": 2, "bonus": -1}); err != nil || res != 20 {
+		t.Errorf(expected_but_got_for_expr, 20, res, "original")
+	}
+
+	invalid := []ast.Node{
+		&ast.CallExpr{Func: "NOPE", Args: []ast.Node{ast.NewNumber(1)}},
+		&ast.CallExpr{Func: "ABS", Args: []ast.Node{ast.NewNumber(1), ast.NewNumber(2)}},
+		&ast.BinaryExpr{Op: ast.Neg, X: ast.NewNumber(1), Y: ast.NewNumber(2)},
+	}
+
+	for _, node := range invalid {
+		if _, err := parser.CompileNode(node); err == nil {
+			t.Errorf(expected_but_got_for_expr, "syntax error", nil, node)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	parser := expr.NewParser()
+	root, err := parser.Parse("a > 0 ? -a : MIN(a, 1)")
+	if err != nil {
+		t.Fatalf(expected_but_got_for_expr, nil, err, "parse")
+	}
+
+	var order []string
+	ast.Inspect(root, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.CondExpr:
+			order = append(order, "?:")
+		case *ast.BinaryExpr:
+			order = append(order, n.Op.String())
+		case *ast.UnaryExpr:
+			order = append(order, "neg")
+		case *ast.CallExpr:
+			order = append(order, n.Func)
+			return false // skip the arguments
+		case *ast.Ident:
+			order = append(order, n.Name)
+		case *ast.Number:
+			order = append(order, n.String())
+		}
+		return true
+	})
+
+	expect := []string{"?:", ">", "a", "0", "neg", "a", "MIN"}
+	if !reflect.DeepEqual(order, expect) {
+		t.Errorf(expected_but_got_for_expr, expect, order, "a > 0 ? -a : MIN(a, 1)")
+	}
+}
+
+func TestFormat(t *testing.T) {
+
+	parser := expr.NewParser()
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "abs( -3 )+max(1,2 ,3)*(4)", expect: "ABS(-3) + MAX(1, 2, 3) * 4"},
+		{input: "(1+2)*3 - (4-5) - (6 - (7-8))", expect: "(1 + 2) * 3 - (4 - 5) - (6 - (7 - 8))"},
+		{input: "((a))", expect: "a"},
+		{input: "a?b:c?d:e", expect: "a ? b : c ? d : e"},
+		{input: "(a?b:c)?d:e", expect: "(a ? b : c) ? d : e"},
+		{input: "1 + (a ? b : c)", expect: "1 + (a ? b : c)"},
+		{input: "2**3**2", expect: "2 ** 3 ** 2"},
+		{input: "(2**3)**2", expect: "(2 ** 3) ** 2"},
+		{input: "-2**2", expect: "-2 ** 2"},
+		{input: "(-2)**2", expect: "(-2) ** 2"},
+		{input: "2**-1", expect: "2 ** -1"},
+		{input: "-(-x)", expect: "- -x"},
+		{input: "!(a&&b)||c", expect: "!(a && b) || c"},
+		{input: "a|b^c&d", expect: "a | b ^ c & d"},
+		{input: "(a|b)^(c&d)", expect: "(a | b) ^ c & d"},
+		{input: "1<<2+3", expect: "1 << 2 + 3"},
+		{input: "(1<<2)+3", expect: "(1 << 2) + 3"},
+		{input: "a==b<c", expect: "a == b < c"},
+		{input: "(a==b)<c", expect: "(a == b) < c"},
+		{input: "8/(4/2)", expect: "8 / (4 / 2)"},
+		{input: "%P*2+sqr(%P)", expect: "%P * 2 + SQR(%P)"},
+		{input: "if(x>0,1,iferror(1/x,0))", expect: "IF(x > 0, 1, IFERROR(1 / x, 0))"},
+		{input: "0x1F+1_000*.5-1e-3", expect: "0x1F + 1_000 * .5 - 1e-3"},
+		{input: "len( 'a(b' )+upper(\"x\\ty\")", expect: "LEN('a(b') + UPPER(\"x\\ty\")"},
+	}
+
+	for _, tc := range tests {
+
+		res, err := parser.Format(tc.input)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			continue
+		}
+
+		if res != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, res, tc.input)
+		}
+
+		// Formatting the canonical form again leaves it unchanged
+		if again, err := parser.Format(res); err != nil || again != res {
+			t.Errorf(expected_but_got_for_expr, res, again, res)
+		}
+	}
+
+	for _, input := range []string{"1 +", "absx(1)", "1 = 2"} {
+		if _, err := parser.Format(input); err == nil {
+			t.Errorf(expected_but_got_for_expr, "syntax error", nil, input)
+		}
+	}
+
+	// Synthesized trees are parenthesized by precedence alone
+	node := &ast.BinaryExpr{Op: ast.Pow,
+		X: ast.NewNumber(-1.5),
+		Y: &ast.BinaryExpr{Op: ast.Sub, X: ast.NewNumber(1), Y: &ast.BinaryExpr{Op: ast.Add, X: ast.NewNumber(2), Y: &ast.Ident{Name: "x"}}},
+	}
+
+	if res := ast.Format(node); res != "(-1.5) ** (1 - (2 + x))" {
+		t.Errorf(expected_but_got_for_expr, "(-1.5) ** (1 - (2 + x))", res, "synthesized")
+	}
+
+	prog, err := parser.Compile("MAX( 1,(2) )*3")
+	if err != nil || prog.String() != "MAX(1, 2) * 3" {
+		t.Errorf(expected_but_got_for_expr, "MAX(1, 2) * 3", prog, "program")
+	}
+}
+
+func TestOptimize(t *testing.T) {
+
+	var calls int
+	parser := expr.NewParser()
+	if err := parser.RegisterFunc("TICK", 1, func(args ...float64) (float64, error) {
+		calls++
+		return args[0] + float64(calls), nil
+	}, expr.Impure()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parser.RegisterFunc("TWICE", 1, func(args ...float64) (float64, error) {
+		return args[0] * 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{input: "BAND(5,-(CEIL(CEIL(CEIL(1.5)))))", expect: "4"},
+		{input: "1 + 2 * 3", expect: "7"},
+		{input: "x * 1 + 0", expect: "x"},
+		{input: "-(-x)", expect: "x"},
+		{input: "0 + 1 * (x - y) - 0", expect: "x - y"},
+		{input: "x / 1 + (x + 1) ** 1", expect: "x / 1 + (x + 1) ** 1"},
+		{input: "TWICE(x) * 1 + 0", expect: "TWICE(x)"},
+		{input: "1 * (0 + TWICE(x)) / 1 - 0", expect: "TWICE(x)"},
+		{input: "-(-TWICE(x))", expect: "TWICE(x)"},
+		{input: "- -(-TWICE(x))", expect: "-TWICE(x)"},
+		{input: "(TWICE(x) - 1) ** (3 - 2)", expect: "TWICE(x) - 1"},
+		{input: "(1 < 2) * 1 + 0", expect: "(1 < 2) * 1 + 0"},
+		{input: "x * (2 + 3) + MAX(1, 2)", expect: "x * 5 + 2"},
+		{input: "1 > 0 ? x : y", expect: "x"},
+		{input: "1 < 0 ? x : y + 1 * 2", expect: "y + 2"},
+		{input: "x > 0 ? 1 + 1 : 3", expect: "x > 0 ? 2 : 3"},
+		{input: "IF(1, 2, 3) + SUM(x, 1 + 1)", expect: "2 + SUM(x, 2)"},
+		{input: "TWICE(2) + TICK(1 + 1)", expect: "4.0 + TICK(2)"},
+		{input: "x * 1.0 + (1 < 2 ? x : y) + !(1 > 2)", expect: "x * 1.0 + x + !(1 > 2)"},
+		{input: "7 / 2 + 2 ** 62 * 4 + 6 / 3", expect: "1.8446744073709552e+19"},
+		{input: "x + 1 / 0", expect: "x + 1 / 0"},
+		{input: "IFERROR(1 / 0, 5)", expect: "5"},
+		{input: "name + UPPER('a' + \"b\")", expect: "name + \"AB\""},
+		{input: "LEN('abc') > 2 ? x : y", expect: "x"},
+	}
+
+	for _, tc := range tests {
+
+		prog, err := parser.CompileOptimized(tc.input)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.expect, err, tc.input)
+			continue
+		}
+
+		if prog.String() != tc.expect {
+			t.Errorf(expected_but_got_for_expr, tc.expect, prog, tc.input)
+		}
+	}
+
+	if calls != 0 {
+		t.Errorf(expected_but_got_for_expr, 0, calls, "calls to an impure function while optimizing")
+	}
+
+	// Optimized programs evaluate to the same results, and keep the positions of their errors
+	for _, input := range []string{"x * 1 + 0", "x * (2 + 3) + MAX(1, 2)", "x > 0 ? 1 + 1 : 3", "-(-x) ** (3 - 2)"} {
+		for _, x := range []float64{-2, 0, 3.5} {
+			expect, _ := parser.EvalEnv(input, expr.Vars{"x": x})
+
+			prog, _ := parser.CompileOptimized(input)
+			if res, err := prog.Eval(expr.Vars{"x": x}); err != nil || res != expect {
+				t.Errorf(expected_but_got_for_expr, expect, res, input)
+			}
+		}
+	}
+
+	prog, _ := parser.CompileOptimized("x +\n 1 / 0")
+	_, err := prog.Eval(expr.Vars{"x": 1})
+
+	var evalErr expr.EvalError
+	if !errors.As(err, &evalErr) || evalErr.Code != expr.ErrDivideByZero || evalErr.Line != 2 || evalErr.Column != 2 {
+		t.Errorf(expected_but_got_for_expr, "division by zero at 2:2", err, "x +\n 1 / 0")
+	}
+
+	if _, err := parser.CompileOptimized("1 +"); err == nil {
+		t.Errorf(expected_but_got_for_expr, "syntax error", nil, "1 +")
+	}
+
+	// Variables are numbers in decimal and integer mode, but may hold quantities or round in the others
+	modes := map[string]expr.ParserOption{"decimal": expr.DecimalMode(0, big.ToNearestEven), "integer": expr.IntegerMode(expr.TruncatedDivision),
+		"units": expr.UnitMode(), "complex": expr.ComplexMode(), "interval": expr.IntervalMode()}
+	for mode, expect := range map[string]string{"decimal": "x", "integer": "x", "units": "- -x * 1", "complex": "- -x * 1", "interval": "- -x * 1"} {
+		if prog, err := expr.NewParser(modes[mode]).CompileOptimized("-(-x) * 1"); err != nil || prog.String() != expect {
+			t.Errorf(expected_but_got_for_expr, expect, prog, "-(-x) * 1 in "+mode+" mode")
+		}
+	}
+}
+
+func TestOptimizeIdentities(t *testing.T) {
+
+	env := expr.Values{"x": expr.IntValue(3), "f": expr.FloatValue(2.5)}
+	tests := []struct {
+		input string
+		units bool
+	}{
+		{input: "x + 0"},
+		{input: "0 + f"},
+		{input: "-(-x) * 1"},
+		{input: "x / 1"},
+		{input: "(x + 1) ** 1 * 1"},
+		{input: "'a' + 0"},
+		{input: "-(-'a')"},
+		{input: "(x < 2) * 1 + 0"},
+		{input: "(1 < 2) * 1 + 0"},
+		{input: "5 m + 0", units: true},
+		{input: "0 + 5 m", units: true},
+		{input: "5 m * 1", units: true},
+		{input: "x * 1 + 0", units: true},
+	}
+
+	for _, tc := range tests {
+
+		parser := expr.NewParser()
+		if tc.units {
+			parser = expr.NewParser(expr.UnitMode())
+		}
+		expect, expectErr := parser.EvalValue(tc.input, env)
+
+		prog, err := parser.CompileOptimized(tc.input)
+		if err != nil {
+			t.Errorf(expected_but_got_for_expr, tc.input, err, tc.input)
+			continue
+		}
+
+		// Identities are only removed where they cannot change the result, or turn an error into one
+		res, err := prog.EvalValue(env)
+		switch {
+		case expectErr != nil && (err == nil || err.Error() != expectErr.Error()):
+			t.Errorf(expected_but_got_for_expr, expectErr, res, tc.input)
+		case expectErr == nil && (err != nil || res.String() != expect.String()):
+			t.Errorf(expected_but_got_for_expr, expect, err, tc.input)
+		}
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
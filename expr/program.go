@@ -0,0 +1,80 @@
+package expr
+
+import "github.com/js10x/expr-evaluator/expr/ast"
+
+// Program is a compiled expression. Its tree and bytecode are never modified after Compile, so
+// evaluating it repeatedly skips lexing and parsing entirely, and it is safe for concurrent use.
+type Program struct {
+	ast      treeNode
+	code     *bytecode
+	src      string
+	decimal  *decimalContext // the context variables are converted to decimals in, when set
+	integer  *integerContext // the context variables are converted to big integers in, when set
+	complex  bool            // whether variables are converted to complex numbers
+	interval bool            // whether variables are converted to intervals
+}
+
+func (p *Parser) newProgram(ast treeNode, src string) *Program {
+	return &Program{
+		ast: ast, code: compile(ast), src: src,
+		decimal: p.decimal, integer: p.integer, complex: p.complex, interval: p.interval,
+	}
+}
+
+// Evaluates the program, resolving any named variables through env. Ints are converted to floats, bools
+// to 1 or 0, and intervals to their midpoint. Programs evaluating to a string fail, as a string has no float value, and so do
+// those evaluating to a complex number with an imaginary part; use EvalValue.
+func (p *Program) Eval(env Resolver) (float64, error) {
+	return p.float(p.EvalValue(env))
+}
+
+// Converts the result of evaluating the program into a float, as Eval does.
+func (p *Program) float(res Value, err error) (float64, error) {
+	if err == nil && res.kind == String {
+		return 0, withLineCol(newEvalError(ErrTypeMismatch, p.ast.pos(), NUMBER_EXPECTED, res.describe()), p.src)
+	}
+	if err == nil && res.kind == Complex && imag(res.c) != 0 {
+		return 0, withLineCol(newEvalError(ErrTypeMismatch, p.ast.pos(), REAL_EXPECTED, res.describe()), p.src)
+	}
+	return res.Float(), err
+}
+
+// Evaluates the program like Eval, but returns the result with its kind, so that 3, 3.0 and true are distinct.
+func (p *Program) EvalValue(env Resolver) (Value, error) {
+
+	if p.decimal != nil && env != nil {
+		env = decimalVars{env, p.decimal}
+	}
+
+	if p.integer != nil && env != nil {
+		env = integerVars{env, p.integer}
+	}
+
+	if p.complex {
+		env = complexVars{env}
+	}
+
+	if p.interval && env != nil {
+		env = intervalVars{env}
+	}
+
+	res, err := p.code.run(env)
+	if err != nil {
+		return Value{}, withLineCol(err, p.src)
+	}
+	return res, nil
+}
+
+// Evaluates the program, substituting variable for every %P identifier.
+func (p *Program) EvalV(variable any) (float64, error) {
+	return p.Eval(placeholderVar{value: variable})
+}
+
+// Returns the canonical text of the program, as produced by ast.Format.
+func (p *Program) String() string {
+	node, err := toAST(p.ast)
+	if err != nil {
+		return p.src
+	}
+	return ast.Format(node)
+}
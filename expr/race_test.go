@@ -0,0 +1,6 @@
+//go:build race
+
+package expr
+
+// The race detector allocates on its own, so tests counting allocations are skipped under it.
+const raceEnabled = true
@@ -0,0 +1,107 @@
+package expr
+
+import "fmt"
+
+// Thunk evaluates a function argument on demand, letting lazy functions skip arguments they do not need.
+type Thunk func() (float64, error)
+
+// FuncOption configures a function registered on a Parser.
+type FuncOption func(*funcConfig)
+
+type funcConfig struct {
+	override bool
+	impure   bool
+}
+
+// Override allows a registered function to replace a builtin or a previously registered function of the same name.
+func Override() FuncOption {
+	return func(c *funcConfig) { c.override = true }
+}
+
+// Impure marks a registered function whose result may differ between calls with the same arguments,
+// such as one reading a clock or a random source, so that the optimizer never folds calls to it.
+func Impure() FuncOption {
+	return func(c *funcConfig) { c.impure = true }
+}
+
+// RegisterFunc adds a function to this parser only. Its arguments are evaluated before fn is called, and
+// passed in a slice of its own, which fn may keep. The arity is the exact number of arguments, or Variadic to accept one or more. Such functions have no
+// derivative, so Gradient fails when one of their arguments depends on a variable.
+func (p *Parser) RegisterFunc(name string, arity int, fn func(args ...float64) (float64, error), opts ...FuncOption) error {
+	eval := func(args ...float64) (float64, error) {
+		return fn(append([]float64(nil), args...)...) // args is the program's scratch space, reused by the next call
+	}
+
+	return p.register(name, arity, &fncDescriptor{eval: eval, dual: func(params ...dual) (Value, error) {
+		return Value{}, newEvalError(ErrNotDifferentiable, span{}, NOT_DIFFERENTIABLE, name)
+	}}, opts)
+}
+
+// RegisterLazyFunc adds a function to this parser only. Its arguments are passed unevaluated, so fn decides
+// which of them to evaluate and when. Such functions have no derivative, so Gradient fails when an argument
+// they evaluate depends on a variable.
+func (p *Parser) RegisterLazyFunc(name string, arity int, fn func(args ...Thunk) (float64, error), opts ...FuncOption) error {
+	return p.register(name, arity, &fncDescriptor{invoke: func(args []treeNode, env Resolver) (Value, error) {
+		differentiated := false
+		thunks := make([]Thunk, len(args))
+		for ix, arg := range args {
+			arg := arg
+			thunks[ix] = func() (float64, error) {
+				res, err := evalNode(arg, env)
+				differentiated = differentiated || res.kind == dualKind
+				return res.Float(), err
+			}
+		}
+
+		res, err := fn(thunks...)
+		if differentiated {
+			return Value{}, newEvalError(ErrNotDifferentiable, span{}, NOT_DIFFERENTIABLE, name)
+		}
+		return FloatValue(res), err
+	}}, opts)
+}
+
+func (p *Parser) register(name string, arity int, desc *fncDescriptor, opts []FuncOption) error {
+	var cfg funcConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if !isFuncName(name) {
+		return fmt.Errorf(INVALID_FNC_NAME, name)
+	}
+
+	desc.args, desc.impure = arity, cfg.impure
+	switch {
+	case arity == Variadic:
+		desc.args, desc.maxArgs = 1, Variadic
+	case arity < 1:
+		return fmt.Errorf(INVALID_FNC_ARITY, arity, name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, builtin := funcTable[name]
+	_, registered := p.funcs[name]
+	if (builtin || registered) && !cfg.override {
+		return fmt.Errorf(FNC_ALREADY_DEFINED, name)
+	}
+
+	p.funcs[name] = desc
+	return nil
+}
+
+// Reports whether name would be read as a single function name by the tokenizer.
+func isFuncName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for ix, ch := range name {
+		if isInvalidChar(ch) || !(isLetter(ch) || (ix > 0 && isDigit(ch))) {
+			return false
+		}
+	}
+	return true
+}
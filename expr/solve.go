@@ -0,0 +1,302 @@
+package expr
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	solveIterations = 5000 // the most evaluations Brent's method takes, well beyond the 2100 or so bisection can need
+	newtonSteps     = 1000 // the most steps Newton's method takes, enough for the slow steps toward a touching root
+	rootPieces      = 256  // the number of pieces Roots splits its range into
+)
+
+// Solve returns a value of the variable name between lo and hi at which the input evaluates to target,
+// as Program.Solve does. Other variables are undefined.
+func (p *Parser) Solve(input string, target float64, name string, lo, hi float64) (float64, error) {
+	prog, err := p.Compile(input)
+	if err != nil {
+		return 0, err
+	}
+	return prog.Solve(target, name, lo, hi, nil)
+}
+
+// Solve returns a value of the variable name between lo and hi at which the program evaluates to target,
+// resolving any other variables through env. When the program is above target at one bound and below it at
+// the other, the root between them is found by Brent's method, which always converges. Otherwise Newton's
+// method is tried from the bound closer to target, with derivatives from Gradient. A bound at which the
+// program is not a number, as SQR(x) is below 0, is first moved toward the other in the steps Roots takes
+// until it is one. Failing to find a root either way, or finding a pole where the program changes sign
+// without crossing target, fails with ErrNoConvergence. Errors evaluating the program at the bounds are
+// returned as they are, while those between them, as 1 / x fails at 0, wrap into ErrNoConvergence too.
+func (p *Program) Solve(target float64, name string, lo, hi float64, env Resolver) (float64, error) {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	f := objective{p, target, name, env}
+
+	a, fa, err := f.bound(lo, hi)
+	if err != nil {
+		return 0, err
+	}
+
+	b, fb, err := f.bound(hi, lo)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case fa == 0:
+		return a, nil
+	case fb == 0:
+		return b, nil
+	case fa < 0 != (fb < 0):
+		return f.brent(a, b, fa, fb)
+	}
+
+	start := a
+	if math.Abs(fb) < math.Abs(fa) {
+		start = b
+	}
+
+	root, ok, err := f.newton(start, a, b)
+	if errors.Is(err, ErrNotDifferentiable) || err == nil && !ok {
+		return 0, newEvalError(ErrNoConvergence, span{}, NOT_BRACKETED, target, lo, hi)
+	}
+	return root, err
+}
+
+// Roots returns the values of the variable name between lo and hi at which the program evaluates to target,
+// in increasing order, resolving any other variables through env. The range is split into even pieces, and
+// the root within each piece the program crosses target over is found by Brent's method, so roots where
+// it only touches target, and roots closer together than a piece, may be missed. Pieces that fail to
+// evaluate, or that hold a pole, are skipped. When no piece crosses target, Roots returns the root Solve
+// finds, or its error.
+func (p *Program) Roots(target float64, name string, lo, hi float64, env Resolver) ([]float64, error) {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	f := objective{p, target, name, env}
+
+	var roots []float64
+	a := lo
+	fa, errA := f.at(a)
+	for ix := 1; ix <= rootPieces; ix++ {
+		b := lo + (hi-lo)*float64(ix)/rootPieces
+		fb, errB := f.at(b)
+
+		switch {
+		case errA != nil || errB != nil:
+		case fa == 0:
+			if len(roots) == 0 || roots[len(roots)-1] != a {
+				roots = append(roots, a)
+			}
+		case fb != 0 && fa < 0 != (fb < 0):
+			if root, err := f.brent(a, b, fa, fb); err == nil {
+				roots = append(roots, root)
+			}
+		}
+		a, fa, errA = b, fb, errB
+	}
+	if errA == nil && fa == 0 && (len(roots) == 0 || roots[len(roots)-1] != a) {
+		roots = append(roots, a)
+	}
+
+	if len(roots) > 0 {
+		return roots, nil
+	}
+
+	root, err := p.Solve(target, name, lo, hi, env)
+	if err != nil {
+		return nil, err
+	}
+	return []float64{root}, nil
+}
+
+// The difference between a program and the target it is solved for, as a function of one variable.
+type objective struct {
+	prog   *Program
+	target float64
+	name   string
+	env    Resolver
+}
+
+// Evaluates the difference at x, failing for NaN, which has no sign to bracket a root with.
+func (f objective) at(x float64) (float64, error) {
+	res, err := f.prog.Eval(solveVars{f.env, f.name, x})
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(res) {
+		return 0, newEvalError(ErrNoConvergence, span{}, NOT_A_NUMBER_AT, f.name, x)
+	}
+	return res - f.target, nil
+}
+
+// Evaluates the difference at the bound from, or at the first of the points between it and the bound to,
+// in steps of a piece of the range, at which the difference is a number. Fails as at does at from when
+// there is none.
+func (f objective) bound(from, to float64) (float64, float64, error) {
+	fx, err := f.at(from)
+	if !errors.Is(err, ErrNoConvergence) {
+		return from, fx, err
+	}
+
+	for ix := 1; ix < rootPieces; ix++ {
+		x := from + (to-from)*float64(ix)/rootPieces
+		if fx, next := f.at(x); !errors.Is(next, ErrNoConvergence) {
+			return x, fx, next
+		}
+	}
+	return 0, 0, err
+}
+
+// Evaluates the difference and its derivative at x.
+func (f objective) slope(x float64) (float64, float64, error) {
+	res, partials, err := f.prog.Gradient(solveVars{f.env, f.name, x})
+	if err != nil {
+		return 0, 0, err
+	}
+	return res - f.target, partials[f.name], nil
+}
+
+// Finds the root between a and b, at which the difference is fa and fb of opposite signs, by Brent's method:
+// inverse quadratic interpolation or the secant method where they make progress, and bisection where they
+// do not, until the bracket is as narrow as floats allow.
+func (f objective) brent(a, b, fa, fb float64) (float64, error) {
+	ends := math.Min(math.Abs(fa), math.Abs(fb))
+	c, fc := b, fb
+	var d, e float64
+	for ix := 0; ix < solveIterations; ix++ {
+		if fb < 0 == (fc < 0) {
+			c, fc = a, fa
+			d = b - a
+			e = d
+		}
+		if math.Abs(fc) < math.Abs(fb) {
+			a, b, c = b, c, b
+			fa, fb, fc = fb, fc, fb
+		}
+
+		tol := 2*epsilon*math.Abs(b) + math.SmallestNonzeroFloat64
+		mid := (c - b) / 2
+		if math.Abs(mid) <= tol || fb == 0 {
+			// A sign change the difference does not shrink across is a pole rather than a root
+			if math.Abs(fb) > ends {
+				return 0, newEvalError(ErrNoConvergence, span{}, POLE_AT, f.name, b, f.target)
+			}
+			return b, nil
+		}
+
+		if math.Abs(e) >= tol && math.Abs(fa) > math.Abs(fb) {
+			var p, q float64
+			s := fb / fa
+			if a == c {
+				p, q = 2*mid*s, 1-s // secant
+			} else {
+				q, r := fa/fc, fb/fc // inverse quadratic
+				p = s * (2*mid*q*(q-r) - (b-a)*(r-1))
+				q = (q - 1) * (r - 1) * (s - 1)
+			}
+			if p > 0 {
+				q = -q
+			}
+			p = math.Abs(p)
+
+			if 2*p < math.Min(3*mid*q-math.Abs(tol*q), math.Abs(e*q)) {
+				e, d = d, p/q
+			} else {
+				d, e = mid, mid
+			}
+		} else {
+			d, e = mid, mid
+		}
+
+		a, fa = b, fb
+		if math.Abs(d) > tol {
+			b += d
+		} else {
+			b += math.Copysign(tol, mid)
+		}
+
+		var err error
+		if fb, err = f.at(b); err != nil {
+			return 0, f.failedAt(b, err)
+		}
+	}
+	return 0, newEvalError(ErrNoConvergence, span{}, NO_CONVERGENCE, solveIterations)
+}
+
+// Finds a root by Newton's method from x, reporting false when a step leaves [lo, hi], the derivative is
+// zero or the steps do not settle. The steps settle once they are within rounding of x, or of the width of
+// the range, as they do near a root the program only touches, such as 0 for x ** 2, where each step only
+// halves the distance to it. A difference within rounding of target is a root as well.
+func (f objective) newton(x, lo, hi float64) (float64, bool, error) {
+	tol := 4 * epsilon * (hi - lo)
+	for ix := 0; ix < newtonSteps; ix++ {
+		fx, dx, err := f.slope(x)
+		switch {
+		case err != nil:
+			return 0, false, f.failedAt(x, err)
+		case math.Abs(fx) <= 4*epsilon*math.Abs(f.target):
+			return x, true, nil
+		case dx == 0 || math.IsNaN(dx) || math.IsInf(dx, 0):
+			return 0, false, nil
+		}
+
+		next := x - fx/dx
+		switch {
+		case !(next >= lo && next <= hi):
+			return 0, false, nil
+		case math.Abs(next-x) <= 4*epsilon*math.Abs(next):
+			return next, true, nil
+		case math.Abs(next-x) <= tol:
+			// Steps this small are also taken toward a pole, where the difference grows rather than shrinks
+			fnext, err := f.at(next)
+			if err != nil {
+				return 0, false, f.failedAt(next, err)
+			}
+			return next, math.Abs(fnext) <= math.Abs(fx), nil
+		}
+		x = next
+	}
+	return 0, false, nil
+}
+
+// Wraps an error evaluating the program at x between the bounds, such as dividing by zero at a pole, as a
+// failure of the method that stepped onto x to converge. Functions without a derivative are left to Solve.
+func (f objective) failedAt(x float64, err error) error {
+	if errors.Is(err, ErrNoConvergence) || errors.Is(err, ErrNotDifferentiable) {
+		return err
+	}
+
+	failed := newEvalError(ErrNoConvergence, span{}, FAILED_AT, f.name, x, err)
+	failed.err = err
+	return failed
+}
+
+// The gap between 1 and the next float.
+const epsilon = 0x1p-52
+
+// Resolves the variable being solved for to x, and any other through env.
+type solveVars struct {
+	env  Resolver
+	name string
+	x    float64
+}
+
+func (v solveVars) Resolve(name string) (float64, bool) {
+	value, ok := v.ResolveValue(name)
+	return value.Float(), ok
+}
+
+func (v solveVars) ResolveValue(name string) (Value, bool) {
+	switch {
+	case name == v.name:
+		return FloatValue(v.x), true
+	case v.env == nil:
+		return Value{}, false
+	}
+	return resolve(v.env, name)
+}
@@ -1,10 +1,5 @@
 package expr
 
-import (
-	"unicode"
-	"unicode/utf8"
-)
-
 type tokenType int
 
 const (
@@ -15,8 +10,28 @@ const (
 	divide
 	add
 	comma
-	id
+	eq
+	neq
+	lt
+	lte
+	gt
+	gte
+	land
+	lor
+	lnot
+	pow
+	mod
+	band
+	bor
+	bxor
+	bnot
+	shl
+	shr
+	question
+	colon
+	named
 	num
+	str
 	fnc
 )
 
@@ -28,6 +43,29 @@ var opTable = map[rune]*token{
 	'/': {typeof: divide, lexeme: '/'},
 	'+': {typeof: add, lexeme: '+'},
 	',': {typeof: comma, lexeme: ','},
+	'<': {typeof: lt, lexeme: '<'},
+	'>': {typeof: gt, lexeme: '>'},
+	'!': {typeof: lnot, lexeme: '!'},
+	'%': {typeof: mod, lexeme: '%'},
+	'&': {typeof: band, lexeme: '&'},
+	'|': {typeof: bor, lexeme: '|'},
+	'^': {typeof: bxor, lexeme: '^'},
+	'~': {typeof: bnot, lexeme: '~'},
+	'?': {typeof: question, lexeme: '?'},
+	':': {typeof: colon, lexeme: ':'},
+}
+
+// Operators spanning two characters, matched before opTable.
+var compoundOpTable = map[string]*token{
+	"==": {typeof: eq, lexeme: "=="},
+	"!=": {typeof: neq, lexeme: "!="},
+	"<=": {typeof: lte, lexeme: "<="},
+	">=": {typeof: gte, lexeme: ">="},
+	"&&": {typeof: land, lexeme: "&&"},
+	"||": {typeof: lor, lexeme: "||"},
+	"**": {typeof: pow, lexeme: "**"},
+	"<<": {typeof: shl, lexeme: "<<"},
+	">>": {typeof: shr, lexeme: ">>"},
 }
 
 func isLeftParen(ch rune) bool {
@@ -46,16 +84,34 @@ func isPercentSign(ch rune) bool {
 	return (ch - '%') == 0
 }
 
+func isQuote(ch rune) bool {
+	return (ch-'"') == 0 || (ch-'\'') == 0
+}
+
 func isPeriod(ch rune) bool {
 	return (ch - '.') == 0
 }
 
+// Reports whether ch follows a leading 0 to select a hex, octal or binary integer literal.
+func isIntPrefix(ch rune) bool {
+	switch lower(ch) {
+	case 'x', 'o', 'b':
+		return true
+	}
+	return false
+}
+
+// Reports whether ch is only valid as part of a compound operator such as '==' or '!='.
+func isCompoundOpOnly(ch rune) bool {
+	return (ch - '=') == 0
+}
+
 func isLetter(ch rune) bool {
-	return 'a' <= lower(ch) && lower(ch) <= 'z' || ch == '_' || ch >= utf8.RuneSelf && unicode.IsLetter(ch)
+	return 'a' <= lower(ch) && lower(ch) <= 'z' || ch == '_'
 }
 
 func isDigit(ch rune) bool {
-	return isDecimal(ch) || ch >= utf8.RuneSelf && unicode.IsDigit(ch)
+	return isDecimal(ch)
 }
 
 func lower(ch rune) rune {
@@ -69,26 +125,14 @@ func isDecimal(ch rune) bool {
 func isInvalidChar(ch rune) bool {
 	switch {
 	case
-		(ch - '!') == 0,
-		(ch - '"') == 0,
 		(ch - '#') == 0,
 		(ch - '$') == 0,
-		(ch - '&') == 0,
-		(ch - '\'') == 0,
 		(ch - '[') == 0,
 		(ch - ']') == 0,
-		(ch - ':') == 0,
 		(ch - ';') == 0,
-		(ch - '<') == 0,
-		(ch - '>') == 0,
-		(ch - '=') == 0,
-		(ch - '^') == 0,
-		(ch - '_') == 0,
 		(ch - '`') == 0,
 		(ch - '{') == 0,
-		(ch - '|') == 0,
 		(ch - '}') == 0,
-		(ch - '~') == 0,
 		int(ch) >= 128:
 		return true
 	}
@@ -1,19 +1,40 @@
 package expr
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type token struct {
 	typeof tokenType
 	lexeme any
+	at     span
+}
+
+// Renders the token as it appeared in the input.
+func (t *token) String() string {
+	if ch, ok := t.lexeme.(rune); ok {
+		return string(ch)
+	}
+	return fmt.Sprint(t.lexeme)
 }
 
 type scanner struct {
-	offset int
-	src    []*token
+	offset   int
+	src      []*token
+	end      int                                      // the length of the input, where end of expression errors point
+	input    string                                   // the input being scanned
+	funcs    func(name string) (*fncDescriptor, bool) // resolves function names for the current parser
+	decimal  *decimalContext                          // parses numbers as decimals when set
+	integer  *integerContext                          // parses integers as big integers when set
+	complex  bool                                     // parses numbers as complex numbers, and i as the imaginary unit, when set
+	units    bool                                     // parses a unit following a number as part of it when set
+	interval bool                                     // parses numbers as the narrowest interval around them when set
 }
 
 func newScanner() *scanner {
@@ -38,19 +59,42 @@ func (s *scanner) next() *token {
 	return s.src[s.offset]
 }
 
+// Returns the span of the next token, or the end of the input when there are no tokens left.
+func (s *scanner) here() span {
+	if next := s.peek(); next != nil {
+		return next.at
+	}
+	return span{s.end, s.end}
+}
+
+// Returns the span from start to the end of the last token scanned.
+func (s *scanner) from(start int) span {
+	if s.offset < 0 {
+		return span{start, start}
+	}
+	return span{start, s.src[s.offset].at.end}
+}
+
+// Returns the text of the input a token was scanned from.
+func (s *scanner) text(t *token) string {
+	return s.input[t.at.start:t.at.end]
+}
+
 func (s *scanner) reset() {
 	s.offset = -1
 	s.src = s.src[:0]
+	s.input = ""
 }
 
 // Performs lexical analysis, building the list of tokens from the input string.
-func tokenize(input string, sc *scanner, variable any) error {
-	var number, functionName string
+func tokenize(input string, sc *scanner) error {
+	var name string
 	var currentToken *token
 	var isLastRun, ok bool
 	var ch, lookahead rune
 	var parens int
 
+	sc.end, sc.input = len(input), input
 	for idx := 0; idx < len(input); idx++ {
 
 		ch = rune(input[idx])
@@ -61,6 +105,24 @@ func tokenize(input string, sc *scanner, variable any) error {
 			continue
 		}
 
+		// Strings, scanned first so that the parentheses and other characters they contain are just text
+		if isQuote(ch) {
+			size := scanString(input[idx:])
+			if size < 0 {
+				return newSyntaxError(ErrInvalidString, span{idx, len(input)}, UNTERMINATED_STRING, string(ch))
+			}
+
+			at := span{idx, idx + size}
+			value, ok := unquote(input[at.start:at.end])
+			if !ok {
+				return newSyntaxError(ErrInvalidString, at, INVALID_STRING)
+			}
+
+			sc.src = append(sc.src, &token{typeof: str, lexeme: value, at: at})
+			idx = at.end - 1
+			continue
+		}
+
 		if isLeftParen(ch) {
 			parens++
 		}
@@ -69,75 +131,264 @@ func tokenize(input string, sc *scanner, variable any) error {
 			parens--
 		}
 
+		if parens < 0 {
+			return newSyntaxError(ErrUnbalancedParens, span{idx, idx + 1}, UNBAL_PARENS)
+		}
+
 		if isInvalidChar(ch) {
-			return SyntaxError{message: fmt.Sprintf(INVALID_CHAR_FOUND_AT, ch, idx)}
+			ch, size := utf8.DecodeRuneInString(input[idx:])
+			return newSyntaxError(ErrInvalidChar, span{idx, idx + size}, INVALID_CHAR_FOUND_AT, string(ch), idx)
 		}
 
 		switch {
 
-		// Variables/Identifiers
-		case isPercentSign(ch):
-			if isLastRun {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_END_OF_EXPR, "variable")}
-			}
-
-			lookahead = rune(input[idx+1])
-			if !isKeyword(lookahead) {
-				return SyntaxError{message: fmt.Sprintf(UNEXPECTED_END_OF_EXPR, "variable")}
-			}
-
-			currentToken = &token{typeof: id, lexeme: variable}
+		// The %P identifier, any other '%' is the modulo operator
+		case isPercentSign(ch) && isPlaceholder(input[idx+1:]):
+			currentToken = &token{typeof: named, lexeme: placeholder, at: span{idx, idx + 2}}
 			sc.src = append(sc.src, currentToken)
 			idx++
 			continue
 
-		// Functions
-		case isLetter(ch):
-			functionName += string(ch)
+		// Functions and named variables
+		case isLetter(ch) || (len(name) > 0 && isDigit(ch)):
+			name += string(ch)
 			if !isLastRun {
 				lookahead = rune(input[idx+1])
-				if isLetter(lookahead) {
+				if isLetter(lookahead) || isDigit(lookahead) {
 					continue
 				}
 			}
 
-			if _, ok = funcTable[functionName]; !ok {
-				return SyntaxError{message: fmt.Sprintf(EXPECTED_FNC_NAME, functionName)}
+			at := span{idx + 1 - len(name), idx + 1}
+			if sc.complex && name == imaginaryUnit && !isCall(input[idx+1:]) {
+				currentToken = &token{typeof: num, lexeme: ComplexValue(1i), at: at}
+			} else if isCall(input[idx+1:]) {
+				if _, ok = sc.funcs(name); !ok {
+					return newSyntaxError(ErrUnknownFunction, at, EXPECTED_FNC_NAME, name)
+				}
+				currentToken = &token{typeof: fnc, lexeme: name, at: at}
+			} else {
+				currentToken = &token{typeof: named, lexeme: name, at: at}
 			}
 
-			currentToken = &token{typeof: fnc, lexeme: functionName}
 			sc.src = append(sc.src, currentToken)
-			functionName = ""
+			name = ""
 
-		// Numbers
+		// Numbers, parsed here so evaluation never has to
 		case isDigit(ch) || isPeriod(ch):
-			number += string(ch)
-			if !isLastRun {
-				lookahead = rune(input[idx+1])
-				if isDigit(lookahead) || isPeriod(lookahead) {
-					continue
+			at := span{idx, idx + scanNumber(input[idx:])}
+			if sc.units {
+				at.end = idx + numberBeforeUnit(input[at.start:at.end])
+			}
+
+			value, ok := parseNumber(input[at.start:at.end])
+			if sc.complex {
+				value, ok = complexLiteral(input[at.start:at.end])
+			} else if sc.interval {
+				value, ok = intervalLiteral(input[at.start:at.end])
+			} else if sc.decimal != nil && (ok || isOutOfRange(input[at.start:at.end])) {
+				var err error
+				if value, err = sc.decimal.literal(input[at.start:at.end]); errors.Is(err, ErrInvalidValue) {
+					return locate(err, at)
+				}
+				ok = err == nil
+			} else if sc.integer != nil && (ok || isOutOfRange(input[at.start:at.end])) {
+				if n, isInt := sc.integer.literal(input[at.start:at.end]); isInt {
+					value, ok = n, true
 				}
 			}
 
-			if isPeriod(rune(number[0])) || strings.Count(number, ".") > 1 {
-				return SyntaxError{message: INVALID_NUMBER}
+			if !ok {
+				return newSyntaxError(ErrInvalidNumber, at, INVALID_NUMBER)
 			}
 
-			currentToken = &token{typeof: num, lexeme: number}
+			if sc.units {
+				var err error
+				if value, at, err = scanQuantity(input, value, at); err != nil {
+					return err
+				}
+			}
+
+			currentToken = &token{typeof: num, lexeme: value, at: at}
 			sc.src = append(sc.src, currentToken)
-			number = ""
+			idx = at.end - 1
+			continue
 		}
 
-		// Operators
-		if currentToken, ok = opTable[ch]; ok {
-			sc.src = append(sc.src, currentToken)
+		// Operators, copied out of the shared tables so each records its own position
+		if !isLastRun {
+			if currentToken, ok = compoundOpTable[input[idx:idx+2]]; ok {
+				op := *currentToken
+				op.at = span{idx, idx + 2}
+				sc.src = append(sc.src, &op)
+				idx++
+				continue
+			}
 		}
-	}
 
-	if parens < 0 {
-		return SyntaxError{message: UNBAL_PARENS}
+		if currentToken, ok = opTable[ch]; ok {
+			op := *currentToken
+			op.at = span{idx, idx + 1}
+			sc.src = append(sc.src, &op)
+		} else if isCompoundOpOnly(ch) {
+			return newSyntaxError(ErrInvalidChar, span{idx, idx + 1}, INVALID_CHAR_FOUND_AT, string(ch), idx)
+		}
 	}
 
 	// If we made it here, the expression is valid.
 	return nil
 }
+
+// Reports whether the remaining input opens an argument list, ignoring any leading whitespace.
+func isCall(rest string) bool {
+	for _, ch := range rest {
+		if unicode.IsSpace(ch) {
+			continue
+		}
+		return isLeftParen(ch)
+	}
+	return false
+}
+
+// Reports whether the input following a '%' completes a %P identifier rather than a modulo operand.
+func isPlaceholder(rest string) bool {
+	if len(rest) == 0 || !isKeyword(rune(rest[0])) {
+		return false
+	}
+	return len(rest) == 1 || !(isLetter(rune(rest[1])) || isDigit(rune(rest[1])))
+}
+
+// Returns the length of the numeric literal at the start of the input. Everything that could belong to
+// a literal is consumed, so that malformed literals such as 1.2.3 or 0b12 are reported as a whole.
+func scanNumber(input string) int {
+	prefixed := len(input) > 1 && input[0] == '0' && isIntPrefix(rune(input[1]))
+
+	ix := 0
+	for ; ix < len(input); ix++ {
+		ch := rune(input[ix])
+		switch {
+		case isDecimal(ch) || isPeriod(ch) || ('a' <= lower(ch) && lower(ch) <= 'z') || ch == '_':
+			continue
+
+		// The sign of a decimal exponent, as in 1e-3
+		case (ch == '+' || ch == '-') && !prefixed && ix > 0 && lower(rune(input[ix-1])) == 'e':
+			continue
+		}
+		break
+	}
+	return ix
+}
+
+// Returns the length of the longest number literal at the start of a run scanned by scanNumber that is
+// followed by a letter, for numbers written directly before their unit, as in 5m or 1e3km.
+func numberBeforeUnit(run string) int {
+	for size := len(run); size > 0; size-- {
+		if _, ok := parseNumber(run[:size]); ok && (size == len(run) || isLetter(rune(run[size]))) {
+			return size
+		}
+	}
+	return len(run)
+}
+
+// Returns the length of the string literal at the start of the input, including both quotes, or -1
+// when it is not terminated. A quote preceded by a backslash does not end the literal.
+func scanString(input string) int {
+	quote := input[0]
+	for ix := 1; ix < len(input); ix++ {
+		switch input[ix] {
+		case '\\':
+			ix++
+		case quote:
+			return ix + 1
+		}
+	}
+	return -1
+}
+
+// Decodes a string literal quoted with either ' or ", which supports the escapes of Go string literals.
+func unquote(lit string) (string, bool) {
+	quote := lit[0]
+	rest := lit[1 : len(lit)-1]
+
+	var sb strings.Builder
+	for len(rest) > 0 {
+		ch, multibyte, tail, err := strconv.UnquoteChar(rest, quote)
+		if err != nil {
+			return "", false
+		}
+
+		if ch < utf8.RuneSelf || !multibyte {
+			sb.WriteByte(byte(ch))
+		} else {
+			sb.WriteRune(ch)
+		}
+		rest = tail
+	}
+	return sb.String(), true
+}
+
+// Parses a decimal literal with an optional fraction and exponent, or a hex, octal or binary integer
+// literal, each of which may separate its digits with underscores. Integers that fit in an int64 are ints.
+func parseNumber(lit string) (Value, bool) {
+	if len(lit) > 1 && lit[0] == '0' && isIntPrefix(rune(lit[1])) {
+		value, err := strconv.ParseUint(lit, 0, 64)
+		if err != nil {
+			return Value{}, false
+		}
+
+		if value > math.MaxInt64 {
+			return FloatValue(float64(value)), true
+		}
+		return IntValue(int64(value)), true
+	}
+
+	if strings.ContainsAny(lit, "pPxX") {
+		return Value{}, false // hexadecimal floats
+	}
+
+	// Validates the placement of any underscores as well
+	value, err := strconv.ParseFloat(lit, 64)
+	if err != nil {
+		return Value{}, false
+	}
+
+	if !strings.ContainsAny(lit, ".eE") {
+		if i, err := strconv.ParseInt(strings.ReplaceAll(lit, "_", ""), 10, 64); err == nil {
+			return IntValue(i), true
+		}
+	}
+	return FloatValue(value), true
+}
+
+// Reports whether lit is a well-formed literal too large for an int64 or a float64, which decimals can still hold.
+func isOutOfRange(lit string) bool {
+	var err error
+	if len(lit) > 1 && lit[0] == '0' && isIntPrefix(rune(lit[1])) {
+		_, err = strconv.ParseUint(lit, 0, 64)
+	} else if !strings.ContainsAny(lit, "pPxX") {
+		_, err = strconv.ParseFloat(lit, 64)
+	}
+	return errors.Is(err, strconv.ErrRange)
+}
+
+// Extends the number at the given span with the unit that follows it, directly or after spaces, if any. A name following
+// a number that is neither a unit nor a call is reported as an unknown unit.
+func scanQuantity(input string, num Value, at span) (Value, span, error) {
+	start := len(input) - len(strings.TrimLeft(input[at.end:], " "))
+	name := scanName(input[start:])
+	if name == "" || isCall(input[start+len(name):]) {
+		return num, at, nil
+	}
+
+	size := scanUnit(input[start:])
+	if size == 0 {
+		return num, at, newSyntaxError(ErrUnknownUnit, span{start, start + len(name)}, UNKNOWN_UNIT, name)
+	}
+
+	u, err := parseUnit(input[start : start+size])
+	if err != nil {
+		return num, at, newSyntaxError(ErrUnknownUnit, span{start, start + size}, UNKNOWN_UNIT, input[start:start+size])
+	}
+
+	return quantityValue(num.Float(), u), span{at.start, start + size}, nil
+}
@@ -0,0 +1,367 @@
+package expr
+
+import (
+	"strings"
+
+	"github.com/js10x/expr-evaluator/expr/ast"
+)
+
+// Tokenizes and parses the input without evaluating it, returning its syntax tree.
+// Function names are resolved against the builtins and the functions registered on this parser.
+func (p *Parser) Parse(input string) (ast.Node, error) {
+
+	prog, err := p.Compile(input)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := toAST(prog.ast)
+	if err != nil {
+		return nil, withLineCol(err, input)
+	}
+	return node, nil
+}
+
+// Rewrites the input in the canonical form produced by ast.Format. Function names that only match
+// a known function when case is ignored are corrected to that function's name.
+func (p *Parser) Format(input string) (string, error) {
+
+	names := p.funcNames()
+	for {
+		node, err := p.Parse(input)
+		if e, ok := err.(SyntaxError); ok && e.Code == ErrUnknownFunction {
+			if name := matchFold(input[e.Offset:e.End], names); name != "" {
+				input = input[:e.Offset] + name + input[e.End:]
+				continue
+			}
+		}
+
+		if err != nil {
+			return "", err
+		}
+		return ast.Format(node), nil
+	}
+}
+
+// Finds the only candidate equal to name when case is ignored, or "" when there is none or the match is ambiguous.
+func matchFold(name string, candidates []string) string {
+	var match string
+	for _, candidate := range candidates {
+		if strings.EqualFold(name, candidate) {
+			if match != "" {
+				return ""
+			}
+			match = candidate
+		}
+	}
+	return match
+}
+
+// Compiles a syntax tree, typically one built or rewritten with the ast package, into a Program.
+// Calls are checked against the functions known to this parser just as they are when parsing.
+func (p *Parser) CompileNode(node ast.Node) (*Program, error) {
+
+	tree, err := p.fromAST(node)
+	if err != nil {
+		return nil, err
+	}
+	return p.newProgram(tree, ""), nil
+}
+
+func toAST(node treeNode) (ast.Node, error) {
+	switch n := node.(type) {
+	case *number:
+		return &ast.Number{Span: toSpan(n.at), Value: n.value.Float(), Lit: n.lit}, nil
+
+	case *text:
+		return &ast.StringLit{Span: toSpan(n.at), Value: n.value, Lit: n.lit}, nil
+
+	case *variable:
+		return &ast.Ident{Span: toSpan(n.at), Name: n.name}, nil
+
+	case *negation:
+		return toUnary(ast.Neg, n.unary)
+	case *logicalNegation:
+		return toUnary(ast.Not, n.unary)
+	case *bitNot:
+		return toUnary(ast.BitNot, n.unary)
+
+	case *addition:
+		return toBinary(ast.Add, n.binary)
+	case *subtraction:
+		return toBinary(ast.Sub, n.binary)
+	case *multiplication:
+		return toBinary(ast.Mul, n.binary)
+	case *division:
+		return toBinary(ast.Div, n.binary)
+	case *modulo:
+		return toBinary(ast.Mod, n.binary)
+	case *power:
+		return toBinary(ast.Pow, n.binary)
+	case *equality:
+		return toBinary(ast.Eq, n.binary)
+	case *inequality:
+		return toBinary(ast.Neq, n.binary)
+	case *lessThan:
+		return toBinary(ast.Lt, n.binary)
+	case *lessOrEqual:
+		return toBinary(ast.Lte, n.binary)
+	case *greaterThan:
+		return toBinary(ast.Gt, n.binary)
+	case *greaterOrEqual:
+		return toBinary(ast.Gte, n.binary)
+	case *conjunction:
+		return toBinary(ast.And, n.binary)
+	case *disjunction:
+		return toBinary(ast.Or, n.binary)
+	case *bitAnd:
+		return toBinary(ast.BitAnd, n.binary)
+	case *bitOr:
+		return toBinary(ast.BitOr, n.binary)
+	case *bitXor:
+		return toBinary(ast.BitXor, n.binary)
+	case *shiftLeft:
+		return toBinary(ast.Shl, n.binary)
+	case *shiftRight:
+		return toBinary(ast.Shr, n.binary)
+
+	case *conditional:
+		cond, err := toAST(n.cond)
+		if err != nil {
+			return nil, err
+		}
+
+		then, err := toAST(n.then)
+		if err != nil {
+			return nil, err
+		}
+
+		otherwise, err := toAST(n.otherwise)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.CondExpr{Span: toSpan(n.at), Cond: cond, Then: then, Else: otherwise}, nil
+
+	case *function:
+		args := make([]ast.Node, len(n.args))
+		for ix, arg := range n.args {
+			node, err := toAST(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[ix] = node
+		}
+		return &ast.CallExpr{Span: toSpan(n.at), Func: n.name, Args: args}, nil
+
+	case *functionArgs:
+		return nil, newSyntaxError(ErrUnexpectedTerm, n.at, UNEXPECTED_TERM_CONNECTED_BY, ",")
+	}
+	return nil, newSyntaxError(ErrInvalidExpr, node.pos(), INVALID_EXPR_GENERAL)
+}
+
+func toUnary(op ast.Op, n unary) (ast.Node, error) {
+	x, err := toAST(n.arg)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.UnaryExpr{Span: toSpan(n.at), Op: op, X: x}, nil
+}
+
+func toBinary(op ast.Op, n binary) (ast.Node, error) {
+	x, err := toAST(n.left)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := toAST(n.right)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.BinaryExpr{Span: toSpan(n.at), Op: op, X: x, Y: y}, nil
+}
+
+func (p *Parser) fromAST(node ast.Node) (treeNode, error) {
+	switch n := node.(type) {
+	case *ast.Number:
+		value, err := p.numberValue(n)
+		if err != nil {
+			return nil, newSyntaxError(ErrInvalidNumber, fromSpan(n), INVALID_NUMBER)
+		}
+		return &number{value: value, lit: n.Lit, at: fromSpan(n)}, nil
+
+	case *ast.StringLit:
+		return &text{value: n.Value, lit: n.String(), at: fromSpan(n)}, nil
+
+	case *ast.Ident:
+		return &variable{name: n.Name, at: fromSpan(n)}, nil
+
+	case *ast.UnaryExpr:
+		x, err := p.fromAST(n.X)
+		if err != nil {
+			return nil, err
+		}
+
+		switch n.Op {
+		case ast.Neg:
+			return newNegate(x, fromSpan(n)), nil
+		case ast.Not:
+			return newNot(x, fromSpan(n)), nil
+		case ast.BitNot:
+			return newBitNot(x, fromSpan(n)), nil
+		}
+		return nil, newSyntaxError(ErrInvalidExpr, fromSpan(n), UNEXPECTED_TERM_AT, n.Op)
+
+	case *ast.BinaryExpr:
+		x, err := p.fromAST(n.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := p.fromAST(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		return fromBinary(n.Op, x, y, fromSpan(n))
+
+	case *ast.CondExpr:
+		cond, err := p.fromAST(n.Cond)
+		if err != nil {
+			return nil, err
+		}
+
+		then, err := p.fromAST(n.Then)
+		if err != nil {
+			return nil, err
+		}
+
+		otherwise, err := p.fromAST(n.Else)
+		if err != nil {
+			return nil, err
+		}
+		return newConditional(cond, then, otherwise, fromSpan(n)), nil
+
+	case *ast.CallExpr:
+		desc, ok := p.lookupFunc(n.Func)
+		if !ok {
+			return nil, newSyntaxError(ErrUnknownFunction, fromSpan(n), EXPECTED_FNC_NAME, n.Func)
+		}
+
+		if !desc.accepts(len(n.Args)) {
+			return nil, newSyntaxError(ErrArgCount, fromSpan(n), INVALID_FNC_ARG_COUNT, desc.arity(), n.Func, len(n.Args))
+		}
+
+		args := make([]treeNode, len(n.Args))
+		for ix, arg := range n.Args {
+			tree, err := p.fromAST(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[ix] = tree
+		}
+		return newFunction(n.Func, desc, args, fromSpan(n)), nil
+
+	case nil:
+		return nil, newSyntaxError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+	}
+	return nil, newSyntaxError(ErrInvalidExpr, fromSpan(node), INVALID_EXPR_GENERAL)
+}
+
+func fromBinary(op ast.Op, x, y treeNode, at span) (treeNode, error) {
+	switch op {
+	case ast.Add:
+		return newAdd(x, y, at), nil
+	case ast.Sub:
+		return newSubtract(x, y, at), nil
+	case ast.Mul:
+		return newMultiply(x, y, at), nil
+	case ast.Div:
+		return newDivide(x, y, at), nil
+	case ast.Mod:
+		return newModulo(x, y, at), nil
+	case ast.Pow:
+		return newPower(x, y, at), nil
+	case ast.Eq:
+		return newEqual(x, y, at), nil
+	case ast.Neq:
+		return newNotEqual(x, y, at), nil
+	case ast.Lt:
+		return newLess(x, y, at), nil
+	case ast.Lte:
+		return newLessEqual(x, y, at), nil
+	case ast.Gt:
+		return newGreater(x, y, at), nil
+	case ast.Gte:
+		return newGreaterEqual(x, y, at), nil
+	case ast.And:
+		return newAnd(x, y, at), nil
+	case ast.Or:
+		return newOr(x, y, at), nil
+	case ast.BitAnd:
+		return newBitAnd(x, y, at), nil
+	case ast.BitOr:
+		return newBitOr(x, y, at), nil
+	case ast.BitXor:
+		return newBitXor(x, y, at), nil
+	case ast.Shl:
+		return newShiftLeft(x, y, at), nil
+	case ast.Shr:
+		return newShiftRight(x, y, at), nil
+	}
+	return nil, newSyntaxError(ErrInvalidExpr, at, UNEXPECTED_TERM_AT, op)
+}
+
+func toSpan(at span) ast.Span { return ast.Span{Start: at.start, Stop: at.end} }
+
+func fromSpan(node ast.Node) span { return span{node.Pos(), node.End()} }
+
+// Returns the value of a number node, which is an int when its literal is an integer that agrees with its
+// value. Parsers in decimal mode take the value of the literal as a decimal instead, falling back to the
+// value converted to one, parsers in integer mode take integer literals as big integers, and parsers in
+// complex mode take any literal as a complex number, and parsers in interval mode as the narrowest interval
+// around it. Literals with a unit are quantities in unit mode.
+func (p *Parser) numberValue(n *ast.Number) (Value, error) {
+	if p.units {
+		if value, ok := quantityLiteral(n.Lit); ok {
+			return value, nil
+		}
+	}
+
+	if p.complex {
+		if value, ok := complexLiteral(n.Lit); ok {
+			return value, nil
+		}
+		return ComplexValue(complex(n.Value, 0)), nil
+	}
+
+	if p.interval {
+		if value, ok := intervalLiteral(n.Lit); ok {
+			return value, nil
+		}
+		return intervalValue(point(n.Value)), nil
+	}
+
+	if p.integer != nil {
+		if value, ok := p.integer.literal(n.Lit); ok && value.Float() == n.Value {
+			return value, nil
+		}
+	}
+
+	value, ok := parseNumber(n.Lit)
+	ok = ok && value.Float() == n.Value
+
+	if p.decimal != nil {
+		if ok {
+			if d, err := p.decimal.parse(n.Lit); err == nil {
+				return Value{kind: Decimal, d: d}, nil
+			}
+		}
+
+		d, err := p.decimal.convert(FloatValue(n.Value))
+		return Value{kind: Decimal, d: d}, err
+	}
+
+	if ok {
+		return value, nil
+	}
+	return FloatValue(n.Value), nil
+}
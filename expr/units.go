@@ -0,0 +1,404 @@
+package expr
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// UnitMode lets number literals carry a unit, as in 5 m, 20cm or 9.81 m/s^2, which follows the number
+// directly or after a space. Only literals carry units, so a variable is given one by multiplying it, as in
+// x * 1 m. A unit is a product and quotient of unit symbols, each optionally raised to an integer
+// power with ^, and only continues past a * or / while the next name is a unit, so that 5 m / s is a speed.
+// Quantities are floats with a unit, so the mode replaces, and is replaced by, the other number modes.
+func UnitMode() ParserOption {
+	return func(p *Parser) {
+		p.resetMode()
+		p.units = true
+	}
+}
+
+// The exponents of the SI base dimensions: length, mass, time, electric current, temperature, amount
+// of substance and luminous intensity.
+type dimension [7]int8
+
+// The symbols of the base units of each dimension, in the order they are written in.
+var baseSymbols = [...]string{"m", "kg", "s", "A", "K", "mol", "cd"}
+
+// Adds sign times the exponents of e, reporting false when one of them leaves the range of an int8.
+func (d dimension) add(e dimension, sign int) (dimension, bool) {
+	for ix := range d {
+		exp := int(d[ix]) + sign*int(e[ix])
+		if exp < math.MinInt8 || exp > math.MaxInt8 {
+			return d, false
+		}
+		d[ix] = int8(exp)
+	}
+	return d, true
+}
+
+// Multiplies the exponents by n, reporting false when one of them leaves the range of an int8.
+func (d dimension) scale(n int) (dimension, bool) {
+	for ix := range d {
+		exp := int(d[ix]) * n
+		if exp < math.MinInt8 || exp > math.MaxInt8 {
+			return d, false
+		}
+		d[ix] = int8(exp)
+	}
+	return d, true
+}
+
+func (d dimension) isZero() bool { return d == dimension{} }
+
+// A unit: its symbol as written, its size in the SI base units of its dimension, and its dimension.
+type unit struct {
+	name   string
+	factor float64
+	dim    dimension
+}
+
+// Units by symbol. Those marked prefixable also accept the SI prefixes, as in km, mg and kPa.
+var unitTable = map[string]struct {
+	unit
+	prefixable bool
+}{
+	"m":   {unit{"m", 1, dimension{1, 0, 0, 0, 0, 0, 0}}, true},
+	"g":   {unit{"g", 1e-3, dimension{0, 1, 0, 0, 0, 0, 0}}, true},
+	"s":   {unit{"s", 1, dimension{0, 0, 1, 0, 0, 0, 0}}, true},
+	"A":   {unit{"A", 1, dimension{0, 0, 0, 1, 0, 0, 0}}, true},
+	"K":   {unit{"K", 1, dimension{0, 0, 0, 0, 1, 0, 0}}, true},
+	"mol": {unit{"mol", 1, dimension{0, 0, 0, 0, 0, 1, 0}}, true},
+	"cd":  {unit{"cd", 1, dimension{0, 0, 0, 0, 0, 0, 1}}, true},
+
+	// Derived SI units, which results are also written in when their dimension matches
+	"Hz":  {unit{"Hz", 1, dimension{0, 0, -1, 0, 0, 0, 0}}, true},
+	"N":   {unit{"N", 1, dimension{1, 1, -2, 0, 0, 0, 0}}, true},
+	"Pa":  {unit{"Pa", 1, dimension{-1, 1, -2, 0, 0, 0, 0}}, true},
+	"J":   {unit{"J", 1, dimension{2, 1, -2, 0, 0, 0, 0}}, true},
+	"W":   {unit{"W", 1, dimension{2, 1, -3, 0, 0, 0, 0}}, true},
+	"C":   {unit{"C", 1, dimension{0, 0, 1, 1, 0, 0, 0}}, true},
+	"V":   {unit{"V", 1, dimension{2, 1, -3, -1, 0, 0, 0}}, true},
+	"ohm": {unit{"ohm", 1, dimension{2, 1, -3, -2, 0, 0, 0}}, true},
+	"F":   {unit{"F", 1, dimension{-2, -1, 4, 2, 0, 0, 0}}, true},
+
+	// Units outside of SI
+	"min": {unit{"min", 60, dimension{0, 0, 1, 0, 0, 0, 0}}, false},
+	"h":   {unit{"h", 3600, dimension{0, 0, 1, 0, 0, 0, 0}}, false},
+	"d":   {unit{"d", 86400, dimension{0, 0, 1, 0, 0, 0, 0}}, false},
+	"L":   {unit{"L", 1e-3, dimension{3, 0, 0, 0, 0, 0, 0}}, true},
+	"t":   {unit{"t", 1e3, dimension{0, 1, 0, 0, 0, 0, 0}}, false},
+	"bar": {unit{"bar", 1e5, dimension{-1, 1, -2, 0, 0, 0, 0}}, true},
+	"in":  {unit{"in", 0.0254, dimension{1, 0, 0, 0, 0, 0, 0}}, false},
+	"ft":  {unit{"ft", 0.3048, dimension{1, 0, 0, 0, 0, 0, 0}}, false},
+	"mi":  {unit{"mi", 1609.344, dimension{1, 0, 0, 0, 0, 0, 0}}, false},
+	"lb":  {unit{"lb", 0.45359237, dimension{0, 1, 0, 0, 0, 0, 0}}, false},
+}
+
+// The SI prefixes and the powers of ten they stand for, da before d so that dam is a decametre. u is micro.
+var unitPrefixes = []struct {
+	symbol string
+	exp    int
+}{
+	{"Q", 30}, {"R", 27}, {"Y", 24}, {"Z", 21}, {"E", 18}, {"P", 15}, {"T", 12}, {"G", 9}, {"M", 6}, {"k", 3}, {"h", 2}, {"da", 1},
+	{"d", -1}, {"c", -2}, {"m", -3}, {"u", -6}, {"n", -9}, {"p", -12}, {"f", -15}, {"a", -18}, {"z", -21}, {"y", -24}, {"r", -27}, {"q", -30},
+}
+
+// Looks up a unit symbol, which is either in the table or a prefix followed by a prefixable unit in it.
+// Symbols in the table take precedence, so min is minutes and not milli-inches.
+func lookupUnit(name string) (unit, bool) {
+	if u, ok := unitTable[name]; ok {
+		return u.unit, true
+	}
+
+	for _, prefix := range unitPrefixes {
+		u, ok := unitTable[strings.TrimPrefix(name, prefix.symbol)]
+		if ok && u.prefixable && strings.HasPrefix(name, prefix.symbol) {
+			u.name, u.factor = name, u.factor*math.Pow10(prefix.exp)
+			return u.unit, true
+		}
+	}
+	return unit{}, false
+}
+
+// Returns the length of the unit at the start of the input, or 0 when it does not start with a unit symbol.
+// The unit ends before a * or / that is not followed by another unit symbol, or by one that is a call.
+func scanUnit(input string) int {
+	end, ix := 0, 0
+	for {
+		name := scanName(input[ix:])
+		if _, ok := lookupUnit(name); !ok || isCall(input[ix+len(name):]) {
+			return end
+		}
+		ix += len(name)
+
+		if exp := scanExponent(input[ix:]); exp > 0 {
+			ix += exp
+		}
+		end = ix
+
+		next := ix + len(input[ix:]) - len(strings.TrimLeft(input[ix:], " "))
+		if next == len(input) || input[next] != '*' && input[next] != '/' {
+			return end
+		}
+		ix = next + 1 + len(input[next+1:]) - len(strings.TrimLeft(input[next+1:], " "))
+	}
+}
+
+// Returns the run of letters at the start of the input.
+func scanName(input string) string {
+	for ix, ch := range input {
+		if !isLetter(ch) {
+			return input[:ix]
+		}
+	}
+	return input
+}
+
+// Returns the length of a power such as ^2 or ^-1 at the start of the input, or 0 when there is none.
+func scanExponent(input string) int {
+	if !strings.HasPrefix(input, "^") {
+		return 0
+	}
+
+	ix := 1
+	if strings.HasPrefix(input[ix:], "-") {
+		ix++
+	}
+
+	digits := len(input[ix:]) - len(strings.TrimLeft(input[ix:], "0123456789"))
+	if digits == 0 {
+		return 0
+	}
+	return ix + digits
+}
+
+// Parses a unit such as km/h, m/s^2 or kg*m^2, as scanned by scanUnit or given to TO.
+func parseUnit(text string) (unit, error) {
+	res := unit{name: strings.ReplaceAll(text, " ", ""), factor: 1} // written as m*s however it is spaced
+	rest, sign := strings.TrimSpace(text), 1
+	for {
+		name := scanName(rest)
+		u, ok := lookupUnit(name)
+		if !ok {
+			return unit{}, newEvalError(ErrUnknownUnit, span{}, UNKNOWN_UNIT, text)
+		}
+		rest = rest[len(name):]
+
+		exp := 1
+		if n := scanExponent(rest); n > 0 {
+			exp, _ = strconv.Atoi(rest[1:n])
+			rest = rest[n:]
+		}
+
+		dim, ok := u.dim.scale(exp)
+		if ok {
+			res.dim, ok = res.dim.add(dim, sign)
+		}
+		if !ok {
+			return unit{}, newEvalError(ErrUnknownUnit, span{}, UNKNOWN_UNIT, text)
+		}
+		res.factor *= math.Pow(u.factor, float64(sign)*float64(exp))
+
+		rest = strings.TrimLeft(rest, " ")
+		switch {
+		case rest == "":
+			return res, nil
+		case rest[0] == '*':
+			sign = 1
+		case rest[0] == '/':
+			sign = -1
+		default:
+			return unit{}, newEvalError(ErrUnknownUnit, span{}, UNKNOWN_UNIT, text)
+		}
+		rest = strings.TrimLeft(rest[1:], " ")
+	}
+}
+
+// Returns the coherent SI unit of a dimension: a derived unit with a name when there is one, such as N,
+// and otherwise a product and quotient of base units, such as m/s^2.
+func siUnit(dim dimension) unit {
+	for _, name := range []string{"N", "Pa", "J", "W", "C", "V", "ohm", "F", "Hz"} {
+		if unitTable[name].dim == dim {
+			return unitTable[name].unit
+		}
+	}
+
+	var num, den []string
+	for ix, symbol := range baseSymbols {
+		switch exp := dim[ix]; {
+		case exp == 1:
+			num = append(num, symbol)
+		case exp > 1:
+			num = append(num, symbol+"^"+strconv.Itoa(int(exp)))
+		case exp == -1:
+			den = append(den, symbol)
+		case exp < -1:
+			den = append(den, symbol+"^"+strconv.Itoa(int(-exp)))
+		}
+	}
+
+	// Without a numerator to divide, the denominator is written with negative powers
+	if len(num) == 0 {
+		for ix, symbol := range baseSymbols {
+			if dim[ix] != 0 {
+				num = append(num, symbol+"^"+strconv.Itoa(int(dim[ix])))
+			}
+		}
+		den = nil
+	}
+
+	name := strings.Join(num, "*")
+	for _, symbol := range den {
+		name += "/" + symbol
+	}
+	return unit{name: name, factor: 1, dim: dim}
+}
+
+// QuantityValue returns a Value holding a quantity of magnitude in the given unit, such as "km/h". It
+// fails with ErrUnknownUnit when the unit cannot be parsed.
+func QuantityValue(magnitude float64, unit string) (Value, error) {
+	u, err := parseUnit(unit)
+	if err != nil {
+		return Value{}, err
+	}
+	return quantityValue(magnitude, u), nil
+}
+
+// Returns a quantity of magnitude in the unit u. Dimensionless results are floats.
+func quantityValue(magnitude float64, u unit) Value {
+	if u.dim.isZero() {
+		return FloatValue(magnitude * u.factor)
+	}
+	return Value{kind: Quantity, f: magnitude, u: &u}
+}
+
+// Parses a number literal followed by a unit, as in 9.81 m/s^2.
+func quantityLiteral(lit string) (Value, bool) {
+	ix := strings.IndexByte(lit, ' ')
+	if ix < 0 {
+		return Value{}, false
+	}
+
+	num, ok := parseNumber(lit[:ix])
+	if !ok {
+		return Value{}, false
+	}
+
+	u, err := parseUnit(lit[ix:])
+	if err != nil {
+		return Value{}, false
+	}
+	return quantityValue(num.Float(), u), true
+}
+
+// Returns the unit of a number, which for anything but a quantity is dimensionless.
+func unitOf(v Value) unit {
+	if v.kind == Quantity {
+		return *v.u
+	}
+	return unit{factor: 1}
+}
+
+// Describes the unit of a value for errors about mismatched dimensions.
+func describeUnit(v Value) string {
+	if v.kind == Quantity {
+		return v.u.name
+	}
+	return "a dimensionless number"
+}
+
+// Converts a quantity into the unit to, which must have the same dimension.
+func convertQuantity(x Value, to unit) (Value, error) {
+	from := unitOf(x)
+	if from.dim != to.dim {
+		return Value{}, newEvalError(ErrDimensionMismatch, span{}, CANNOT_CONVERT_UNIT, describeUnit(x), to.name)
+	}
+	return quantityValue(x.Float()*from.factor/to.factor, to), nil
+}
+
+// Reports whether a unit is a single symbol, which is raised to a power by writing the power after it.
+func isSymbol(name string) bool {
+	return name != "" && scanName(name) == name
+}
+
+// Applies an operator to two numbers at least one of which is a quantity. Quantities are added, subtracted
+// and compared after converting the right one into the unit of the left one, which their dimensions must
+// allow, and the result is written in that unit. Products and quotients of two quantities are written in
+// coherent SI units, and powers need a dimensionless integer exponent.
+func quantityOp(op opcode, x, y Value) (Value, error) {
+	if x.kind == Complex || y.kind == Complex || x.kind == Interval || y.kind == Interval {
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED_FOR, opSymbols[op], x.kind, y.kind)
+	}
+
+	a, b := unitOf(x), unitOf(y)
+	switch op {
+	case opMul, opDiv:
+		if op == opDiv && y.Float() == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+
+		switch {
+		case b.dim.isZero() && op == opMul:
+			return quantityValue(x.Float()*y.Float(), a), nil
+		case b.dim.isZero():
+			return quantityValue(x.Float()/y.Float(), a), nil
+		case a.dim.isZero() && op == opMul:
+			return quantityValue(x.Float()*y.Float(), b), nil
+		}
+
+		sign := 1
+		if op == opDiv {
+			sign = -1
+		}
+
+		dim, ok := a.dim.add(b.dim, sign)
+		if !ok {
+			return Value{}, newEvalError(ErrDimensionMismatch, span{}, DIMENSION_OUT_OF_RANGE, math.MinInt8, math.MaxInt8)
+		}
+
+		if op == opMul {
+			return quantityValue(x.Float()*a.factor*y.Float()*b.factor, siUnit(dim)), nil
+		}
+		return quantityValue(x.Float()*a.factor/(y.Float()*b.factor), siUnit(dim)), nil
+
+	case opPow:
+		n := y.Float()
+		if y.kind == Quantity || n != math.Trunc(n) {
+			return Value{}, newEvalError(ErrDimensionMismatch, span{}, QUANTITY_POWER, y.describe())
+		}
+
+		dim, ok := a.dim.scale(int(math.Max(math.Min(n, math.MaxInt8+1), math.MinInt8-1)))
+		if !ok {
+			return Value{}, newEvalError(ErrDimensionMismatch, span{}, DIMENSION_OUT_OF_RANGE, math.MinInt8, math.MaxInt8)
+		}
+
+		if isSymbol(a.name) {
+			power := unit{name: a.name + "^" + strconv.Itoa(int(n)), factor: math.Pow(a.factor, n), dim: dim}
+			return quantityValue(math.Pow(x.Float(), n), power), nil
+		}
+		return quantityValue(math.Pow(x.Float()*a.factor, n), siUnit(dim)), nil
+	}
+
+	if a.dim != b.dim {
+		return Value{}, newEvalError(ErrDimensionMismatch, span{}, DIMENSION_MISMATCH, opSymbols[op], describeUnit(x), describeUnit(y))
+	}
+
+	res, err := floatOp(op, x.Float(), y.Float()*b.factor/a.factor)
+	if err != nil || res.kind != Float {
+		return res, err
+	}
+	return quantityValue(res.f, a), nil
+}
+
+// Returns the square root of a quantity, in the coherent SI unit of half its dimension, which must be even.
+func sqrtQuantity(x Value) (Value, error) {
+	var half dimension
+	for ix, exp := range x.u.dim {
+		if exp%2 != 0 {
+			return Value{}, newEvalError(ErrDimensionMismatch, span{}, FNC_NOT_DEFINED_ON, "SQR", x.describe())
+		}
+		half[ix] = exp / 2
+	}
+	return quantityValue(math.Sqrt(x.f*x.u.factor), siUnit(half)), nil
+}
@@ -0,0 +1,729 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Kind is the type of a Value.
+type Kind uint8
+
+const (
+	Float Kind = iota
+	Int
+	Bool
+	String
+	Decimal
+	BigInt
+	Complex
+	Quantity
+	Interval
+	dualKind // a number with its partial derivatives, only ever seen within Gradient
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Int:
+		return "int"
+	case Bool:
+		return "bool"
+	case String:
+		return "string"
+	case Decimal:
+		return "decimal"
+	case BigInt:
+		return "bigint"
+	case Complex:
+		return "complex"
+	case Quantity:
+		return "quantity"
+	case Interval:
+		return "interval"
+	case dualKind:
+		return "dual"
+	}
+	return "float"
+}
+
+// Value is the result of evaluating an expression: an int64, a float64, a bool or a string.
+//
+// Integer literals are ints and other numbers are floats. Operators promote their operands as follows:
+//   - an int is promoted to a float when the other operand is a float, and when an int result would overflow,
+//     including by a left shift
+//   - a float holding a whole number is promoted to an int by the bitwise operators, which only accept ints
+//   - a number is promoted to a bool, true when non-zero, and a string to one that is true when non-empty,
+//     wherever a condition is expected
+//
+// Bools and strings are never promoted to numbers, so applying an arithmetic or bitwise operator to one is
+// an error. Strings are concatenated by + and compared byte-wise by the comparison operators.
+//
+// Parsers created with the DecimalMode option evaluate numbers as decimals instead, to which ints and floats
+// are promoted when they meet one. Parsers created with the IntegerMode option evaluate integers as big
+// integers, to which ints are promoted and which are promoted to floats. Parsers created with the
+// ComplexMode option evaluate numbers as complex numbers, to which every other number is promoted. Parsers
+// created with the UnitMode option read quantities, floats with a unit, which other numbers are never
+// promoted to. Parsers created with the IntervalMode option evaluate numbers as intervals, to which every
+// other real number is promoted.
+type Value struct {
+	kind Kind
+	i    int64 // the value of an int, or 1 for true
+	f    float64
+	s    string
+	d    *decimal
+	b    *bigInt
+	c    complex128
+	u    *unit // the unit of a quantity, whose magnitude in that unit is f
+	r    *interval
+	g    *dual
+}
+
+func IntValue(i int64) Value     { return Value{kind: Int, i: i} }
+func FloatValue(f float64) Value { return Value{kind: Float, f: f} }
+func StringValue(s string) Value { return Value{kind: String, s: s} }
+
+func BoolValue(b bool) Value {
+	if b {
+		return Value{kind: Bool, i: 1}
+	}
+	return Value{kind: Bool}
+}
+
+func (v Value) Kind() Kind { return v.kind }
+
+// Returns the value as an int64, truncating a float or a decimal, saturating a big integer and converting
+// a bool to 1 or 0. Strings are 0.
+func (v Value) Int() int64 {
+	switch v.kind {
+	case Float, Quantity:
+		return int64(v.f)
+	case Interval, dualKind:
+		return int64(v.Float())
+	case Decimal:
+		return v.d.trunc()
+	case BigInt:
+		return bigInt64(v.b.n)
+	case Complex:
+		return int64(real(v.c))
+	}
+	return v.i
+}
+
+// Returns the value as a float64, rounding a decimal or a big integer to the nearest float and converting
+// a bool to 1 or 0. Quantities are their magnitude in their unit, and intervals their midpoint. Strings,
+// and complex numbers with an imaginary part, are NaN.
+func (v Value) Float() float64 {
+	switch v.kind {
+	case Float, Quantity:
+		return v.f
+	case Interval:
+		if v.r.isPoint() {
+			return v.r.lo
+		}
+		return v.r.lo/2 + v.r.hi/2
+	case dualKind:
+		return v.g.x
+	case Decimal:
+		return v.d.float()
+	case BigInt:
+		return bigFloat(v.b.n)
+	case Complex:
+		if imag(v.c) != 0 {
+			return math.NaN()
+		}
+		return real(v.c)
+	case String:
+		return math.NaN()
+	}
+	return float64(v.i)
+}
+
+// Returns the exact value of a number as a fraction, or nil for bools, strings, NaN, infinities, complex
+// numbers with an imaginary part and intervals holding more than one number.
+func (v Value) Rat() *big.Rat {
+	switch v.kind {
+	case Int:
+		return new(big.Rat).SetInt64(v.i)
+	case Float, Quantity:
+		if math.IsNaN(v.f) || math.IsInf(v.f, 0) {
+			return nil
+		}
+		return new(big.Rat).SetFloat64(v.f)
+	case Decimal:
+		return v.d.rat()
+	case BigInt:
+		return new(big.Rat).SetInt(v.b.n)
+	case Complex:
+		if imag(v.c) != 0 {
+			return nil
+		}
+		return FloatValue(real(v.c)).Rat()
+	case Interval:
+		if !v.r.isPoint() {
+			return nil
+		}
+		return FloatValue(v.r.lo).Rat()
+	case dualKind:
+		return FloatValue(v.g.x).Rat()
+	}
+	return nil
+}
+
+// Returns the value as a complex128, with the float value of any other kind as its real part.
+func (v Value) Complex() complex128 {
+	if v.kind == Complex {
+		return v.c
+	}
+	return complex(v.Float(), 0)
+}
+
+// Returns the bounds of an interval, or the float value of any other kind as both of them.
+func (v Value) Interval() (lo, hi float64) {
+	if v.kind == Interval {
+		return v.r.lo, v.r.hi
+	}
+	return v.Float(), v.Float()
+}
+
+// Returns the exact value of an int or a big integer, or nil for any other kind.
+func (v Value) BigInt() *big.Int {
+	switch v.kind {
+	case Int:
+		return big.NewInt(v.i)
+	case BigInt:
+		return new(big.Int).Set(v.b.n)
+	}
+	return nil
+}
+
+// Returns the value as a bool, which for numbers is true when they are non-zero, for intervals when
+// they are other than exactly zero, and for strings when they are non-empty. Conditions within an
+// expression are stricter about intervals, as truth is.
+func (v Value) Bool() bool {
+	switch v.kind {
+	case Float, Quantity:
+		return v.f != 0
+	case Decimal:
+		return v.d.coef.Sign() != 0
+	case BigInt:
+		return v.b.n.Sign() != 0
+	case Complex:
+		return v.c != 0
+	case Interval:
+		return *v.r != point(0)
+	case dualKind:
+		return v.g.x != 0
+	case String:
+		return v.s != ""
+	}
+	return v.i != 0
+}
+
+// Returns the value as a condition, as Bool does, but fails with ErrIndeterminate for an interval holding
+// zero as well as other numbers, which is true for some of its values and false for others.
+func (v Value) truth() (bool, error) {
+	if v.kind == Interval && v.r.lo <= 0 && v.r.hi >= 0 && !v.r.isPoint() {
+		return false, newEvalError(ErrIndeterminate, span{}, INDETERMINATE_CONDITION, v)
+	}
+	return v.Bool(), nil
+}
+
+// Returns the value as text: a string as it is, and any other kind formatted.
+func (v Value) String() string {
+	switch v.kind {
+	case Int:
+		return strconv.FormatInt(v.i, 10)
+	case Bool:
+		return strconv.FormatBool(v.i != 0)
+	case String:
+		return v.s
+	case Decimal:
+		return v.d.String()
+	case BigInt:
+		return v.b.n.String()
+	case Complex:
+		return formatComplex(v.c)
+	case Quantity:
+		return strconv.FormatFloat(v.f, 'g', -1, 64) + " " + v.u.name
+	case Interval:
+		return v.r.String()
+	case dualKind:
+		return strconv.FormatFloat(v.g.x, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(v.f, 'g', -1, 64)
+}
+
+// Returns the value as a literal that parses back to the same kind and value. Complex numbers parse back
+// as such only in complex mode, and those with both parts as the sum of two literals.
+func (v Value) literal() string {
+	if v.kind == String {
+		return strconv.Quote(v.s)
+	}
+
+	s := v.String()
+	if v.kind == Float && !math.IsInf(v.f, 0) && !math.IsNaN(v.f) {
+		for _, ch := range s {
+			if ch == '.' || ch == 'e' {
+				return s
+			}
+		}
+		return s + ".0"
+	}
+	return s
+}
+
+// Returns the value as the Go type of its kind, for formatting.
+func (v Value) native() any {
+	switch v.kind {
+	case Int:
+		return v.i
+	case Bool:
+		return v.i != 0
+	case String:
+		return v.s
+	case Decimal:
+		return new(big.Float).SetPrec(uint(float64(v.d.ctx.prec)*math.Log2(10)) + 64).SetRat(v.d.rat())
+	case BigInt:
+		return v.b.n
+	case Complex:
+		return v.c
+	case Quantity, Interval:
+		return v.String()
+	case dualKind:
+		return v.g.x
+	}
+	return v.f
+}
+
+// Converts a value supplied by the caller, such as the variable passed to EvalV.
+func toValue(value any) (Value, error) {
+	switch v := value.(type) {
+	case Value:
+		return v, nil
+	case bool:
+		return BoolValue(v), nil
+	case int:
+		return IntValue(int64(v)), nil
+	case int64:
+		return IntValue(v), nil
+	case float64:
+		return FloatValue(v), nil
+	case *big.Int:
+		return BigIntValue(v), nil
+	case complex128:
+		return ComplexValue(v), nil
+	case string:
+		if num, ok := parseNumber(v); ok {
+			return num, nil
+		}
+		_, err := strconv.ParseFloat(v, 64)
+		return Value{}, err
+	}
+	return Value{}, newEvalError(ErrInvalidValue, span{}, UNEXPECTED_TERM_AT, value)
+}
+
+// Returns the operand as an int for a bitwise operator, accepting floats that hold a whole number.
+func intOperand(op string, v Value) (int64, error) {
+	switch {
+	case v.kind == Int:
+		return v.i, nil
+	case v.kind == Float && v.f == math.Trunc(v.f) && v.f >= math.MinInt64 && v.f < math.MaxInt64:
+		return int64(v.f), nil
+	case v.kind == Decimal:
+		if i, ok := v.d.int64(); ok {
+			return i, nil
+		}
+	case v.kind == BigInt && v.b.n.IsInt64():
+		return v.b.n.Int64(), nil
+	case v.kind == Complex && imag(v.c) == 0:
+		return intOperand(op, FloatValue(real(v.c)))
+	case v.kind == Interval && v.r.isPoint():
+		return intOperand(op, FloatValue(v.r.lo))
+	case v.kind == dualKind:
+		return 0, newEvalError(ErrNotDifferentiable, span{}, NOT_DIFFERENTIABLE, op)
+	}
+	return 0, newEvalError(ErrTypeMismatch, span{}, OPERAND_NOT_INTEGER, op, v.describe())
+}
+
+// Describes a value for error messages.
+func (v Value) describe() string {
+	if v.kind == Bool {
+		return "bool"
+	}
+	return v.kind.String() + " " + v.literal()
+}
+
+// Applies a unary operator.
+func unaryOp(op opcode, x Value) (Value, error) {
+	switch op {
+	case opNot:
+		truth, err := x.truth()
+		return BoolValue(!truth), err
+
+	case opNeg:
+		switch x.kind {
+		case Int:
+			if x.i == math.MinInt64 {
+				return FloatValue(-float64(x.i)), nil
+			}
+			return IntValue(-x.i), nil
+		case Float:
+			return FloatValue(-x.f), nil
+		case Decimal:
+			return Value{kind: Decimal, d: x.d.neg()}, nil
+		case BigInt:
+			return x.b.ctx.value(new(big.Int).Neg(x.b.n)), nil
+		case Complex:
+			return ComplexValue(complex(-real(x.c), 0-imag(x.c))), nil // keeps -4 above the branch cut of SQR and LN
+		case Quantity:
+			return quantityValue(-x.f, *x.u), nil
+		case Interval:
+			return intervalValue(interval{-x.r.hi, -x.r.lo}), nil
+		case dualKind:
+			return x.g.then(-x.g.x, -1), nil
+		}
+
+	case opBitNot:
+		if x.kind == Bool || x.kind == String {
+			break
+		}
+
+		if x.kind == BigInt {
+			return x.b.ctx.value(new(big.Int).Not(x.b.n)), nil
+		}
+
+		i, err := intOperand("~", x)
+		if err != nil {
+			return Value{}, err
+		}
+		return IntValue(^i), nil
+	}
+	return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED, opSymbols[op], x.kind)
+}
+
+// Applies a binary operator other than the short-circuiting && and ||.
+func binaryOp(op opcode, x, y Value) (Value, error) {
+	symbol := opSymbols[op]
+	switch op {
+	case opEq, opNeq:
+		if x.kind == Bool && y.kind == Bool {
+			return BoolValue((x.i == y.i) == (op == opEq)), nil
+		}
+	}
+
+	if x.kind == String && y.kind == String {
+		return stringOp(op, x.s, y.s)
+	}
+
+	if x.kind == Bool || y.kind == Bool || x.kind == String || y.kind == String {
+		if x.kind == y.kind {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED, symbol, x.kind)
+		}
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED_FOR, symbol, x.kind, y.kind)
+	}
+
+	switch op {
+	case opBitAnd, opBitOr, opBitXor, opShl, opShr:
+		if (x.kind == BigInt || y.kind == BigInt) && x.kind != dualKind && y.kind != dualKind {
+			return bigBitwiseOp(op, x, y)
+		}
+
+		a, err := intOperand(symbol, x)
+		if err != nil {
+			return Value{}, err
+		}
+
+		b, err := intOperand(symbol, y)
+		if err != nil {
+			return Value{}, err
+		}
+		return bitwiseOp(op, a, b)
+	}
+
+	if x.kind == dualKind || y.kind == dualKind {
+		a, okX := dualOperand(x)
+		b, okY := dualOperand(y)
+		if !okX || !okY {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED_FOR, symbol, x.kind, y.kind)
+		}
+		return dualOp(op, a, b)
+	}
+
+	if x.kind == Quantity || y.kind == Quantity {
+		return quantityOp(op, x, y)
+	}
+
+	if x.kind == Interval || y.kind == Interval {
+		a, okX := intervalOperand(x)
+		b, okY := intervalOperand(y)
+		if !okX || !okY {
+			return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED_FOR, symbol, x.kind, y.kind)
+		}
+		return intervalOp(op, a, b)
+	}
+
+	if x.kind == Complex || y.kind == Complex {
+		a, _ := complexOperand(x)
+		b, _ := complexOperand(y)
+		return complexOp(op, a, b)
+	}
+
+	if x.kind == Decimal || y.kind == Decimal {
+		a, b, err := toDecimals(x, y)
+		if err != nil {
+			return Value{}, err
+		}
+		return decimalOp(op, a, b)
+	}
+
+	if (x.kind == BigInt || y.kind == BigInt) && x.kind != Float && y.kind != Float {
+		ctx := integerArg([]Value{x, y})
+		a, _ := bigOperand(x)
+		b, _ := bigOperand(y)
+		return ctx.op(op, a, b)
+	}
+
+	if x.kind == Int && y.kind == Int {
+		if res, ok, err := intOp(op, x.i, y.i); ok || err != nil {
+			return res, err
+		}
+	}
+	return floatOp(op, x.Float(), y.Float())
+}
+
+// Applies a bitwise operator to operands one of which is a big integer, accepting any whole number as the other.
+func bigBitwiseOp(op opcode, x, y Value) (Value, error) {
+	a, ok := bigOperand(x)
+	if !ok {
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERAND_NOT_INTEGER, opSymbols[op], x.describe())
+	}
+
+	b, ok := bigOperand(y)
+	if !ok {
+		return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERAND_NOT_INTEGER, opSymbols[op], y.describe())
+	}
+	return integerArg([]Value{x, y}).bitwise(op, a, b)
+}
+
+// Promotes both operands to decimals in the context of the one that already is.
+func toDecimals(x, y Value) (*decimal, *decimal, error) {
+	ctx := y.d
+	if x.kind == Decimal {
+		ctx = x.d
+	}
+
+	a, err := ctx.ctx.convert(x)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := ctx.ctx.convert(y)
+	return a, b, err
+}
+
+// Promotes v to the kind of like when that is wider, as an int is to a big integer, a float or a decimal,
+// a big integer is to a float or a decimal, a float is to a decimal, and any number is to a complex number.
+func promote(v, like Value) (Value, error) {
+	switch {
+	case like.kind == Complex && v.kind != Complex:
+		c, _ := complexOperand(v)
+		return ComplexValue(c), nil
+	case like.kind == Decimal && (v.kind == Int || v.kind == Float || v.kind == BigInt):
+		d, err := like.d.ctx.convert(v)
+		return Value{kind: Decimal, d: d}, err
+	case like.kind == Float && (v.kind == Int || v.kind == BigInt):
+		return FloatValue(v.Float()), nil
+	case like.kind == BigInt && v.kind == Int:
+		return like.b.ctx.value(big.NewInt(v.i)), nil
+	}
+	return v, nil
+}
+
+// Applies an operator to two ints, reporting false when the result is not an int, as for a division
+// or on overflow, so that it is computed as a float instead.
+func intOp(op opcode, a, b int64) (Value, bool, error) {
+	switch op {
+	case opAdd:
+		if res := a + b; (res > a) == (b > 0) {
+			return IntValue(res), true, nil
+		}
+
+	case opSub:
+		if res := a - b; (res < a) == (b > 0) {
+			return IntValue(res), true, nil
+		}
+
+	case opMul:
+		if res, ok := mulInt(a, b); ok {
+			return IntValue(res), true, nil
+		}
+
+	case opMod:
+		if b == 0 {
+			return Value{}, false, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		return IntValue(a % b), true, nil
+
+	case opPow:
+		if res, ok := powInt(a, b); ok {
+			return IntValue(res), true, nil
+		}
+
+	case opEq:
+		return BoolValue(a == b), true, nil
+	case opNeq:
+		return BoolValue(a != b), true, nil
+	case opLt:
+		return BoolValue(a < b), true, nil
+	case opLte:
+		return BoolValue(a <= b), true, nil
+	case opGt:
+		return BoolValue(a > b), true, nil
+	case opGte:
+		return BoolValue(a >= b), true, nil
+	}
+	return Value{}, false, nil
+}
+
+// Multiplies two ints, reporting false on overflow.
+func mulInt(a, b int64) (int64, bool) {
+	res := a * b
+	return res, a == 0 || (res/a == b && !(a == -1 && b == math.MinInt64))
+}
+
+// Raises a to the non-negative power b by squaring, reporting false on overflow or a negative b.
+func powInt(a, b int64) (int64, bool) {
+	if b < 0 {
+		return 0, false
+	}
+
+	var ok bool
+	res := int64(1)
+	for b > 0 {
+		if b&1 == 1 {
+			if res, ok = mulInt(res, a); !ok {
+				return 0, false
+			}
+		}
+
+		if b >>= 1; b > 0 {
+			if a, ok = mulInt(a, a); !ok {
+				return 0, false
+			}
+		}
+	}
+	return res, true
+}
+
+func floatOp(op opcode, a, b float64) (Value, error) {
+	switch op {
+	case opAdd:
+		return FloatValue(a + b), nil
+	case opSub:
+		return FloatValue(a - b), nil
+	case opMul:
+		return FloatValue(a * b), nil
+	case opDiv:
+		if b == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		return FloatValue(a / b), nil
+	case opMod:
+		if b == 0 {
+			return Value{}, newEvalError(ErrDivideByZero, span{}, DIVIDE_BY_ZERO)
+		}
+		return FloatValue(math.Mod(a, b)), nil
+	case opPow:
+		return FloatValue(math.Pow(a, b)), nil
+	case opEq:
+		return BoolValue(a == b), nil
+	case opNeq:
+		return BoolValue(a != b), nil
+	case opLt:
+		return BoolValue(a < b), nil
+	case opLte:
+		return BoolValue(a <= b), nil
+	case opGt:
+		return BoolValue(a > b), nil
+	case opGte:
+		return BoolValue(a >= b), nil
+	}
+	return Value{}, newEvalError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+}
+
+func stringOp(op opcode, a, b string) (Value, error) {
+	switch op {
+	case opAdd:
+		return StringValue(a + b), nil
+	case opEq:
+		return BoolValue(a == b), nil
+	case opNeq:
+		return BoolValue(a != b), nil
+	case opLt:
+		return BoolValue(a < b), nil
+	case opLte:
+		return BoolValue(a <= b), nil
+	case opGt:
+		return BoolValue(a > b), nil
+	case opGte:
+		return BoolValue(a >= b), nil
+	}
+	return Value{}, newEvalError(ErrTypeMismatch, span{}, OPERATOR_NOT_DEFINED, opSymbols[op], String)
+}
+
+func bitwiseOp(op opcode, a, b int64) (Value, error) {
+	switch op {
+	case opBitAnd:
+		return IntValue(a & b), nil
+	case opBitOr:
+		return IntValue(a | b), nil
+	case opBitXor:
+		return IntValue(a ^ b), nil
+	case opShl, opShr:
+		return shift(a, b, op == opShl)
+	}
+	return Value{}, newEvalError(ErrInvalidExpr, span{}, INVALID_EXPR_GENERAL)
+}
+
+// Shifts x by n bits. Negative counts are rejected rather than left to panic, and a left shift that would
+// lose high bits is promoted to a float, as other operators are on overflow.
+func shift(x, n int64, left bool) (Value, error) {
+	if n < 0 {
+		return Value{}, newEvalError(ErrNegativeShift, span{}, NEGATIVE_SHIFT_COUNT)
+	}
+
+	if !left {
+		return IntValue(x >> n), nil
+	}
+
+	switch {
+	case x == 0 || n < 64 && (x<<n)>>n == x:
+		return IntValue(x << n), nil
+	case n > 2048:
+		n = 2048 // overflows any float, and any int the count is converted to
+	}
+	return FloatValue(math.Ldexp(float64(x), int(n))), nil
+}
+
+var opSymbols = [...]string{
+	opNeg:    "-",
+	opNot:    "!",
+	opBitNot: "~",
+	opAdd:    "+",
+	opSub:    "-",
+	opMul:    "*",
+	opDiv:    "/",
+	opMod:    "%",
+	opPow:    "**",
+	opEq:     "==",
+	opNeq:    "!=",
+	opLt:     "<",
+	opLte:    "<=",
+	opGt:     ">",
+	opGte:    ">=",
+	opBitAnd: "&",
+	opBitOr:  "|",
+	opBitXor: "^",
+	opShl:    "<<",
+	opShr:    ">>",
+}
@@ -0,0 +1,328 @@
+package expr
+
+import "sync"
+
+type opcode uint8
+
+const (
+	opConst         opcode = iota // push consts[arg]
+	opLoad                        // push the value of the variable names[arg]
+	opCall                        // pop the arguments of calls[arg] and push its result
+	opTree                        // push the result of evaluating trees[arg] by walking it
+	opJump                        // continue at arg
+	opJumpIfZero                  // pop, continuing at arg when the value is false or zero
+	opJumpIfNotZero               // pop, continuing at arg when the value is true or non-zero
+	opTruth                       // replace the top of the stack by the bool it converts to
+	opNeg
+	opNot
+	opBitNot
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opEq
+	opNeq
+	opLt
+	opLte
+	opGt
+	opGte
+	opBitAnd
+	opBitOr
+	opBitXor
+	opShl
+	opShr
+)
+
+type instr struct {
+	op  opcode
+	arg int32
+}
+
+type call struct {
+	fn   *fncDescriptor
+	argc int
+}
+
+// A tree compiled for a stack machine. Operands live on a stack of unboxed Values, so running
+// it allocates nothing beyond what the functions it calls and the Resolver do.
+type bytecode struct {
+	code   []instr
+	spans  []span // the span of the node each instruction was compiled from, for errors
+	consts []Value
+	names  []string
+	calls  []call
+	trees  []treeNode // subtrees that cannot be compiled, such as calls to lazy functions
+	depth  int        // the maximum stack depth
+	argc   int        // the most arguments passed to a single call
+}
+
+// The memory a run needs, reused across runs and across programs to keep evaluation allocation free.
+type machine struct {
+	stack  []Value
+	floats []float64 // the arguments of a call to a function taking floats
+}
+
+var machines = sync.Pool{New: func() any { return new(machine) }}
+
+// Returns the machine to the pool, first clearing the depth Values its stack held, so that the strings,
+// big numbers and other values of the last run do not stay reachable from the pool.
+func (m *machine) release(depth int) {
+	stack := m.stack[:depth]
+	for ix := range stack {
+		stack[ix] = Value{}
+	}
+	m.stack = m.stack[:0]
+	machines.Put(m)
+}
+
+// Compiles a parsed tree. Nodes the machine has no instruction for are evaluated by walking them.
+func compile(tree treeNode) *bytecode {
+	c := &compiler{}
+	c.compile(tree)
+	return &c.bytecode
+}
+
+type compiler struct {
+	bytecode
+	sp int
+}
+
+func (c *compiler) emit(op opcode, arg int, at span, effect int) int {
+	c.code = append(c.code, instr{op: op, arg: int32(arg)})
+	c.spans = append(c.spans, at)
+
+	c.sp += effect
+	if c.sp > c.depth {
+		c.depth = c.sp
+	}
+	return len(c.code) - 1
+}
+
+// Points the jump at ix to the next instruction to be emitted.
+func (c *compiler) patch(ix int) {
+	c.code[ix].arg = int32(len(c.code))
+}
+
+func (c *compiler) compile(node treeNode) {
+	switch n := node.(type) {
+	case *number:
+		c.consts = append(c.consts, n.value)
+		c.emit(opConst, len(c.consts)-1, n.at, 1)
+
+	case *text:
+		c.consts = append(c.consts, StringValue(n.value))
+		c.emit(opConst, len(c.consts)-1, n.at, 1)
+
+	case *variable:
+		c.names = append(c.names, n.name)
+		c.emit(opLoad, len(c.names)-1, n.at, 1)
+
+	case *negation:
+		c.unary(opNeg, n.unary)
+	case *logicalNegation:
+		c.unary(opNot, n.unary)
+	case *bitNot:
+		c.unary(opBitNot, n.unary)
+
+	case *addition:
+		c.binary(opAdd, n.binary)
+	case *subtraction:
+		c.binary(opSub, n.binary)
+	case *multiplication:
+		c.binary(opMul, n.binary)
+	case *division:
+		c.binary(opDiv, n.binary)
+	case *modulo:
+		c.binary(opMod, n.binary)
+	case *power:
+		c.binary(opPow, n.binary)
+	case *equality:
+		c.binary(opEq, n.binary)
+	case *inequality:
+		c.binary(opNeq, n.binary)
+	case *lessThan:
+		c.binary(opLt, n.binary)
+	case *lessOrEqual:
+		c.binary(opLte, n.binary)
+	case *greaterThan:
+		c.binary(opGt, n.binary)
+	case *greaterOrEqual:
+		c.binary(opGte, n.binary)
+	case *bitAnd:
+		c.binary(opBitAnd, n.binary)
+	case *bitOr:
+		c.binary(opBitOr, n.binary)
+	case *bitXor:
+		c.binary(opBitXor, n.binary)
+	case *shiftLeft:
+		c.binary(opShl, n.binary)
+	case *shiftRight:
+		c.binary(opShr, n.binary)
+
+	// The right operand is skipped once the left one decides the result
+	case *conjunction:
+		c.logical(opJumpIfZero, false, n.binary)
+	case *disjunction:
+		c.logical(opJumpIfNotZero, true, n.binary)
+
+	case *conditional:
+		c.conditional(n.cond, n.then, n.otherwise)
+
+	case *function:
+		switch {
+		case n.fn == funcTable["IF"]:
+			c.conditional(n.args[0], n.args[1], n.args[2])
+
+		case n.fn.invoke != nil:
+			c.fallback(n)
+
+		default:
+			for _, arg := range n.args {
+				c.compile(arg)
+			}
+			c.calls = append(c.calls, call{fn: n.fn, argc: len(n.args)})
+			if len(n.args) > c.argc {
+				c.argc = len(n.args)
+			}
+			c.emit(opCall, len(c.calls)-1, n.at, 1-len(n.args))
+		}
+
+	default:
+		c.fallback(node)
+	}
+}
+
+func (c *compiler) unary(op opcode, n unary) {
+	c.compile(n.arg)
+	c.emit(op, 0, n.at, 0)
+}
+
+func (c *compiler) binary(op opcode, n binary) {
+	c.compile(n.left)
+	c.compile(n.right)
+	c.emit(op, 0, n.at, -1)
+}
+
+// Compiles && and ||, where the left operand alone decides the result when the jump is taken.
+func (c *compiler) logical(jump opcode, decided bool, n binary) {
+	c.compile(n.left)
+	short := c.emit(jump, 0, n.left.pos(), -1)
+
+	c.compile(n.right)
+	c.emit(opTruth, 0, n.right.pos(), 0)
+	end := c.emit(opJump, 0, n.at, -1) // the constant below is pushed instead, not as well
+
+	c.patch(short)
+	c.consts = append(c.consts, BoolValue(decided))
+	c.emit(opConst, len(c.consts)-1, n.at, 1)
+	c.patch(end)
+}
+
+func (c *compiler) conditional(cond, then, otherwise treeNode) {
+	c.compile(cond)
+	skip := c.emit(opJumpIfZero, 0, cond.pos(), -1)
+
+	c.compile(then)
+	end := c.emit(opJump, 0, then.pos(), -1) // only one of the branches is pushed
+
+	c.patch(skip)
+	c.compile(otherwise)
+	c.patch(end)
+}
+
+func (c *compiler) fallback(node treeNode) {
+	c.trees = append(c.trees, node)
+	c.emit(opTree, len(c.trees)-1, node.pos(), 1)
+}
+
+func (b *bytecode) run(env Resolver) (Value, error) {
+
+	m := machines.Get().(*machine)
+	defer m.release(b.depth)
+	if cap(m.stack) < b.depth {
+		m.stack = make([]Value, b.depth)
+	}
+	if cap(m.floats) < b.argc {
+		m.floats = make([]float64, b.argc)
+	}
+
+	stack := m.stack[:b.depth]
+	sp := 0
+	for pc := 0; pc < len(b.code); pc++ {
+		in := b.code[pc]
+		switch in.op {
+		case opConst:
+			stack[sp] = b.consts[in.arg]
+			sp++
+
+		case opLoad:
+			name := b.names[in.arg]
+			if env == nil {
+				return Value{}, newEvalError(ErrUndefinedVariable, b.spans[pc], UNDEFINED_VARIABLE, name)
+			}
+
+			value, ok := resolve(env, name)
+			if !ok {
+				return Value{}, newEvalError(ErrUndefinedVariable, b.spans[pc], UNDEFINED_VARIABLE, name)
+			}
+			stack[sp] = value
+			sp++
+
+		case opCall:
+			fn := b.calls[in.arg]
+			res, err := fn.fn.apply(stack[sp-fn.argc:sp], m.floats)
+			if err != nil {
+				return Value{}, locate(err, b.spans[pc])
+			}
+			sp -= fn.argc
+			stack[sp] = res
+			sp++
+
+		case opTree:
+			res, err := b.trees[in.arg].Eval(env)
+			if err != nil {
+				return Value{}, err
+			}
+			stack[sp] = res
+			sp++
+
+		case opJump:
+			pc = int(in.arg) - 1
+
+		case opJumpIfZero, opJumpIfNotZero:
+			sp--
+			truth, err := stack[sp].truth()
+			if err != nil {
+				return Value{}, locate(err, b.spans[pc])
+			}
+			if truth == (in.op == opJumpIfNotZero) {
+				pc = int(in.arg) - 1
+			}
+
+		case opTruth:
+			truth, err := stack[sp-1].truth()
+			if err != nil {
+				return Value{}, locate(err, b.spans[pc])
+			}
+			stack[sp-1] = BoolValue(truth)
+
+		case opNeg, opNot, opBitNot:
+			res, err := unaryOp(in.op, stack[sp-1])
+			if err != nil {
+				return Value{}, locate(err, b.spans[pc])
+			}
+			stack[sp-1] = res
+
+		default:
+			sp--
+			res, err := binaryOp(in.op, stack[sp-1], stack[sp])
+			if err != nil {
+				return Value{}, locate(err, b.spans[pc])
+			}
+			stack[sp-1] = res
+		}
+	}
+	return stack[0], nil
+}
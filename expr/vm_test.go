@@ -0,0 +1,154 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// Expressions from parser_test.go covering every operator, the builtins and the error paths.
+var vmExpressions = []string{
+	"2 + 3 * 4",
+	"-(7 + 5) * 2",
+	"ABS(-(7 + 5) / 2)",
+	"BAND(5, 10 * 1000.0)",
+	"BAND(-(%P + 5) / 2, (%P * 5) / 2)",
+	"BANDNOT(255,8) + BNOT(255) + BOR(15,2) + BXOR(15,2)",
+	"SHL(255,8) + SHR(255,8) + 1 << 3 >> 1",
+	"CEIL(15.5) * COS(360) - SIN(360) / TAN(360) + SQR(5) + RND(3.4)",
+	"MOD(4,2) + POW(2,2) + 2 ** 3 ** 2 + 7 % 3",
+	"EQ(1,8) + NE(1,8) + GE(8,8) + GT(8,4) + LE(8,7) + LT(1,8)",
+	"1 == 1 && 2 != 3 || 4 < 5 && !(6 <= 7) || 8 > 9 || 10 >= 11",
+	"x && 1 / 0",
+	"!x || y",
+	"x > 0 ? x * 2 : y > 0 ? y : -y",
+	"IF(x, 1 / x, 0) + IFERROR(1 / (x - x), 42)",
+	"MIN(x, y, 3) + MAX(x, y) + SUM(1, 2, x) + PRODUCT(x, y) + AVG(x, y) + MEDIAN(x, y, 3) + STDDEV(x, y) + COUNT(x, y)",
+	"AND(x, 1) + OR(0, y) + NOT(x)",
+	"AND(x, 1) || OR(0, y) || NOT(x)",
+	"(x < y) == (y < x)",
+	"(x < y) + 1",
+	"BAND(x, 3) + ~y",
+	"9223372036854775807 + x",
+	"~x & 255 | 8 ^ 3",
+	"(2/(2*0))*20",
+	"5 % (x - x)",
+	"1 << -x",
+	"2 * SHR(1, -x)",
+	"x + undefined",
+	`LEN("héllo") + x`,
+	`UPPER(s) + "-" + s == "ABC-abc" ? s : "no"`,
+	`s < "b" && CONTAINS(s, "b") || x`,
+	`SUBSTR(s, x, y) + s`,
+	`FORMAT("%v:%v", s, x) + 1`,
+	"%P",
+}
+
+func TestVMMatchesTree(t *testing.T) {
+
+	parser := NewParser()
+	envs := []Resolver{
+		Vars{"x": 2, "y": -3, "%P": 7},
+		Vars{"x": 0, "y": 0.5, "%P": -1},
+		Vars{"x": -1.5, "y": 4, "%P": 0},
+		Values{"x": IntValue(1), "y": IntValue(1), "s": StringValue("abc")},
+		Values{"x": FloatValue(0.5), "y": BoolValue(true), "s": StringValue("")},
+		nil,
+	}
+
+	for _, input := range vmExpressions {
+		prog, err := parser.Compile(input)
+		if err != nil {
+			t.Errorf("expected %v, but got %v for expression %v", nil, err, input)
+			continue
+		}
+
+		for _, env := range envs {
+			expect, expectErr := treeEval(prog, env)
+			res, err := prog.EvalValue(env)
+
+			if !sameError(err, expectErr) {
+				t.Errorf("expected %v, but got %v for expression %v with %v", expectErr, err, input, env)
+				continue
+			}
+
+			if err == nil && res != expect && !(math.IsNaN(res.Float()) && math.IsNaN(expect.Float())) {
+				t.Errorf("expected %v, but got %v for expression %v with %v", expect, res, input, env)
+			}
+		}
+	}
+}
+
+func TestVMAllocations(t *testing.T) {
+
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+
+	parser := NewParser()
+	env := Vars{"x": 2, "y": -3, "%P": 7}
+	for _, input := range []string{
+		"BAND(-(%P + 5) / 2, (%P * 5) / 5)",
+		"x > 0 ? x * 2 : y > 0 ? y : -y",
+		"MIN(x, y, 3) + MAX(x, y) + SUM(1, 2, x)",
+		"1 == 1 && 2 != 3 || !(x <= 7)",
+	} {
+		prog, err := parser.Compile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prog.Eval(env)
+		if allocs := testing.AllocsPerRun(100, func() { prog.Eval(env) }); allocs != 0 {
+			t.Errorf("expected %v, but got %v for expression %v", "no allocations", allocs, input)
+		}
+	}
+}
+
+func BenchmarkTreeWalk(b *testing.B) {
+	benchmarkPrograms(b, func(prog *Program, env Resolver) { treeEval(prog, env) })
+}
+
+func BenchmarkVM(b *testing.B) {
+	benchmarkPrograms(b, func(prog *Program, env Resolver) { prog.Eval(env) })
+}
+
+func benchmarkPrograms(b *testing.B, eval func(prog *Program, env Resolver)) {
+
+	parser := NewParser()
+	env := Vars{"x": 2, "y": -3, "%P": 7}
+	for _, input := range vmExpressions {
+		prog, err := parser.Compile(input)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(input, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				eval(prog, env)
+			}
+		})
+	}
+}
+
+// Evaluates the program by walking its tree, as Program.Eval did before it was compiled to bytecode.
+func treeEval(prog *Program, env Resolver) (Value, error) {
+	res, err := prog.ast.Eval(env)
+	if err != nil {
+		return Value{}, withLineCol(err, prog.src)
+	}
+	return res, nil
+}
+
+func sameError(err, expect error) bool {
+	if err == nil || expect == nil {
+		return err == expect
+	}
+
+	var evalErr, expectEvalErr EvalError
+	if errors.As(err, &evalErr) && errors.As(expect, &expectEvalErr) {
+		return evalErr.Code == expectEvalErr.Code && evalErr.Position == expectEvalErr.Position
+	}
+	return err.Error() == expect.Error()
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"os"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/js10x/expr-evaluator/expr"
+	"github.com/js10x/expr-evaluator/expr/ast"
 )
 
 var parser *expr.Parser = expr.NewParser()
@@ -13,20 +21,287 @@ var parser *expr.Parser = expr.NewParser()
 func main() {
 	var expression string
 	var variable float64
+	var format, write, reduce, complex, units bool
+	var precision uint
+	var division, bounds, derivative, solve string
 
 	// The expression to evaluate.
 	flag.StringVar(&expression, "e", "", "-(7 + 5) * 2")
 
 	// A numeric value that will be inserted into the expression during evaluation anywhere a %P identifier is defined.
 	flag.Float64Var(&variable, "v", 1, "-e \"-(%P + 5) * 2 + 2\" -v 7.125")
+
+	// Prints what the expression reduced to after constant folding and simplification before evaluating it.
+	flag.BoolVar(&reduce, "reduce", false, "-e \"%P * (2 + 3) * 1\" -reduce")
+
+	// Evaluates in decimal with the given number of significant digits instead of in binary floating point.
+	flag.UintVar(&precision, "decimal", 0, "-e \"0.1 + 0.2\" -decimal 34")
+
+	// Evaluates integers exactly however large they get, with division that truncates (trunc) or floors (floor).
+	flag.StringVar(&division, "bigint", "", "-e \"SHL(255, 60)\" -bigint trunc")
+
+	// Evaluates in complex numbers, where i is the imaginary unit and a number followed by i is imaginary.
+	flag.BoolVar(&complex, "complex", false, "-e \"(3 + 4i) * EXP(i * %P)\" -complex")
+
+	// Evaluates numbers followed by a unit, such as 5 m or 9.81 m/s^2, as physical quantities.
+	flag.BoolVar(&units, "units", false, "-e \"TO(100 km / 2 h, \\\"km/h\\\")\" -units")
+
+	// Evaluates in interval arithmetic, with %P ranging over the interval between the two bounds.
+	flag.StringVar(&bounds, "interval", "", "-e \"SQR(%P) * 2\" -interval 6.9,7.1")
+
+	// Prints the derivative of the expression with respect to the named variable instead of evaluating it.
+	flag.StringVar(&derivative, "d", "", "-e \"SIN(x) * x\" -d x")
+
+	// Prints the values of %P between the two bounds at which the expression is zero, or at which both sides of an
+	// equation such as %P ** 2 == 2 are equal, instead of evaluating it.
+	flag.StringVar(&solve, "solve", "", "-e \"%P ** 2 == 2\" -solve 0,10")
+
+	// Formats files of formulas, one per line, instead of evaluating an expression. Reads stdin when no files are given.
+	flag.BoolVar(&format, "fmt", false, "-fmt rules.txt")
+
+	// With -fmt, writes the formatted formulas back to their files instead of printing them.
+	flag.BoolVar(&write, "w", false, "-fmt -w rules.txt")
 	flag.Parse()
+
+	if format {
+		if !formatFiles(flag.Args(), write) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(strings.TrimSpace(expression)) <= 0 {
 		log.Fatalln("An expression must be provided with the 'e' flag")
 	}
 
-	evaluated, err := parser.EvalV(expression, variable)
+	modes := 0
+	for _, set := range []bool{precision > 0, division != "", complex, units, bounds != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatalln("Only one of the 'decimal', 'bigint', 'complex', 'units' and 'interval' flags may be given")
+	}
+
+	switch {
+	case precision > 0:
+		parser = expr.NewParser(expr.DecimalMode(precision, big.ToNearestEven))
+	case complex:
+		parser = expr.NewParser(expr.ComplexMode())
+	case units:
+		parser = expr.NewParser(expr.UnitMode())
+	case division == "trunc":
+		parser = expr.NewParser(expr.IntegerMode(expr.TruncatedDivision))
+	case division == "floor":
+		parser = expr.NewParser(expr.IntegerMode(expr.FlooredDivision))
+	case division != "":
+		log.Fatalln("The 'bigint' flag must be either trunc or floor")
+	}
+
+	value := expr.FloatValue(variable)
+	if bounds != "" {
+		lo, hi, ok := parseBounds(bounds)
+		if !ok {
+			log.Fatalln("The 'interval' flag must be two numbers separated by a comma")
+		}
+		parser, value = expr.NewParser(expr.IntervalMode()), expr.IntervalValue(lo, hi)
+	}
+
+	if derivative != "" {
+		node, err := parser.D(expression, derivative)
+		if err != nil {
+			fmt.Fprint(os.Stderr, annotate(expression, err))
+			os.Exit(1)
+		}
+		fmt.Println(ast.Format(node))
+		return
+	}
+
+	if solve != "" {
+		lo, hi, ok := parseBounds(solve)
+		if !ok {
+			log.Fatalln("The 'solve' flag must be two numbers separated by a comma")
+		}
+
+		roots, err := solveRoots(expression, lo, hi)
+		if err != nil {
+			fmt.Fprint(os.Stderr, annotate(expression, err))
+			os.Exit(1)
+		}
+
+		for _, root := range roots {
+			log.Printf("Solved -> %%P = %v\n", root)
+		}
+		return
+	}
+
+	prog, err := parser.CompileOptimized(expression)
+	if err != nil {
+		fmt.Fprint(os.Stderr, annotate(expression, err))
+		os.Exit(1)
+	}
+
+	if reduce {
+		log.Printf("Reduced -> %v\n", prog)
+	}
+
+	evaluated, err := prog.EvalValue(expr.Values{"%P": value})
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprint(os.Stderr, annotate(expression, err))
+		os.Exit(1)
 	}
 	log.Printf("Evaluated -> %v\n", evaluated)
 }
+
+// Formats each formula of the named files, or of stdin when there are none, reporting whether all of them were valid.
+// Files containing an invalid formula are left unchanged.
+func formatFiles(paths []string, write bool) bool {
+	if len(paths) == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out, ok := formatSource("<stdin>", string(src))
+		if ok {
+			fmt.Print(out)
+		}
+		return ok
+	}
+
+	valid := true
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			valid = false
+			continue
+		}
+
+		out, ok := formatSource(path, string(src))
+		switch {
+		case !ok:
+			valid = false
+		case write:
+			if err := os.WriteFile(path, []byte(out), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				valid = false
+			}
+		default:
+			fmt.Print(out)
+		}
+	}
+	return valid
+}
+
+// Formats each non-blank line of src as a formula, reporting errors against the line they were found on.
+func formatSource(name, src string) (string, bool) {
+	lines := strings.Split(src, "\n")
+	valid := true
+	for ix, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[ix] = ""
+			continue
+		}
+
+		formatted, err := parser.Format(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v:%v: %v", name, ix+1, annotate(line, err))
+			valid = false
+			continue
+		}
+		lines[ix] = formatted
+	}
+	return strings.Join(lines, "\n"), valid
+}
+
+// Renders err beneath the line of the expression it refers to, marking the offending span with ^~~~
+// and following it with a hint when one is known.
+func annotate(expression string, err error) string {
+	var pos expr.Position
+	var code expr.ErrorCode
+	var hint string
+	var syntaxErr expr.SyntaxError
+	var evalErr expr.EvalError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		pos, code, hint = syntaxErr.Position, syntaxErr.Code, syntaxErr.Hint
+	case errors.As(err, &evalErr):
+		pos, code, hint = evalErr.Position, evalErr.Code, evalErr.Hint
+	default:
+		return fmt.Sprintf("error: %v\n", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "error: %v (%v)\n", err, code)
+	if pos.Line < 1 || pos.Offset > len(expression) {
+		return sb.String()
+	}
+
+	lineStart := strings.LastIndex(expression[:pos.Offset], "\n") + 1
+	lineEnd := len(expression)
+	if ix := strings.Index(expression[pos.Offset:], "\n"); ix >= 0 {
+		lineEnd = pos.Offset + ix
+	}
+
+	// Tabs are copied into the marker's indent so it stays aligned however the terminal expands them
+	line := expression[lineStart:lineEnd]
+	indent := strings.Map(func(ch rune) rune {
+		if ch == '\t' {
+			return ch
+		}
+		return ' '
+	}, expression[lineStart:pos.Offset])
+
+	width := utf8.RuneCountInString(expression[pos.Offset:clamp(pos.End, pos.Offset, lineEnd)])
+	marker := "^" + strings.Repeat("~", clamp(width-1, 0, width))
+
+	fmt.Fprintf(&sb, "  %v\n  %v%v\n", line, indent, marker)
+	if hint != "" {
+		fmt.Fprintf(&sb, "hint: %v\n", hint)
+	}
+	return sb.String()
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// Finds the values of %P between lo and hi at which the expression is zero, or at which both sides are
+// equal when it is an equation.
+func solveRoots(expression string, lo, hi float64) ([]float64, error) {
+	node, err := parser.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if eq, ok := node.(*ast.BinaryExpr); ok && eq.Op == ast.Eq {
+		node = &ast.BinaryExpr{Span: eq.Span, Op: ast.Sub, X: eq.X, Y: eq.Y}
+	}
+
+	prog, err := parser.CompileNode(node)
+	if err != nil {
+		return nil, err
+	}
+	return prog.Roots(0, "%P", lo, hi, nil)
+}
+
+// Parses the bounds of the interval and solve flags, written as LO,HI.
+func parseBounds(bounds string) (float64, float64, bool) {
+	lo, hi, ok := strings.Cut(bounds, ",")
+	if !ok {
+		return 0, 0, false
+	}
+
+	a, errA := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+	b, errB := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+	return a, b, errA == nil && errB == nil
+}